@@ -4,35 +4,52 @@ import (
 	"log"
 	"net/http"
 
-	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
 
-	"github.com/alfonsodev/automerge-repo-go/repo"
+	"github.com/automerge/automerge-repo-go"
+	network "github.com/automerge/automerge-repo-network-websocket-go"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+// HandlerOptions configures AutomergeRepoHandlerWithOptions.
+type HandlerOptions struct {
+	// CheckOrigin decides whether to upgrade a request. Nil accepts requests
+	// from any origin.
+	CheckOrigin func(r *http.Request) bool
+	// Auth authenticates peers during the handshake. The identity it returns
+	// is attached to the connection for the repo's share policy.
+	Auth repo.Authenticator
+	// Keepalive configures the liveness checks of each connection. Nil
+	// selects network.DefaultKeepalive; a zero Keepalive turns them off.
+	Keepalive *network.Keepalive
 }
 
 // AutomergeRepoHandler returns an Echo handler function that upgrades the connection
-// to a WebSocket and bridges it with the Automerge repository.
+// to a WebSocket and bridges it with the Automerge repository. Connections
+// use network.DefaultKeepalive.
 func AutomergeRepoHandler(handle *repo.RepoHandle) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
-		if err != nil {
-			log.Printf("failed to upgrade connection: %v", err)
-			return err
-		}
-		defer ws.Close()
+	return AutomergeRepoHandlerWithOptions(handle, HandlerOptions{})
+}
 
-		conn := repo.NewWSConnAdapter(ws)
-		remoteID, err := repo.Handshake(c.Request().Context(), conn, handle.Repo.ID, repo.Incoming)
+// AutomergeRepoHandlerWithOptions is AutomergeRepoHandler with an origin check,
+// an Authenticator and keepalive settings.
+func AutomergeRepoHandlerWithOptions(handle *repo.RepoHandle, opts HandlerOptions) echo.HandlerFunc {
+	checkOrigin := opts.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = func(r *http.Request) bool {
+			return true
+		}
+	}
+	return func(c echo.Context) error {
+		conn, remoteID, err := network.AcceptWebSocketWithOptions(c.Response(), c.Request(), handle.Repo.ID, network.AcceptOptions{
+			CheckOrigin: checkOrigin,
+			Auth:        opts.Auth,
+			Keepalive:   opts.Keepalive,
+		})
 		if err != nil {
-			log.Printf("handshake failed: %v", err)
+			log.Printf("failed to accept connection: %v", err)
 			return err
 		}
+		defer conn.Close()
 
 		// Bridge the WebSocket connection with the repo's network adapter.
 		// This will handle the Automerge sync protocol.
@@ -0,0 +1,85 @@
+package echo_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/automerge/automerge-repo-go"
+	amecho "github.com/automerge/automerge-repo-echo-go"
+	network "github.com/automerge/automerge-repo-network-websocket-go"
+)
+
+func serve(t *testing.T, h echo.HandlerFunc) string {
+	t.Helper()
+	e := echo.New()
+	e.GET("/ws", h)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+func TestHandlerAuthenticatesPeers(t *testing.T) {
+	server := repo.NewRepoHandle(repo.New())
+	defer server.Close()
+	auth := repo.AuthenticatorFunc(func(ctx context.Context, req repo.AuthRequest) (*repo.Identity, error) {
+		if req.Metadata["token"] != "secret" {
+			return nil, errors.New("bad token")
+		}
+		return &repo.Identity{Subject: "alice"}, nil
+	})
+	url := serve(t, amecho.AutomergeRepoHandlerWithOptions(server, amecho.HandlerOptions{Auth: auth}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	client := repo.New()
+	// requests from other origins are accepted unless CheckOrigin says otherwise
+	conn, remote, err := network.DialWebSocketWithOptions(ctx, url, client.ID, network.DialOptions{
+		Header:   http.Header{"Origin": {"https://other.example"}},
+		Metadata: repo.PeerMetadata{"token": "secret"},
+	})
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	if remote != server.Repo.ID {
+		t.Fatalf("unexpected remote %s", remote)
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		if id := server.PeerIdentity(client.ID); id != nil && id.Subject == "alice" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("identity not attached to the connection")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, _, err := network.DialWebSocket(ctx, url, repo.New().ID); err == nil {
+		t.Fatalf("expected unauthenticated peer to be refused")
+	}
+}
+
+func TestHandlerCheckOrigin(t *testing.T) {
+	server := repo.NewRepoHandle(repo.New())
+	defer server.Close()
+	allow := func(r *http.Request) bool { return r.Header.Get("Origin") == "https://app.example" }
+	url := serve(t, amecho.AutomergeRepoHandlerWithOptions(server, amecho.HandlerOptions{CheckOrigin: allow}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := network.DialWebSocketWithOptions(ctx, url, repo.New().ID, network.DialOptions{Header: http.Header{"Origin": {"https://evil.example"}}}); err == nil {
+		t.Fatalf("expected foreign origin to be refused")
+	}
+	conn, _, err := network.DialWebSocketWithOptions(ctx, url, repo.New().ID, network.DialOptions{Header: http.Header{"Origin": {"https://app.example"}}})
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,31 @@
+module github.com/automerge/automerge-repo-echo-go
+
+go 1.24.5
+
+require (
+	github.com/automerge/automerge-repo-go v0.0.0-00010101000000-000000000000
+	github.com/automerge/automerge-repo-network-websocket-go v0.0.0-00010101000000-000000000000
+	github.com/labstack/echo/v4 v4.13.4
+)
+
+require (
+	github.com/automerge/automerge-go v0.0.0-20241030180337-6fb4f2d08244 // indirect
+	github.com/fxamacker/cbor/v2 v2.9.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/labstack/gommon v0.4.2 // indirect
+	github.com/mattn/go-colorable v0.1.14 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/valyala/fasttemplate v1.2.2 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/crypto v0.38.0 // indirect
+	golang.org/x/net v0.40.0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+	golang.org/x/text v0.25.0 // indirect
+)
+
+replace (
+	github.com/automerge/automerge-repo-go => ../../automerge-repo-go
+	github.com/automerge/automerge-repo-network-websocket-go => ../../automerge-repo-network-websocket-go
+)
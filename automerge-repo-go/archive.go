@@ -0,0 +1,214 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/uuid"
+)
+
+// archiveFormat identifies archives written by Repo.Export.
+const archiveFormat = "automerge-repo-archive"
+
+// archiveVersion is the current archive format version.
+const archiveVersion = 1
+
+// archiveHeader is the first CBOR item of an archive.
+type archiveHeader struct {
+	Format  string `cbor:"format"`
+	Version int    `cbor:"version"`
+	RepoID  string `cbor:"repoId"`
+	Created int64  `cbor:"created"`
+}
+
+// archiveRecord is a single document, or the trailing "end" record that
+// marks a complete archive.
+type archiveRecord struct {
+	Type       string `cbor:"type"`
+	DocumentID string `cbor:"documentId,omitempty"`
+	Data       []byte `cbor:"data,omitempty"`
+	Checksum   []byte `cbor:"sha256,omitempty"`
+	Count      int    `cbor:"count,omitempty"`
+}
+
+// ErrArchiveCorrupt is returned by Import when an archive fails validation.
+var ErrArchiveCorrupt = errors.New("corrupt archive")
+
+// Export streams every document in the repo's store to w as a versioned CBOR
+// archive. Each document is written as a full snapshot with a SHA-256
+// checksum, independent of how the store lays out its files. Changes that
+// have not been saved to the store are not included.
+func (r *Repo) Export(w io.Writer) error {
+	if r.store == nil {
+		return fmt.Errorf("no store configured")
+	}
+	ids, err := r.store.List()
+	if err != nil {
+		return err
+	}
+	enc := cbor.NewEncoder(w)
+	header := archiveHeader{
+		Format:  archiveFormat,
+		Version: archiveVersion,
+		RepoID:  r.ID.String(),
+		Created: time.Now().UnixMilli(),
+	}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		doc, err := r.store.Load(id)
+		if err != nil {
+			return fmt.Errorf("export %s: %w", id, err)
+		}
+		doc.ensureDoc()
+		data := doc.Doc.Save()
+		sum := sha256.Sum256(data)
+		rec := archiveRecord{Type: "doc", DocumentID: id.String(), Data: data, Checksum: sum[:]}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return enc.Encode(archiveRecord{Type: "end", Count: len(ids)})
+}
+
+// ImportOptions control Repo.Import.
+type ImportOptions struct {
+	// RestoreDeleted imports documents that were removed with Repo.Delete.
+	// By default they are skipped, so that restoring an old backup does not
+	// bring deleted documents back.
+	RestoreDeleted bool
+}
+
+// stagedDoc is a document read from an archive that has not been imported yet.
+type stagedDoc struct {
+	id  DocumentID
+	doc *automerge.Doc
+}
+
+// Import reads an archive written by Export. Documents that already exist in
+// memory or in the store are merged with the archived copy rather than
+// replaced, so importing onto a live repo never discards changes. Documents
+// that were deleted from the repo are skipped unless RestoreDeleted is set.
+// Imported documents are saved when a store is configured.
+//
+// The whole archive is read and checked before any document is imported, so
+// a corrupt or truncated archive leaves the repo unchanged.
+func (r *Repo) Import(rd io.Reader, opts ...ImportOptions) error {
+	var o ImportOptions
+	for _, opt := range opts {
+		if opt.RestoreDeleted {
+			o.RestoreDeleted = true
+		}
+	}
+	staged, err := readArchive(rd)
+	if err != nil {
+		return err
+	}
+	for _, sd := range staged {
+		if !o.RestoreDeleted && r.isDeleted(sd.id) {
+			continue
+		}
+		if err := r.importDoc(sd.id, sd.doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readArchive decodes and checks every document in an archive.
+func readArchive(rd io.Reader) ([]stagedDoc, error) {
+	dec := cbor.NewDecoder(rd)
+	var header archiveHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("%w: reading header: %v", ErrArchiveCorrupt, err)
+	}
+	if header.Format != archiveFormat {
+		return nil, fmt.Errorf("%w: unexpected format %q", ErrArchiveCorrupt, header.Format)
+	}
+	if header.Version != archiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", header.Version)
+	}
+	var staged []stagedDoc
+	for {
+		var rec archiveRecord
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("%w: missing end record", ErrArchiveCorrupt)
+			}
+			return nil, fmt.Errorf("%w: %v", ErrArchiveCorrupt, err)
+		}
+		switch rec.Type {
+		case "doc":
+			sd, err := readRecord(rec)
+			if err != nil {
+				return nil, err
+			}
+			staged = append(staged, sd)
+		case "end":
+			if rec.Count != len(staged) {
+				return nil, fmt.Errorf("%w: expected %d documents, read %d", ErrArchiveCorrupt, rec.Count, len(staged))
+			}
+			return staged, nil
+		default:
+			return nil, fmt.Errorf("%w: unexpected record %q", ErrArchiveCorrupt, rec.Type)
+		}
+	}
+}
+
+func readRecord(rec archiveRecord) (stagedDoc, error) {
+	id, err := uuid.Parse(rec.DocumentID)
+	if err != nil {
+		return stagedDoc{}, fmt.Errorf("%w: invalid document id %q", ErrArchiveCorrupt, rec.DocumentID)
+	}
+	sum := sha256.Sum256(rec.Data)
+	if !bytes.Equal(sum[:], rec.Checksum) {
+		return stagedDoc{}, fmt.Errorf("%w: checksum mismatch for document %s", ErrArchiveCorrupt, id)
+	}
+	doc, err := automerge.Load(rec.Data)
+	if err != nil {
+		return stagedDoc{}, fmt.Errorf("%w: document %s: %v", ErrArchiveCorrupt, id, err)
+	}
+	return stagedDoc{id: id, doc: doc}, nil
+}
+
+// importDoc merges an archived document into the repo.
+func (r *Repo) importDoc(id DocumentID, incoming *automerge.Doc) error {
+	doc, ok := r.getDoc(id, pinSync)
+	if !ok && r.store != nil {
+		if stored, err := r.store.Load(id); err == nil {
+			doc, ok = stored, true
+			doc.pin(pinSync)
+			r.putDoc(doc)
+		}
+	}
+	if ok {
+		defer doc.unpin(pinSync)
+		if _, err := doc.merge(incoming, ChangeOrigin{Kind: OriginStorage}); err != nil {
+			return err
+		}
+	} else {
+		doc = &Document{ID: id, Doc: incoming}
+		r.putDoc(doc)
+	}
+	r.mu.Lock()
+	_, restored := r.deleted[id]
+	delete(r.deleted, id)
+	r.mu.Unlock()
+
+	if r.store == nil {
+		return nil
+	}
+	if ts, ok := r.store.(TombstoneStorage); ok && restored {
+		if err := ts.RemoveTombstone(id); err != nil {
+			return err
+		}
+	}
+	return r.SaveDoc(id)
+}
@@ -0,0 +1,170 @@
+package repo
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestRepoExportImport(t *testing.T) {
+	src := NewWithStore(newMemStore())
+	a := src.NewDoc()
+	if err := a.Set("name", "alpha"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	b := src.NewDoc()
+	if err := b.Set("name", "beta"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	for _, id := range []DocumentID{a.ID, b.ID} {
+		if err := src.SaveDoc(id); err != nil {
+			t.Fatalf("save err: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := src.Export(&buf); err != nil {
+		t.Fatalf("export err: %v", err)
+	}
+
+	// the destination already has a diverged copy of a
+	dstStore := newMemStore()
+	dst := NewWithStore(dstStore)
+	fork, err := a.Doc.Fork()
+	if err != nil {
+		t.Fatalf("fork err: %v", err)
+	}
+	existing := &Document{ID: a.ID, Doc: fork}
+	if err := existing.Set("extra", "kept"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	dst.putDoc(existing)
+	if err := a.Set("name", "alpha2"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := src.SaveDoc(a.ID); err != nil {
+		t.Fatalf("save err: %v", err)
+	}
+	buf.Reset()
+	if err := src.Export(&buf); err != nil {
+		t.Fatalf("export err: %v", err)
+	}
+
+	if err := dst.Import(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("import err: %v", err)
+	}
+
+	merged, ok := dst.GetDoc(a.ID)
+	if !ok {
+		t.Fatalf("document a missing after import")
+	}
+	if v, _ := merged.Get("name"); v != "alpha2" {
+		t.Fatalf("expected archived change to be merged, got %v", v)
+	}
+	if v, _ := merged.Get("extra"); v != "kept" {
+		t.Fatalf("expected local change to survive import, got %v", v)
+	}
+	stored, err := dstStore.Load(b.ID)
+	if err != nil {
+		t.Fatalf("imported document not saved: %v", err)
+	}
+	if v, _ := stored.Get("name"); v != "beta" {
+		t.Fatalf("unexpected imported value: %v", v)
+	}
+}
+
+func TestRepoImportRejectsCorruptArchive(t *testing.T) {
+	src := NewWithStore(newMemStore())
+	doc := src.NewDoc()
+	if err := doc.Set("k", "v"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := src.SaveDoc(doc.ID); err != nil {
+		t.Fatalf("save err: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := src.Export(&buf); err != nil {
+		t.Fatalf("export err: %v", err)
+	}
+
+	// flip a byte inside the document snapshot
+	data := buf.Bytes()
+	snapshot := doc.Doc.Save()
+	i := bytes.Index(data, snapshot[:8])
+	if i < 0 {
+		t.Fatalf("snapshot not found in archive")
+	}
+	data[i+len(snapshot)/2] ^= 0xff
+
+	dst := New()
+	if err := dst.Import(bytes.NewReader(data)); !errors.Is(err, ErrArchiveCorrupt) {
+		t.Fatalf("expected ErrArchiveCorrupt, got %v", err)
+	}
+
+	// a truncated archive is rejected too
+	buf.Reset()
+	if err := src.Export(&buf); err != nil {
+		t.Fatalf("export err: %v", err)
+	}
+	if err := dst.Import(bytes.NewReader(buf.Bytes()[:buf.Len()-4])); !errors.Is(err, ErrArchiveCorrupt) {
+		t.Fatalf("expected ErrArchiveCorrupt for truncated archive, got %v", err)
+	}
+}
+
+func TestRepoImportSkipsDeletedDocs(t *testing.T) {
+	src := NewWithStore(newMemStore())
+	doc := src.NewDoc()
+	if err := doc.Set("k", "v"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := src.SaveDoc(doc.ID); err != nil {
+		t.Fatalf("save err: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := src.Export(&buf); err != nil {
+		t.Fatalf("export err: %v", err)
+	}
+	if err := src.Delete(doc.ID); err != nil {
+		t.Fatalf("delete err: %v", err)
+	}
+
+	if err := src.Import(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("import err: %v", err)
+	}
+	if _, ok := src.GetDoc(doc.ID); ok {
+		t.Fatalf("import resurrected a deleted document")
+	}
+	if err := src.Import(bytes.NewReader(buf.Bytes()), ImportOptions{RestoreDeleted: true}); err != nil {
+		t.Fatalf("import err: %v", err)
+	}
+	if _, ok := src.GetDoc(doc.ID); !ok {
+		t.Fatalf("RestoreDeleted did not restore the document")
+	}
+}
+
+func TestRepoImportIsAllOrNothing(t *testing.T) {
+	src := NewWithStore(newMemStore())
+	for i := 0; i < 3; i++ {
+		doc := src.NewDoc()
+		if err := doc.Set("i", int64(i)); err != nil {
+			t.Fatalf("set err: %v", err)
+		}
+		if err := src.SaveDoc(doc.ID); err != nil {
+			t.Fatalf("save err: %v", err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := src.Export(&buf); err != nil {
+		t.Fatalf("export err: %v", err)
+	}
+
+	// the first records are intact, the archive ends early
+	dstStore := newMemStore()
+	dst := NewWithStore(dstStore)
+	if err := dst.Import(bytes.NewReader(buf.Bytes()[:buf.Len()-4])); !errors.Is(err, ErrArchiveCorrupt) {
+		t.Fatalf("expected ErrArchiveCorrupt, got %v", err)
+	}
+	if ids, _ := dstStore.List(); len(ids) != 0 || len(dst.docIDs()) != 0 {
+		t.Fatalf("partial import left %d stored and %d resident documents", len(ids), len(dst.docIDs()))
+	}
+}
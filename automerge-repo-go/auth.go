@@ -0,0 +1,200 @@
+package repo
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// ErrUnauthorized is wrapped by handshake errors of peers rejected by an
+// Authenticator.
+var ErrUnauthorized = errors.New("peer not authorized")
+
+// PeerMetadata is the peerMetadata map of a join or peer message. Nested
+// maps decode as map[interface{}]interface{}.
+type PeerMetadata map[string]interface{}
+
+// Identity is who an Authenticator decided a peer is.
+type Identity struct {
+	// Subject names the user or service behind the peer.
+	Subject string
+	// Attributes holds any further facts share policies need, such as roles.
+	Attributes map[string]string
+}
+
+// AuthRequest describes a peer asking to join during the handshake.
+type AuthRequest struct {
+	// PeerID is the repo ID the peer claims, derived from SenderID.
+	PeerID   RepoID
+	SenderID string
+	Metadata PeerMetadata
+	// Request is the HTTP request of websocket connections.
+	Request *http.Request
+	// TLS is the connection state of TLS connections.
+	TLS        *tls.ConnectionState
+	RemoteAddr net.Addr
+}
+
+// Authenticator decides whether a peer may join. It runs on the accepting
+// side once the join message has arrived and before the peer is answered. An
+// error rejects the peer; otherwise the returned identity, which may be nil
+// for anonymous peers, is attached to the connection.
+//
+// The peer chooses PeerID itself. An Authenticator must check that the
+// credential it verifies is entitled to PeerID, for example by binding repo
+// IDs to users, or else one user could connect under another's repo ID.
+// AddConn refuses to replace an authenticated connection with one of a
+// different Subject, but it cannot tell which of two connections is genuine
+// when the first is anonymous.
+type Authenticator interface {
+	Authenticate(ctx context.Context, req AuthRequest) (*Identity, error)
+}
+
+// AuthenticatorFunc adapts a function into an Authenticator.
+type AuthenticatorFunc func(ctx context.Context, req AuthRequest) (*Identity, error)
+
+// Authenticate calls f.
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, req AuthRequest) (*Identity, error) {
+	return f(ctx, req)
+}
+
+// Authenticate runs a on req, filling in the peer fields from the join
+// message, and wraps rejections in ErrUnauthorized. A nil a accepts every
+// peer anonymously.
+func Authenticate(ctx context.Context, a Authenticator, req AuthRequest, senderID string, md PeerMetadata) (*Identity, error) {
+	if a == nil {
+		return nil, nil
+	}
+	req.PeerID = parseRepoID(senderID)
+	req.SenderID = senderID
+	req.Metadata = md
+	id, err := a.Authenticate(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	return id, nil
+}
+
+// Authenticated is implemented by connections that carry the identity an
+// Authenticator attached to the peer. AddConn records it for PeerIdentity.
+type Authenticated interface {
+	Identity() *Identity
+}
+
+type identityConn struct {
+	Conn
+	id *Identity
+}
+
+func (c identityConn) Identity() *Identity { return c.id }
+
+// WithIdentity attaches id to c for AddConn.
+func WithIdentity(c Conn, id *Identity) Conn {
+	return identityConn{Conn: c, id: id}
+}
+
+// AcceptHandshake performs the accepting side of Handshake, running auth on
+// the join message before answering. req supplies the transport details of
+// the AuthRequest.
+func AcceptHandshake(ctx context.Context, rw io.ReadWriter, id RepoID, auth Authenticator, req AuthRequest) (RepoID, *Identity, error) {
+	if conn, ok := rw.(interface{ SetDeadline(time.Time) error }); ok {
+		if d, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(d)
+			defer conn.SetDeadline(time.Time{})
+		}
+	}
+
+	// decode a byte at a time, so that nothing after the join message, such
+	// as the first sync message, is consumed here
+	var join handshakeMessage
+	if err := cbor.NewDecoder(byteReader{rw}).Decode(&join); err != nil {
+		return RepoID{}, nil, err
+	}
+	if join.Type != "join" {
+		return RepoID{}, nil, fmt.Errorf("unexpected message %q", join.Type)
+	}
+	ident, err := Authenticate(ctx, auth, req, join.SenderID, join.PeerMetadata)
+	if err != nil {
+		return RepoID{}, nil, err
+	}
+	if err := cbor.NewEncoder(rw).Encode(handshakeMessage{Type: "peer", SenderID: id.String()}); err != nil {
+		return RepoID{}, nil, err
+	}
+	return parseRepoID(join.SenderID), ident, nil
+}
+
+// byteReader reads at most one byte per call from r.
+type byteReader struct {
+	r io.Reader
+}
+
+func (b byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return b.r.Read(p)
+}
+
+// PeerIdentity returns the identity attached to the current connection of a
+// peer, or nil.
+func (h *RepoHandle) PeerIdentity(remote RepoID) *Identity {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if pi, ok := h.peers[remote]; ok {
+		return pi.identity
+	}
+	return nil
+}
+
+// IdentityPolicy is implemented by share policies that decide from the
+// identity an Authenticator attached to the connection a document travels
+// over. RepoHandle calls ShareWithIdentity instead of the SharePolicy methods
+// for them, for syncing, requesting and announcing alike, with a nil
+// identity for connections that were not authenticated. A policy wrapping
+// others implements it to pass the identity on.
+type IdentityPolicy interface {
+	ShareWithIdentity(peer RepoID, doc DocumentID, id *Identity) ShareDecision
+}
+
+// IdentitySharePolicy is an IdentityPolicy deciding from the document and the
+// identity alone. Called through the SharePolicy methods, which only know the
+// peer's claimed ID, it sees a nil identity.
+type IdentitySharePolicy func(doc DocumentID, id *Identity) ShareDecision
+
+// ShareWithIdentity calls f.
+func (f IdentitySharePolicy) ShareWithIdentity(_ RepoID, doc DocumentID, id *Identity) ShareDecision {
+	return f(doc, id)
+}
+
+// ShouldSync calls f with a nil identity.
+func (f IdentitySharePolicy) ShouldSync(doc DocumentID, _ RepoID) ShareDecision { return f(doc, nil) }
+
+// ShouldRequest calls f with a nil identity.
+func (f IdentitySharePolicy) ShouldRequest(doc DocumentID, _ RepoID) ShareDecision { return f(doc, nil) }
+
+// ShouldAnnounce calls f with a nil identity.
+func (f IdentitySharePolicy) ShouldAnnounce(doc DocumentID, _ RepoID) ShareDecision { return f(doc, nil) }
+
+// shareDecision asks the repo's share policy about doc and the peer on
+// connection pi, which may be nil. decide is one of the SharePolicy methods.
+func (h *RepoHandle) shareDecision(decide func(SharePolicy, DocumentID, RepoID) ShareDecision, doc DocumentID, remote RepoID, pi *peerInfo) ShareDecision {
+	switch p := h.Repo.sharePolicy.(type) {
+	case nil:
+		return Share
+	case IdentityPolicy:
+		var id *Identity
+		if pi != nil {
+			id = pi.identity
+		}
+		return p.ShareWithIdentity(remote, doc, id)
+	default:
+		return decide(p, doc, remote)
+	}
+}
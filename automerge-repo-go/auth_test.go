@@ -0,0 +1,253 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func tokenAuth(seen chan<- AuthRequest) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, req AuthRequest) (*Identity, error) {
+		seen <- req
+		if req.Metadata["token"] != "secret" {
+			return nil, errors.New("bad token")
+		}
+		return &Identity{Subject: "alice", Attributes: map[string]string{"role": "editor"}}, nil
+	})
+}
+
+func TestTCPTransportAuth(t *testing.T) {
+	seen := make(chan AuthRequest, 2)
+	serverTr := &TCPTransport{Auth: tokenAuth(seen)}
+	ln, err := serverTr.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	server, client := New(), New()
+
+	type result struct {
+		lp  *LPConn
+		err error
+	}
+	dial := func(token string) (result, error) {
+		accepted := make(chan result, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				accepted <- result{err: err}
+				return
+			}
+			lp, _, err := serverTr.Handshake(context.Background(), conn, server.ID, Incoming)
+			if err != nil {
+				conn.Close()
+			}
+			accepted <- result{lp, err}
+		}()
+		tr := &TCPTransport{Metadata: PeerMetadata{"token": token}}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		lp, _, err := tr.Dial(ctx, ln.Addr().String(), client.ID)
+		if err == nil {
+			defer lp.Close()
+		}
+		return <-accepted, err
+	}
+
+	res, err := dial("secret")
+	if err != nil || res.err != nil {
+		t.Fatalf("handshake failed: %v / %v", err, res.err)
+	}
+	defer res.lp.Close()
+	if id := res.lp.Identity(); id == nil || id.Subject != "alice" {
+		t.Fatalf("unexpected identity %+v", id)
+	}
+	if req := <-seen; req.PeerID != client.ID || req.RemoteAddr == nil {
+		t.Fatalf("unexpected auth request %+v", req)
+	}
+
+	res, err = dial("wrong")
+	if !errors.Is(res.err, ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %v", res.err)
+	}
+	if err == nil {
+		t.Fatalf("expected rejected dial to fail")
+	}
+}
+
+func TestAcceptHandshake(t *testing.T) {
+	seen := make(chan AuthRequest, 1)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	server, client := New(), New()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := Handshake(context.Background(), c1, client.ID, Outgoing)
+		errCh <- err
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	remote, ident, err := AcceptHandshake(ctx, c2, server.ID, AuthenticatorFunc(func(ctx context.Context, req AuthRequest) (*Identity, error) {
+		seen <- req
+		return &Identity{Subject: req.SenderID}, nil
+	}), AuthRequest{})
+	if err != nil || <-errCh != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if remote != client.ID || ident == nil || ident.Subject != client.ID.String() {
+		t.Fatalf("unexpected result %s %+v", remote, ident)
+	}
+}
+
+func TestAcceptHandshakeLeavesFollowingData(t *testing.T) {
+	var in bytes.Buffer
+	client := New()
+	if err := cbor.NewEncoder(&in).Encode(handshakeMessage{Type: "join", SenderID: client.ID.String()}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	// the peer's first sync message arrives right behind the join
+	in.WriteString("next message")
+	var out bytes.Buffer
+	remote, _, err := AcceptHandshake(context.Background(), readWriter{&in, &out}, New().ID, nil, AuthRequest{})
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if remote != client.ID {
+		t.Fatalf("unexpected remote %s", remote)
+	}
+	if in.String() != "next message" {
+		t.Fatalf("handshake consumed the following data, %q left", in.String())
+	}
+}
+
+// readWriter reads from the embedded buffer and writes to w.
+type readWriter struct {
+	*bytes.Buffer
+	w *bytes.Buffer
+}
+
+func (rw readWriter) Write(p []byte) (int, error) { return rw.w.Write(p) }
+
+// peerFilter is a share policy refusing some peers outright and leaving the
+// rest to an identity policy.
+type peerFilter struct {
+	deny  map[RepoID]bool
+	inner IdentityPolicy
+}
+
+func (p peerFilter) ShareWithIdentity(peer RepoID, doc DocumentID, id *Identity) ShareDecision {
+	if p.deny[peer] {
+		return DontShare
+	}
+	return p.inner.ShareWithIdentity(peer, doc, id)
+}
+
+func (p peerFilter) ShouldSync(doc DocumentID, peer RepoID) ShareDecision {
+	return p.ShareWithIdentity(peer, doc, nil)
+}
+
+func (p peerFilter) ShouldRequest(doc DocumentID, peer RepoID) ShareDecision {
+	return p.ShareWithIdentity(peer, doc, nil)
+}
+
+func (p peerFilter) ShouldAnnounce(doc DocumentID, peer RepoID) ShareDecision {
+	return p.ShareWithIdentity(peer, doc, nil)
+}
+
+func TestIdentitySharePolicy(t *testing.T) {
+	editors := IdentitySharePolicy(func(_ DocumentID, id *Identity) ShareDecision {
+		if id != nil && id.Attributes["role"] == "editor" {
+			return Share
+		}
+		return DontShare
+	})
+	t.Run("func", func(t *testing.T) { testIdentitySharePolicy(t, editors) })
+	t.Run("wrapped", func(t *testing.T) { testIdentitySharePolicy(t, peerFilter{inner: editors}) })
+}
+
+func testIdentitySharePolicy(t *testing.T, policy SharePolicy) {
+	r := New().WithSharePolicy(policy)
+	h := NewRepoHandle(r)
+	editor := NewRepoHandle(New())
+	anon := NewRepoHandle(New())
+	defer h.Close()
+	defer editor.Close()
+	defer anon.Close()
+
+	alice := &Identity{Subject: "alice", Attributes: map[string]string{"role": "editor"}}
+	c1, c2 := newMockConn()
+	editorDone := h.AddConn(editor.Repo.ID, WithIdentity(c1, alice))
+	_ = editor.AddConn(r.ID, c2)
+	c3, c4 := newMockConn()
+	_ = h.AddConn(anon.Repo.ID, c3)
+	_ = anon.AddConn(r.ID, c4)
+	if got := h.PeerIdentity(editor.Repo.ID); got != alice {
+		t.Fatalf("unexpected identity %+v", got)
+	}
+	if h.PeerIdentity(anon.Repo.ID) != nil {
+		t.Fatalf("anonymous peer has an identity")
+	}
+
+	doc := r.NewDoc()
+	if err := doc.Set("k", "v"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	_ = h.SyncDocument(editor.Repo.ID, doc.ID)
+	_ = h.SyncDocument(anon.Repo.ID, doc.ID)
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := editor.Repo.GetDoc(doc.ID); !ok {
+		t.Fatalf("document not shared with editor")
+	}
+	if _, ok := anon.Repo.GetDoc(doc.ID); ok {
+		t.Fatalf("document shared with anonymous peer")
+	}
+
+	h.RemoveConn(editor.Repo.ID)
+	editorDone.Await()
+	if h.PeerIdentity(editor.Repo.ID) != nil {
+		t.Fatalf("identity kept after disconnect")
+	}
+}
+
+func TestAddConnDuplicatePeer(t *testing.T) {
+	h := NewRepoHandle(New())
+	defer h.Close()
+	peer := New().ID
+	alice := &Identity{Subject: "alice"}
+
+	c1, _ := newMockConn()
+	first := h.AddConn(peer, WithIdentity(c1, alice))
+
+	// an anonymous connection or another user cannot take over the peer
+	for _, id := range []*Identity{nil, {Subject: "mallory"}} {
+		c, _ := newMockConn()
+		var conn Conn = c
+		if id != nil {
+			conn = WithIdentity(c, id)
+		}
+		if res := h.AddConn(peer, conn).Await(); !errors.Is(res.Err, ErrPeerIdentity) {
+			t.Fatalf("expected ErrPeerIdentity, got %+v", res)
+		}
+		if got := h.PeerIdentity(peer); got != alice {
+			t.Fatalf("identity replaced with %+v", got)
+		}
+	}
+
+	// the same user reconnecting replaces and closes the old connection
+	c2, _ := newMockConn()
+	second := h.AddConn(peer, WithIdentity(c2, &Identity{Subject: "alice"}))
+	if res := first.Await(); res.Kind != ConnFinishedLocalClose {
+		t.Fatalf("old connection not closed: %+v", res)
+	}
+	if got := h.PeerIdentity(peer); got == nil || got == alice {
+		t.Fatalf("unexpected identity %+v", got)
+	}
+	h.RemoveConn(peer)
+	second.Await()
+}
@@ -0,0 +1,280 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrBranchExists is returned by Branches.Create for a name already in use.
+	ErrBranchExists = errors.New("branch already exists")
+	// ErrBranchNotFound is returned for a branch name that is not recorded.
+	ErrBranchNotFound = errors.New("branch not found")
+)
+
+// BranchesType is the TypeKey value of branch metadata documents.
+const BranchesType = "branches"
+
+// Branch describes a named branch of a document.
+type Branch struct {
+	Name string
+	// DocumentID is the branch's own document, a clone of the main document.
+	DocumentID DocumentID
+	// Base holds the heads of the main document the branch was created from.
+	Base    []automerge.ChangeHash
+	Created time.Time
+	// Merges lists, oldest first, the branch heads merged into the main
+	// document.
+	Merges []BranchMerge
+}
+
+// BranchMerge records one merge of a branch into the main document.
+type BranchMerge struct {
+	Heads []automerge.ChangeHash
+	Time  time.Time
+}
+
+// Branches manages the named branches of a main document. The branches are
+// recorded in a metadata document and each branch is a document of its own,
+// so both sync to peers like any other document.
+//
+// The metadata document has this layout:
+//
+//	{"@type": "branches", "main": "<id>", "branches": {"<name>": {
+//		"doc": "<id>", "base": ["<hash>"], "created": <time>,
+//		"merges": [{"heads": ["<hash>"], "at": <time>}]}}}
+type Branches struct {
+	repo *Repo
+	meta *DocumentHandle
+	main DocumentID
+}
+
+type branchesRecord struct {
+	Main     string                  `automerge:"main"`
+	Branches map[string]branchRecord `automerge:"branches"`
+}
+
+type branchRecord struct {
+	Doc     string        `automerge:"doc"`
+	Base    []string      `automerge:"base"`
+	Created time.Time     `automerge:"created"`
+	Merges  []mergeRecord `automerge:"merges"`
+}
+
+type mergeRecord struct {
+	Heads []string  `automerge:"heads"`
+	At    time.Time `automerge:"at"`
+}
+
+// NewBranches creates a metadata document tracking the branches of the
+// document main.
+func (r *Repo) NewBranches(main DocumentID) (*Branches, error) {
+	h, err := r.Find(main)
+	if err != nil {
+		return nil, err
+	}
+	h.Close()
+	meta := r.NewDocHandle()
+	if err := meta.WithDocMut(func(doc *automerge.Doc) error {
+		root := doc.RootMap()
+		if err := root.Set(TypeKey, BranchesType); err != nil {
+			return err
+		}
+		if err := root.Set("main", main.String()); err != nil {
+			return err
+		}
+		return root.Set("branches", automerge.NewMap())
+	}, CommitOptions{Message: "create branches"}); err != nil {
+		meta.Close()
+		return nil, err
+	}
+	return &Branches{repo: r, meta: meta, main: main}, nil
+}
+
+// OpenBranches opens the branch metadata document id.
+func (r *Repo) OpenBranches(id DocumentID) (*Branches, error) {
+	meta, err := r.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := GetPathAs[branchesRecord](meta)
+	if err == nil && rec.Main == "" {
+		err = fmt.Errorf("document %s is not a branches document", id)
+	}
+	var main DocumentID
+	if err == nil {
+		main, err = uuid.Parse(rec.Main)
+	}
+	if err != nil {
+		meta.Close()
+		return nil, err
+	}
+	return &Branches{repo: r, meta: meta, main: main}, nil
+}
+
+// ID returns the ID of the metadata document.
+func (b *Branches) ID() DocumentID {
+	return b.meta.DocID()
+}
+
+// Main returns the ID of the main document.
+func (b *Branches) Main() DocumentID {
+	return b.main
+}
+
+// Close releases the metadata document's handle.
+func (b *Branches) Close() {
+	b.meta.Close()
+}
+
+// Create clones the current state of the main document into a new branch
+// called name and returns a handle to the branch document.
+func (b *Branches) Create(name string) (*DocumentHandle, error) {
+	if _, err := b.Get(name); err == nil {
+		return nil, fmt.Errorf("branch %q: %w", name, ErrBranchExists)
+	}
+	h, err := b.repo.Clone(b.main)
+	if err != nil {
+		return nil, err
+	}
+	err = b.meta.SetPath([]interface{}{"branches", name}, map[string]interface{}{
+		"doc":     h.DocID().String(),
+		"base":    hashStrings(h.Heads()),
+		"created": time.Now(),
+		"merges":  []interface{}{},
+	})
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// Get returns the branch called name.
+func (b *Branches) Get(name string) (Branch, error) {
+	rec, err := GetPathAs[branchRecord](b.meta, "branches", name)
+	if errors.Is(err, ErrPathNotFound) {
+		return Branch{}, fmt.Errorf("branch %q: %w", name, ErrBranchNotFound)
+	}
+	if err != nil {
+		return Branch{}, err
+	}
+	return rec.branch(name)
+}
+
+// List returns all branches sorted by name.
+func (b *Branches) List() ([]Branch, error) {
+	rec, err := GetPathAs[branchesRecord](b.meta)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Branch, 0, len(rec.Branches))
+	for name, br := range rec.Branches {
+		branch, err := br.branch(name)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, branch)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// Open returns a handle to the document of the branch called name.
+func (b *Branches) Open(name string) (*DocumentHandle, error) {
+	br, err := b.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.repo.Find(br.DocumentID)
+}
+
+// Diff returns the patches from the branch's base heads to its current
+// state, that is the edits made on the branch.
+func (b *Branches) Diff(name string) ([]Patch, error) {
+	br, err := b.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	h, err := b.repo.Find(br.DocumentID)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+	return h.Diff(br.Base, nil)
+}
+
+// Merge merges the branch called name into the main document and records
+// the branch heads that were merged.
+func (b *Branches) Merge(name string) error {
+	br, err := b.Get(name)
+	if err != nil {
+		return err
+	}
+	src, err := b.repo.Find(br.DocumentID)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	heads := src.Heads()
+	main, err := b.repo.Find(b.main)
+	if err != nil {
+		return err
+	}
+	defer main.Close()
+	if err := main.MergeFrom(src); err != nil {
+		return err
+	}
+	merges, err := GetPathAs[[]mergeRecord](b.meta, "branches", name, "merges")
+	if err != nil {
+		return err
+	}
+	return b.meta.Insert([]interface{}{"branches", name, "merges"}, len(merges), map[string]interface{}{
+		"heads": hashStrings(heads),
+		"at":    time.Now(),
+	})
+}
+
+func (r branchRecord) branch(name string) (Branch, error) {
+	id, err := uuid.Parse(r.Doc)
+	if err != nil {
+		return Branch{}, fmt.Errorf("branch %q: %w", name, err)
+	}
+	base, err := parseHashes(r.Base)
+	if err != nil {
+		return Branch{}, fmt.Errorf("branch %q: %w", name, err)
+	}
+	br := Branch{Name: name, DocumentID: id, Base: base, Created: r.Created}
+	for _, m := range r.Merges {
+		heads, err := parseHashes(m.Heads)
+		if err != nil {
+			return Branch{}, fmt.Errorf("branch %q: %w", name, err)
+		}
+		br.Merges = append(br.Merges, BranchMerge{Heads: heads, Time: m.At})
+	}
+	return br, nil
+}
+
+func hashStrings(heads []automerge.ChangeHash) []string {
+	out := make([]string, len(heads))
+	for i, h := range heads {
+		out[i] = h.String()
+	}
+	return out
+}
+
+func parseHashes(s []string) ([]automerge.ChangeHash, error) {
+	out := make([]automerge.ChangeHash, len(s))
+	for i, h := range s {
+		var err error
+		if out[i], err = automerge.NewChangeHash(h); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,84 @@
+package repo
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBranches(t *testing.T) {
+	r := New()
+	main, err := r.NewDocFromJSON([]byte(`{"title":"draft"}`))
+	if err != nil {
+		t.Fatalf("NewDocFromJSON failed: %v", err)
+	}
+	b, err := r.NewBranches(main.DocID())
+	if err != nil {
+		t.Fatalf("NewBranches failed: %v", err)
+	}
+	defer b.Close()
+
+	base := main.Heads()
+	feature, err := b.Create("feature")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := b.Create("feature"); !errors.Is(err, ErrBranchExists) {
+		t.Fatalf("expected ErrBranchExists, got %v", err)
+	}
+	if _, err := b.Create("alt"); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := feature.SetPath([]interface{}{"title"}, "final"); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+
+	patches, err := b.Diff("feature")
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	want := []Patch{{Action: PatchPut, Path: []interface{}{"title"}, Value: "final"}}
+	if !reflect.DeepEqual(patches, want) {
+		t.Fatalf("unexpected diff %#v", patches)
+	}
+
+	if err := b.Merge("feature"); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if v, _ := main.GetPath("title"); v != "final" {
+		t.Fatalf("branch not merged, title is %v", v)
+	}
+
+	// reopen the metadata to read what was recorded
+	reopened, err := r.OpenBranches(b.ID())
+	if err != nil {
+		t.Fatalf("OpenBranches failed: %v", err)
+	}
+	defer reopened.Close()
+	if reopened.Main() != main.DocID() {
+		t.Fatalf("unexpected main %s", reopened.Main())
+	}
+	list, err := reopened.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(list) != 2 || list[0].Name != "alt" || list[1].Name != "feature" {
+		t.Fatalf("unexpected branches %+v", list)
+	}
+	br := list[1]
+	if br.DocumentID != feature.DocID() || !sameHeads(br.Base, base) || br.Created.IsZero() {
+		t.Fatalf("unexpected branch record %+v", br)
+	}
+	if len(br.Merges) != 1 || !sameHeads(br.Merges[0].Heads, feature.Heads()) {
+		t.Fatalf("unexpected merges %+v", br.Merges)
+	}
+	if len(list[0].Merges) != 0 {
+		t.Fatalf("unmerged branch has merges %+v", list[0].Merges)
+	}
+	if _, err := reopened.Get("missing"); !errors.Is(err, ErrBranchNotFound) {
+		t.Fatalf("expected ErrBranchNotFound, got %v", err)
+	}
+	if _, err := r.OpenBranches(main.DocID()); err == nil {
+		t.Fatalf("expected error opening a document that is not a branches document")
+	}
+}
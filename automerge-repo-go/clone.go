@@ -0,0 +1,82 @@
+package repo
+
+import "github.com/google/uuid"
+
+// Clone creates a new document holding the full history of the document id
+// and returns a handle to it. The clone gets a new DocumentID and its own
+// actor, so edits to it can later be merged back with Merge. A schema
+// attached to id with WithSchema also applies to the clone.
+func (r *Repo) Clone(id DocumentID) (*DocumentHandle, error) {
+	src, err := r.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	if src.doc.deleted.Load() {
+		return nil, ErrDocumentDeleted
+	}
+	src.doc.ensureDoc()
+	fork, err := src.doc.fork()
+	if err != nil {
+		return nil, err
+	}
+	d := &Document{ID: uuid.New(), Doc: fork}
+	d.pin(pinHandle)
+	r.mu.Lock()
+	if s, ok := r.schemas[id]; ok {
+		r.schemas[d.ID] = s
+	}
+	r.mu.Unlock()
+	r.putDoc(d)
+	return &DocumentHandle{doc: d, repo: r}, nil
+}
+
+// Merge applies every change of the source document that the target lacks
+// to the target and returns a handle to the target. The merge counts as a
+// local change of the target, so it is saved, synced and undone like any
+// other edit. If the merged document would violate the target's schema the
+// target is left untouched and a *ValidationError is returned.
+func (r *Repo) Merge(targetID, sourceID DocumentID) (*DocumentHandle, error) {
+	src, err := r.Find(sourceID)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	target, err := r.Find(targetID)
+	if err != nil {
+		return nil, err
+	}
+	if err := target.MergeFrom(src); err != nil {
+		target.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
+// MergeFrom applies every change of other's document that h's document
+// lacks. See Repo.Merge.
+func (h *DocumentHandle) MergeFrom(other *DocumentHandle) error {
+	if h.doc.deleted.Load() || other.doc.deleted.Load() {
+		return ErrDocumentDeleted
+	}
+	h.doc.ensureDoc()
+	other.doc.ensureDoc()
+	theirs, err := other.doc.fork()
+	if err != nil {
+		return err
+	}
+	if h.repo != nil && h.repo.hasSchemas(h.doc.ID) {
+		fork, err := h.doc.fork()
+		if err != nil {
+			return err
+		}
+		if _, err := fork.Merge(theirs); err != nil {
+			return err
+		}
+		if err := h.repo.validate(h.doc.ID, fork); err != nil {
+			return err
+		}
+	}
+	_, err = h.doc.merge(theirs, h.origin())
+	return err
+}
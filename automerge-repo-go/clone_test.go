@@ -0,0 +1,76 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCloneAndMerge(t *testing.T) {
+	store := newMemStore()
+	r := NewWithStore(store)
+	main, err := r.NewDocFromJSON([]byte(`{"title":"draft","tags":["a"]}`))
+	if err != nil {
+		t.Fatalf("NewDocFromJSON failed: %v", err)
+	}
+
+	branch, err := r.Clone(main.DocID())
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	if branch.DocID() == main.DocID() {
+		t.Fatalf("clone reused the document id")
+	}
+	if got, want := len(mustHistory(t, branch)), len(mustHistory(t, main)); got != want {
+		t.Fatalf("clone has %d changes, want %d", got, want)
+	}
+
+	if err := branch.SetPath([]interface{}{"title"}, "final"); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+	if err := main.Insert([]interface{}{"tags"}, 1, "b"); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if js, _ := main.JSON(); string(js) != `{"tags":["a","b"],"title":"draft"}` {
+		t.Fatalf("edit to clone leaked into the original: %s", js)
+	}
+	if err := branch.Save(); err != nil {
+		t.Fatalf("saving clone failed: %v", err)
+	}
+	if _, err := store.Load(branch.DocID()); err != nil {
+		t.Fatalf("clone not in storage: %v", err)
+	}
+
+	merged, err := r.Merge(main.DocID(), branch.DocID())
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	defer merged.Close()
+	if js, _ := merged.JSON(); string(js) != `{"tags":["a","b"],"title":"final"}` {
+		t.Fatalf("unexpected merge result %s", js)
+	}
+	if js, _ := branch.JSON(); string(js) != `{"tags":["a"],"title":"final"}` {
+		t.Fatalf("merge changed the source: %s", js)
+	}
+}
+
+func TestMergeValidatesTarget(t *testing.T) {
+	r := New()
+	target, err := r.NewDocFromJSON([]byte(`{"title":"task"}`))
+	if err != nil {
+		t.Fatalf("NewDocFromJSON failed: %v", err)
+	}
+	r.WithSchema(target.DocID(), MustCompileSchema(taskSchema))
+	source, err := r.NewDocFromJSON([]byte(`{"extra":true}`))
+	if err != nil {
+		t.Fatalf("NewDocFromJSON failed: %v", err)
+	}
+	if _, err := r.Merge(target.DocID(), source.DocID()); !errors.Is(err, ErrSchemaViolation) {
+		t.Fatalf("expected ErrSchemaViolation, got %v", err)
+	}
+	if js, _ := target.JSON(); string(js) != `{"title":"task"}` {
+		t.Fatalf("rejected merge changed the target: %s", js)
+	}
+	if _, err := r.Clone(DocumentID{}); err == nil {
+		t.Fatalf("expected error cloning a missing document")
+	}
+}
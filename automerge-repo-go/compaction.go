@@ -0,0 +1,182 @@
+package repo
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+// CompactionStats describes the changes a document has accumulated since it
+// was last compacted. Changes made locally, through WithDocMut and received
+// from peers are all counted.
+type CompactionStats struct {
+	// ChangesSinceCompact is the number of automerge changes applied since the
+	// last compaction.
+	ChangesSinceCompact int
+	// BytesSinceCompact is the encoded size of those changes, which
+	// approximates the incremental bytes appended to storage.
+	BytesSinceCompact int64
+	// LastCompact is the time of the last compaction, or of the first tracked
+	// change if the document has not been compacted by this process.
+	LastCompact time.Time
+	// LastChange is the time the most recent change was applied.
+	LastChange time.Time
+}
+
+// CompactionPolicy decides when a document should be compacted into a single
+// snapshot instead of having incremental changes appended.
+type CompactionPolicy interface {
+	ShouldCompact(stats CompactionStats) bool
+}
+
+// CompactionPolicyFunc adapts an ordinary function to a CompactionPolicy.
+type CompactionPolicyFunc func(stats CompactionStats) bool
+
+// ShouldCompact calls f(stats).
+func (f CompactionPolicyFunc) ShouldCompact(stats CompactionStats) bool { return f(stats) }
+
+// CompactAfterChanges compacts once n changes have accumulated.
+func CompactAfterChanges(n int) CompactionPolicy {
+	return CompactionPolicyFunc(func(s CompactionStats) bool {
+		return s.ChangesSinceCompact >= n
+	})
+}
+
+// CompactAfterBytes compacts once the incremental changes reach n bytes.
+func CompactAfterBytes(n int64) CompactionPolicy {
+	return CompactionPolicyFunc(func(s CompactionStats) bool {
+		return s.BytesSinceCompact >= n
+	})
+}
+
+// CompactAfterInterval compacts a changed document once d has passed since its
+// last compaction.
+func CompactAfterInterval(d time.Duration) CompactionPolicy {
+	return CompactionPolicyFunc(func(s CompactionStats) bool {
+		return s.ChangesSinceCompact > 0 && time.Since(s.LastCompact) >= d
+	})
+}
+
+// CompactWhenIdle compacts a changed document once it has not been modified
+// for d. It is intended for use with StartCompactor.
+func CompactWhenIdle(d time.Duration) CompactionPolicy {
+	return CompactionPolicyFunc(func(s CompactionStats) bool {
+		return s.ChangesSinceCompact > 0 && time.Since(s.LastChange) >= d
+	})
+}
+
+// AnyCompactionPolicy compacts when any of the given policies would.
+func AnyCompactionPolicy(policies ...CompactionPolicy) CompactionPolicy {
+	return CompactionPolicyFunc(func(s CompactionStats) bool {
+		for _, p := range policies {
+			if p.ShouldCompact(s) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// WithCompactionPolicy configures the policy SaveDoc and StartCompactor use
+// to decide when to compact. The default compacts every 10 changes.
+func (r *Repo) WithCompactionPolicy(p CompactionPolicy) *Repo {
+	r.compaction = p
+	return r
+}
+
+// CompactionStats returns the changes accumulated since the last compaction.
+func (d *Document) CompactionStats() CompactionStats {
+	d.statsMu.Lock()
+	defer d.statsMu.Unlock()
+	return d.stats
+}
+
+// recordChanges adds the changes applied since before to the compaction stats.
+func (d *Document) recordChanges(before []automerge.ChangeHash) {
+	d.mutMu.Lock()
+	changes, err := d.Doc.Changes(before...)
+	d.mutMu.Unlock()
+	if err != nil || len(changes) == 0 {
+		return
+	}
+	var n int64
+	for _, c := range changes {
+		n += int64(len(c.Save()))
+	}
+	now := time.Now()
+	d.statsMu.Lock()
+	if d.stats.LastCompact.IsZero() {
+		d.stats.LastCompact = now
+	}
+	d.stats.ChangesSinceCompact += len(changes)
+	d.stats.BytesSinceCompact += n
+	d.stats.LastChange = now
+	d.statsMu.Unlock()
+	if d.sizeKnown.Load() {
+		d.size.Add(n)
+	}
+}
+
+// StartCompactor launches a goroutine that checks every interval which
+// documents the compaction policy wants compacted and compacts them, running
+// at most concurrency compactions at once. It stops when ctx is canceled and
+// the returned channel is closed once it has exited.
+func (r *Repo) StartCompactor(ctx context.Context, interval time.Duration, concurrency int) <-chan struct{} {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		sem := make(chan struct{}, concurrency)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			var wg sync.WaitGroup
+			for _, id := range r.docIDs() {
+				if r.store == nil || r.compaction == nil {
+					continue
+				}
+				doc, ok := r.getDoc(id, pinSync)
+				if !ok {
+					continue
+				}
+				if !r.compaction.ShouldCompact(doc.CompactionStats()) {
+					doc.unpin(pinSync)
+					continue
+				}
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					doc.unpin(pinSync)
+					wg.Wait()
+					return
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer func() { <-sem }()
+					defer doc.unpin(pinSync)
+					doc.saveMu.Lock()
+					defer doc.saveMu.Unlock()
+					if doc.deleted.Load() || !r.compaction.ShouldCompact(doc.CompactionStats()) {
+						return
+					}
+					if err := r.compact(doc); err != nil {
+						log.Printf("compactor: compacting %s: %v", doc.ID, err)
+					}
+				}()
+			}
+			wg.Wait()
+		}
+	}()
+	return done
+}
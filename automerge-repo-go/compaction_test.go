@@ -0,0 +1,233 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+// memStore is an in-memory StorageAdapter for tests. It records how often
+// each operation was called.
+type memStore struct {
+	mu         sync.Mutex
+	data       map[DocumentID][]byte
+	tombstones map[DocumentID]DeleteOptions
+	saves      int
+	compacts   int
+
+	// active and maxActive track concurrent Compact calls.
+	active    int
+	maxActive int
+	delay     time.Duration
+}
+
+func newMemStore() *memStore {
+	return &memStore{data: make(map[DocumentID][]byte), tombstones: make(map[DocumentID]DeleteOptions)}
+}
+
+func (s *memStore) Load(id DocumentID) (*Document, error) {
+	s.mu.Lock()
+	b, ok := s.data[id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("document %s not found", id)
+	}
+	d, err := automerge.Load(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Document{ID: id, Doc: d}, nil
+}
+
+func (s *memStore) Save(doc *Document) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saves++
+	s.data[doc.ID] = doc.Doc.Save()
+	return nil
+}
+
+func (s *memStore) Compact(doc *Document) error {
+	s.mu.Lock()
+	s.compacts++
+	s.active++
+	if s.active > s.maxActive {
+		s.maxActive = s.active
+	}
+	s.mu.Unlock()
+
+	time.Sleep(s.delay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	s.data[doc.ID] = doc.Doc.Save()
+	return nil
+}
+
+func (s *memStore) List() ([]DocumentID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]DocumentID, 0, len(s.data))
+	for id := range s.data {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *memStore) Remove(id DocumentID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, id)
+	return nil
+}
+
+func (s *memStore) SaveTombstone(id DocumentID, opts DeleteOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tombstones[id] = opts
+	return nil
+}
+
+func (s *memStore) RemoveTombstone(id DocumentID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tombstones, id)
+	return nil
+}
+
+func (s *memStore) Tombstones() (map[DocumentID]DeleteOptions, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[DocumentID]DeleteOptions, len(s.tombstones))
+	for id, opts := range s.tombstones {
+		out[id] = opts
+	}
+	return out, nil
+}
+
+func (s *memStore) counts() (saves, compacts int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saves, s.compacts
+}
+
+func TestCompactionPolicyCountsWithDocMut(t *testing.T) {
+	store := newMemStore()
+	r := NewWithStore(store).WithCompactionPolicy(CompactAfterChanges(3))
+	h := r.NewDocHandle()
+
+	for i := 0; i < 3; i++ {
+		if err := h.WithDocMut(func(doc *automerge.Doc) error {
+			return doc.RootMap().Set("n", int64(i))
+		}); err != nil {
+			t.Fatalf("mutate err: %v", err)
+		}
+	}
+	if got := h.doc.CompactionStats().ChangesSinceCompact; got != 3 {
+		t.Fatalf("expected 3 changes, got %d", got)
+	}
+	if err := h.Save(); err != nil {
+		t.Fatalf("save err: %v", err)
+	}
+	if _, compacts := store.counts(); compacts != 1 {
+		t.Fatalf("expected compaction, got %d", compacts)
+	}
+	if got := h.doc.CompactionStats(); got.ChangesSinceCompact != 0 || got.BytesSinceCompact != 0 {
+		t.Fatalf("expected stats reset, got %#v", got)
+	}
+}
+
+func TestCompactionPolicyCountsSyncChanges(t *testing.T) {
+	h1 := NewRepoHandle(New())
+	h2 := NewRepoHandle(NewWithStore(newMemStore()).WithCompactionPolicy(CompactAfterBytes(1)))
+
+	c1, c2 := newMockConn()
+	_ = h1.AddConn(h2.Repo.ID, c1)
+	_ = h2.AddConn(h1.Repo.ID, c2)
+
+	doc := h1.Repo.NewDoc()
+	if err := doc.Set("k", "v"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := h1.SyncDocument(h2.Repo.ID, doc.ID); err != nil {
+		t.Fatalf("sync err: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	doc2, ok := h2.Repo.GetDoc(doc.ID)
+	if !ok {
+		t.Fatalf("document not synced")
+	}
+	stats := doc2.CompactionStats()
+	if stats.ChangesSinceCompact != 1 || stats.BytesSinceCompact == 0 {
+		t.Fatalf("expected synced change to be counted, got %#v", stats)
+	}
+
+	h1.Close()
+	h2.Close()
+}
+
+func TestStartCompactorRespectsConcurrency(t *testing.T) {
+	store := newMemStore()
+	store.delay = 20 * time.Millisecond
+	r := NewWithStore(store).WithCompactionPolicy(CompactWhenIdle(0))
+	for i := 0; i < 6; i++ {
+		if err := r.NewDoc().Set("k", "v"); err != nil {
+			t.Fatalf("set err: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := r.StartCompactor(ctx, 5*time.Millisecond, 2)
+
+	deadline := time.After(time.Second)
+	for {
+		if _, compacts := store.counts(); compacts == 6 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("timeout waiting for compaction")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	cancel()
+	<-done
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.maxActive > 2 {
+		t.Fatalf("expected at most 2 concurrent compactions, got %d", store.maxActive)
+	}
+	if store.compacts != 6 {
+		t.Fatalf("expected each document compacted once, got %d", store.compacts)
+	}
+}
+
+func TestCompactionWaitsForWithDocMut(t *testing.T) {
+	store := newMemStore()
+	r := NewWithStore(store)
+	h := r.NewDocHandle()
+	compacted := make(chan error, 1)
+	if err := h.WithDocMut(func(doc *automerge.Doc) error {
+		if err := doc.RootMap().Set("a", 1); err != nil {
+			return err
+		}
+		go func() { compacted <- h.Compact() }()
+		time.Sleep(20 * time.Millisecond)
+		return doc.RootMap().Set("b", 2)
+	}); err != nil {
+		t.Fatalf("WithDocMut failed: %v", err)
+	}
+	if err := <-compacted; err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if history := mustHistory(t, h); len(history) != 1 {
+		t.Fatalf("expected the change to stay whole, got %d changes", len(history))
+	}
+}
@@ -3,6 +3,7 @@ package repo
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -12,15 +13,49 @@ import (
 	"github.com/fxamacker/cbor/v2"
 )
 
+// DefaultMaxFrameSize is the largest message a connection accepts unless
+// configured otherwise.
+const DefaultMaxFrameSize = 64 << 20
+
+// ErrFrameTooLarge is returned when a peer sends a message larger than the
+// connection's maximum frame size.
+var ErrFrameTooLarge = errors.New("frame too large")
+
 // LPConn wraps a connection and exchanges length-prefixed CBOR messages.
 type LPConn struct {
-	rw io.ReadWriteCloser
-	mu sync.Mutex
+	rw       io.ReadWriteCloser
+	mu       sync.Mutex
+	maxFrame int
+	identity *Identity
 }
 
 // NewLPConn returns a new length prefixed connection.
 func NewLPConn(rw io.ReadWriteCloser) *LPConn {
-	return &LPConn{rw: rw}
+	return &LPConn{rw: rw, maxFrame: DefaultMaxFrameSize}
+}
+
+// SetMaxFrameSize sets the largest message Recv and RecvMessage accept.
+// Larger frames are rejected with ErrFrameTooLarge before any buffer is
+// allocated. A size of zero or less removes the limit.
+func (c *LPConn) SetMaxFrameSize(n int) {
+	c.maxFrame = n
+}
+
+// readFrame reads one length prefixed frame.
+func (c *LPConn) readFrame() ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(c.rw, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if c.maxFrame > 0 && uint64(n) > uint64(c.maxFrame) {
+		return nil, fmt.Errorf("%w: %d bytes, limit %d", ErrFrameTooLarge, n, c.maxFrame)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(c.rw, data); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
 // Send encodes v as CBOR and writes it with a 4 byte length prefix.
@@ -42,13 +77,8 @@ func (c *LPConn) Send(v interface{}) error {
 
 // Recv reads a length prefixed CBOR message into v.
 func (c *LPConn) Recv(v interface{}) error {
-	var lenBuf [4]byte
-	if _, err := io.ReadFull(c.rw, lenBuf[:]); err != nil {
-		return err
-	}
-	n := binary.BigEndian.Uint32(lenBuf[:])
-	data := make([]byte, n)
-	if _, err := io.ReadFull(c.rw, data); err != nil {
+	data, err := c.readFrame()
+	if err != nil {
 		return err
 	}
 	return cbor.Unmarshal(data, v)
@@ -73,13 +103,8 @@ func (c *LPConn) SendMessage(msg RepoMessage) error {
 
 // RecvMessage reads a RepoMessage that was sent using SendMessage.
 func (c *LPConn) RecvMessage() (RepoMessage, error) {
-	var lenBuf [4]byte
-	if _, err := io.ReadFull(c.rw, lenBuf[:]); err != nil {
-		return RepoMessage{}, err
-	}
-	n := binary.BigEndian.Uint32(lenBuf[:])
-	data := make([]byte, n)
-	if _, err := io.ReadFull(c.rw, data); err != nil {
+	data, err := c.readFrame()
+	if err != nil {
 		return RepoMessage{}, err
 	}
 	return DecodeRepoMessage(data)
@@ -88,43 +113,60 @@ func (c *LPConn) RecvMessage() (RepoMessage, error) {
 // Close closes the underlying connection.
 func (c *LPConn) Close() error { return c.rw.Close() }
 
+// Identity returns the identity the handshake's Authenticator attached to the
+// peer, or nil.
+func (c *LPConn) Identity() *Identity { return c.identity }
+
 // Connect performs a handshake over conn using length-prefixed messages and
 // returns the remote repo ID along with a LPConn for further communication.
 func Connect(ctx context.Context, conn net.Conn, id RepoID, dir ConnDirection) (*LPConn, RepoID, error) {
+	return connect(ctx, conn, id, dir, nil, nil)
+}
+
+// connect performs the handshake of Connect, announcing md as this side's
+// peer metadata. If check is set it is called with the peer's join or peer
+// message, before an incoming peer is answered; its error aborts the
+// handshake and the identity it returns is attached to the LPConn.
+func connect(ctx context.Context, conn net.Conn, id RepoID, dir ConnDirection, md PeerMetadata, check func(handshakeMessage) (*Identity, error)) (*LPConn, RepoID, error) {
 	if d, ok := ctx.Deadline(); ok {
 		_ = conn.SetDeadline(d)
 		defer conn.SetDeadline(time.Time{})
 	}
 
 	lp := NewLPConn(conn)
+	var remote handshakeMessage
 	switch dir {
 	case Outgoing:
-		if err := lp.Send(handshakeMessage{Type: "join", SenderID: id.String()}); err != nil {
+		if err := lp.Send(handshakeMessage{Type: "join", SenderID: id.String(), PeerMetadata: md}); err != nil {
 			return nil, RepoID{}, err
 		}
-		var resp handshakeMessage
-		if err := lp.Recv(&resp); err != nil {
+		if err := lp.Recv(&remote); err != nil {
 			return nil, RepoID{}, err
 		}
-		if resp.Type != "peer" {
-			return nil, RepoID{}, fmt.Errorf("unexpected message %q", resp.Type)
+		if remote.Type != "peer" {
+			return nil, RepoID{}, fmt.Errorf("unexpected message %q", remote.Type)
 		}
-		remote := parseRepoID(resp.SenderID)
-		return lp, remote, nil
 	case Incoming:
-		var req handshakeMessage
-		if err := lp.Recv(&req); err != nil {
+		if err := lp.Recv(&remote); err != nil {
 			return nil, RepoID{}, err
 		}
-		if req.Type != "join" {
-			return nil, RepoID{}, fmt.Errorf("unexpected message %q", req.Type)
+		if remote.Type != "join" {
+			return nil, RepoID{}, fmt.Errorf("unexpected message %q", remote.Type)
 		}
-		if err := lp.Send(handshakeMessage{Type: "peer", SenderID: id.String()}); err != nil {
-			return nil, RepoID{}, err
-		}
-		remote := parseRepoID(req.SenderID)
-		return lp, remote, nil
 	default:
 		return nil, RepoID{}, fmt.Errorf("invalid direction")
 	}
+	if check != nil {
+		ident, err := check(remote)
+		if err != nil {
+			return nil, RepoID{}, err
+		}
+		lp.identity = ident
+	}
+	if dir == Incoming {
+		if err := lp.Send(handshakeMessage{Type: "peer", SenderID: id.String(), PeerMetadata: md}); err != nil {
+			return nil, RepoID{}, err
+		}
+	}
+	return lp, parseRepoID(remote.SenderID), nil
 }
\ No newline at end of file
@@ -2,6 +2,7 @@ package repo
 
 import (
 	"context"
+	"errors"
 	"net"
 	"testing"
 	"time"
@@ -75,3 +76,20 @@ func TestLPConnSendRecvMessage(t *testing.T) {
 	lp1.Close()
 	lp2.Close()
 }
+
+func TestLPConnMaxFrameSize(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	lp := NewLPConn(c2)
+	defer lp.Close()
+	lp.SetMaxFrameSize(1024)
+
+	go func() {
+		// announce a 1 GiB frame without sending it
+		_, _ = c1.Write([]byte{0x40, 0, 0, 0})
+	}()
+
+	if _, err := lp.RecvMessage(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+	}
+}
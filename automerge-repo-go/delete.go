@@ -0,0 +1,155 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrDocumentDeleted is returned when operating on a document that has been
+// removed with Repo.Delete.
+var ErrDocumentDeleted = errors.New("document deleted")
+
+// DocState describes the lifecycle state of a document handle.
+type DocState int
+
+const (
+	// DocReady indicates the document is available for reading and writing.
+	DocReady DocState = iota
+	// DocDeleted indicates the document was removed with Repo.Delete.
+	DocDeleted
+)
+
+// DeleteOptions control how Repo.Delete propagates a deletion.
+type DeleteOptions struct {
+	// Tombstone sends a tombstone message to every connected peer so that
+	// they stop requesting the document from this repo.
+	Tombstone bool
+}
+
+// Delete removes the document from memory and storage. Handles to the
+// document move to the DocDeleted state, in-flight saves and compactions are
+// dropped and per-peer sync state is discarded. Sync messages for the
+// document received afterwards are ignored rather than recreating it. The
+// deletion is recorded in the store if it implements TombstoneStorage.
+// Deleting a document the repo does not know returns an error and records
+// nothing.
+func (r *Repo) Delete(id DocumentID, opts ...DeleteOptions) error {
+	var o DeleteOptions
+	for _, opt := range opts {
+		if opt.Tombstone {
+			o.Tombstone = true
+		}
+	}
+
+	r.mu.RLock()
+	_, known := r.docs[id]
+	if _, ok := r.evicted[id]; ok {
+		known = true
+	}
+	if _, ok := r.deleted[id]; ok {
+		known = true
+	}
+	r.mu.RUnlock()
+	if !known {
+		stored, err := r.stored(id)
+		if err != nil {
+			return err
+		}
+		if !stored {
+			return fmt.Errorf("document %s not found", id)
+		}
+	}
+
+	if ts, ok := r.store.(TombstoneStorage); ok {
+		if err := ts.SaveTombstone(id, o); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	doc, ok := r.docs[id]
+	delete(r.docs, id)
+	delete(r.evicted, id)
+	delete(r.schemas, id)
+	delete(r.quarantine, id)
+	r.deleted[id] = o
+	hooks := append([]func(DocumentID, DeleteOptions){}, r.deleteHooks...)
+	r.mu.Unlock()
+
+	if ok {
+		// Waiting for saveMu lets a save that is already writing finish
+		// before the stored copy is removed below.
+		doc.saveMu.Lock()
+		doc.deleted.Store(true)
+		doc.saveMu.Unlock()
+		doc.notifyWatchers(ChangeOrigin{Kind: OriginLocal})
+	}
+	if r.store != nil {
+		if err := r.store.Remove(id); err != nil {
+			return err
+		}
+	}
+	for _, hook := range hooks {
+		hook(id, o)
+	}
+	return nil
+}
+
+// stored reports whether the repo's store holds the document.
+func (r *Repo) stored(id DocumentID) (bool, error) {
+	if r.store == nil {
+		return false, nil
+	}
+	ids, err := r.store.List()
+	if err != nil {
+		return false, err
+	}
+	for _, stored := range ids {
+		if stored == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isDeleted reports whether the document was removed with Delete.
+func (r *Repo) isDeleted(id DocumentID) bool {
+	_, ok := r.deletion(id)
+	return ok
+}
+
+// deletion returns the options the document was deleted with.
+func (r *Repo) deletion(id DocumentID) (DeleteOptions, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	opts, ok := r.deleted[id]
+	return opts, ok
+}
+
+// tombstones returns the documents deleted with DeleteOptions.Tombstone.
+func (r *Repo) tombstones() []DocumentID {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var ids []DocumentID
+	for id, opts := range r.deleted {
+		if opts.Tombstone {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// onDelete registers f to be called after a document is deleted.
+func (r *Repo) onDelete(f func(DocumentID, DeleteOptions)) {
+	r.mu.Lock()
+	r.deleteHooks = append(r.deleteHooks, f)
+	r.mu.Unlock()
+}
+
+// State returns the lifecycle state of the document.
+func (h *DocumentHandle) State() DocState {
+	if h.doc.deleted.Load() {
+		return DocDeleted
+	}
+	return DocReady
+}
@@ -0,0 +1,249 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+	"github.com/google/uuid"
+)
+
+func TestRepoDelete(t *testing.T) {
+	store := newMemStore()
+	r := NewWithStore(store)
+	h := r.NewDocHandle()
+	if err := h.WithDocMut(func(doc *automerge.Doc) error {
+		return doc.RootMap().Set("k", "v")
+	}); err != nil {
+		t.Fatalf("mutate err: %v", err)
+	}
+	if err := h.Save(); err != nil {
+		t.Fatalf("save err: %v", err)
+	}
+
+	ch := h.Changed()
+	if err := r.Delete(h.DocID()); err != nil {
+		t.Fatalf("delete err: %v", err)
+	}
+
+	select {
+	case <-ch:
+	default:
+		t.Fatalf("expected change notification on delete")
+	}
+	if h.State() != DocDeleted {
+		t.Fatalf("expected deleted state, got %v", h.State())
+	}
+	if _, ok := r.GetDoc(h.DocID()); ok {
+		t.Fatalf("document still in memory")
+	}
+	if _, err := store.Load(h.DocID()); err == nil {
+		t.Fatalf("document still in storage")
+	}
+	if err := h.WithDocMut(func(doc *automerge.Doc) error { return nil }); !errors.Is(err, ErrDocumentDeleted) {
+		t.Fatalf("expected ErrDocumentDeleted from WithDocMut, got %v", err)
+	}
+	if err := h.Save(); !errors.Is(err, ErrDocumentDeleted) {
+		t.Fatalf("expected ErrDocumentDeleted from Save, got %v", err)
+	}
+}
+
+func TestRepoDeleteUnknown(t *testing.T) {
+	store := newMemStore()
+	r := NewWithStore(store)
+	id := uuid.New()
+	if err := r.Delete(id, DeleteOptions{Tombstone: true}); err == nil {
+		t.Fatalf("expected an error for an unknown document")
+	}
+	if r.isDeleted(id) {
+		t.Fatalf("unknown document recorded as deleted")
+	}
+	if len(store.tombstones) != 0 {
+		t.Fatalf("tombstone written for an unknown document")
+	}
+
+	// a document only in the store can be deleted
+	doc := &Document{ID: id, Doc: automerge.New()}
+	if err := store.Save(doc); err != nil {
+		t.Fatalf("save err: %v", err)
+	}
+	if err := r.Delete(id); err != nil {
+		t.Fatalf("delete err: %v", err)
+	}
+}
+
+func TestRepoDeleteClearsSchemaAndQuarantine(t *testing.T) {
+	r := New().WithStrictSchemas(true)
+	h := r.NewDocHandle()
+	r.WithSchema(h.DocID(), MustCompileSchema(taskSchema))
+	other := automerge.New()
+	if err := other.RootMap().Set("priority", int64(9)); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if _, err := other.Commit("invalid"); err != nil {
+		t.Fatalf("commit err: %v", err)
+	}
+	changes, err := other.Changes()
+	if err != nil {
+		t.Fatalf("changes err: %v", err)
+	}
+	r.addQuarantine(h.DocID(), changes)
+	if len(r.Quarantined(h.DocID())) != 1 {
+		t.Fatalf("change not quarantined")
+	}
+	if err := r.Delete(h.DocID()); err != nil {
+		t.Fatalf("delete err: %v", err)
+	}
+	r.mu.RLock()
+	_, schema := r.schemas[h.DocID()]
+	_, quarantine := r.quarantine[h.DocID()]
+	r.mu.RUnlock()
+	if schema || quarantine {
+		t.Fatalf("schema or quarantine kept after delete")
+	}
+}
+
+// blockingStore holds back the result of Load until release is closed.
+type blockingStore struct {
+	*memStore
+	loading chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Load(id DocumentID) (*Document, error) {
+	doc, err := s.memStore.Load(id)
+	close(s.loading)
+	<-s.release
+	return doc, err
+}
+
+func TestRepoDeleteDuringFind(t *testing.T) {
+	store := &blockingStore{memStore: newMemStore(), loading: make(chan struct{}), release: make(chan struct{})}
+	r := NewWithStore(store)
+	doc := &Document{ID: uuid.New(), Doc: automerge.New()}
+	if err := store.Save(doc); err != nil {
+		t.Fatalf("save err: %v", err)
+	}
+	found := make(chan error, 1)
+	go func() {
+		_, err := r.Find(doc.ID)
+		found <- err
+	}()
+	<-store.loading
+	if err := r.Delete(doc.ID); err != nil {
+		t.Fatalf("delete err: %v", err)
+	}
+	close(store.release)
+	if err := <-found; !errors.Is(err, ErrDocumentDeleted) {
+		t.Fatalf("expected ErrDocumentDeleted from Find, got %v", err)
+	}
+	if _, ok := r.GetDoc(doc.ID); ok {
+		t.Fatalf("deleted document loaded back into memory")
+	}
+}
+
+func TestRepoDeleteTombstone(t *testing.T) {
+	h1 := NewRepoHandle(New())
+	h2 := NewRepoHandle(New())
+
+	c1, c2 := newMockConn()
+	_ = h1.AddConn(h2.Repo.ID, c1)
+	_ = h2.AddConn(h1.Repo.ID, c2)
+	<-h1.Events
+	<-h2.Events
+
+	doc := h1.Repo.NewDoc()
+	if err := doc.Set("k", "v"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := h1.SyncDocument(h2.Repo.ID, doc.ID); err != nil {
+		t.Fatalf("sync err: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := h2.Repo.GetDoc(doc.ID); !ok {
+		t.Fatalf("document not synced")
+	}
+
+	if err := h1.Repo.Delete(doc.ID, DeleteOptions{Tombstone: true}); err != nil {
+		t.Fatalf("delete err: %v", err)
+	}
+
+	select {
+	case evt := <-h2.Events:
+		if evt.Type != EventDocTombstone || evt.Peer != h1.Repo.ID || evt.DocumentID != doc.ID {
+			t.Fatalf("expected tombstone event, got %#v", evt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for tombstone")
+	}
+
+	// the peer keeps its copy but no longer syncs it to us
+	doc2, ok := h2.Repo.GetDoc(doc.ID)
+	if !ok {
+		t.Fatalf("peer copy removed")
+	}
+	if err := doc2.Set("k", "changed"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := h2.SyncDocument(h1.Repo.ID, doc.ID); err != nil {
+		t.Fatalf("sync err: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := h1.Repo.GetDoc(doc.ID); ok {
+		t.Fatalf("deleted document was recreated")
+	}
+
+	h1.Close()
+	h2.Close()
+}
+
+func TestRepoTombstonesPersist(t *testing.T) {
+	store := newMemStore()
+	r := NewWithStore(store)
+	doc := r.NewDoc()
+	if err := doc.Set("k", "v"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := r.SaveDoc(doc.ID); err != nil {
+		t.Fatalf("save err: %v", err)
+	}
+	if err := r.Delete(doc.ID, DeleteOptions{Tombstone: true}); err != nil {
+		t.Fatalf("delete err: %v", err)
+	}
+
+	// a restarted repo still knows about the deletion and tells peers about
+	// it when they connect
+	h1 := NewRepoHandle(NewWithStore(store))
+	h2 := NewRepoHandle(New())
+	defer h1.Close()
+	defer h2.Close()
+	if !h1.Repo.isDeleted(doc.ID) {
+		t.Fatalf("deletion not restored from the store")
+	}
+	peerDoc := &Document{ID: doc.ID, Doc: automerge.New()}
+	if err := peerDoc.Set("k", "peer"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	h2.Repo.putDoc(peerDoc)
+
+	c1, c2 := newMockConn()
+	_ = h1.AddConn(h2.Repo.ID, c1)
+	_ = h2.AddConn(h1.Repo.ID, c2)
+	evt := waitEvent(t, h2, EventDocTombstone)
+	if evt.Peer != h1.Repo.ID || evt.DocumentID != doc.ID {
+		t.Fatalf("unexpected tombstone event %#v", evt)
+	}
+
+	// a sync for the deleted document is answered with another tombstone
+	h2.mu.Lock()
+	delete(h2.peers[h1.Repo.ID].tombstoned, doc.ID)
+	h2.mu.Unlock()
+	if err := h2.SyncDocument(h1.Repo.ID, doc.ID); err != nil {
+		t.Fatalf("sync err: %v", err)
+	}
+	waitEvent(t, h2, EventDocTombstone)
+	if _, ok := h1.Repo.GetDoc(doc.ID); ok {
+		t.Fatalf("deleted document was recreated")
+	}
+}
@@ -0,0 +1,272 @@
+package repo
+
+import (
+	"reflect"
+	"sort"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+// PatchAction is the kind of edit described by a Patch.
+type PatchAction string
+
+const (
+	// PatchPut sets a map key or list element to Value.
+	PatchPut PatchAction = "put"
+	// PatchDelete removes a map key, or Length list elements or characters
+	// starting at the last element of Path.
+	PatchDelete PatchAction = "del"
+	// PatchInsert inserts the elements of Value, a []interface{}, into a list
+	// at the last element of Path.
+	PatchInsert PatchAction = "insert"
+	// PatchSplice inserts the string Value into text at the last element of Path.
+	PatchSplice PatchAction = "splice"
+	// PatchIncrement adds Value, an int64, to a counter.
+	PatchIncrement PatchAction = "inc"
+)
+
+// Patch describes a single edit between two versions of a document. Path
+// holds map keys as strings and list or text positions as ints. Text
+// positions count unicode code points, as in automerge.Text.
+type Patch struct {
+	Action PatchAction
+	Path   []interface{}
+	Value  interface{}
+	Length int
+}
+
+// PatchEvent is delivered by DocumentHandle.ChangedSince.
+type PatchEvent struct {
+	DocumentID DocumentID
+	// Heads are the document heads the patches lead to.
+	Heads   []automerge.ChangeHash
+	Patches []Patch
+	// Err is set if the patches could not be computed, or to
+	// ErrDocumentDeleted if the document was deleted.
+	Err error
+}
+
+// Diff returns the patches that turn the document as of from into the
+// document as of to. Empty from heads denote the empty document and empty to
+// heads the current state.
+//
+// Patches are computed by comparing the two versions, so an object that was
+// replaced by an equal object produces no patch, and lists are diffed by
+// their common prefix and suffix rather than by element identity.
+//
+// The patches of recent calls are cached and shared between callers, who
+// must not modify them, so that every watcher of a change is served by one
+// diff. The version a diff led to is kept as the starting point of the next.
+func (d *Document) Diff(from, to []automerge.ChangeHash) ([]Patch, error) {
+	d.ensureDoc()
+	if len(to) == 0 {
+		to = d.Doc.Heads()
+	}
+	d.diffMu.Lock()
+	defer d.diffMu.Unlock()
+	for _, c := range d.diffs {
+		if sameHeads(c.from, from) && sameHeads(c.to, to) {
+			return c.patches, nil
+		}
+	}
+	var a *automerge.Doc
+	switch {
+	case len(from) == 0:
+		a = automerge.New()
+	case d.diffDoc != nil && sameHeads(d.diffHeads, from):
+		a = d.diffDoc
+	default:
+		var err error
+		if a, err = d.fork(from...); err != nil {
+			return nil, err
+		}
+	}
+	b, err := d.fork(to...)
+	if err != nil {
+		return nil, err
+	}
+	patches := diffDocs(a, b)
+	d.diffDoc, d.diffHeads = b, to
+	if len(d.diffs) == maxCachedDiffs {
+		d.diffs = d.diffs[1:]
+	}
+	d.diffs = append(d.diffs, cachedDiff{from: from, to: to, patches: patches})
+	return patches, nil
+}
+
+// maxCachedDiffs is the number of diffs a document keeps for Diff.
+const maxCachedDiffs = 8
+
+type cachedDiff struct {
+	from, to []automerge.ChangeHash
+	patches  []Patch
+}
+
+// diffDocs returns the patches that turn a into b.
+func diffDocs(a, b *automerge.Doc) []Patch {
+	var patches []Patch
+	diffMaps(&patches, nil, a.RootMap(), b.RootMap())
+	return patches
+}
+
+// Diff returns the patches between two sets of heads of the document. See
+// Document.Diff.
+func (h *DocumentHandle) Diff(from, to []automerge.ChangeHash) ([]Patch, error) {
+	return h.doc.Diff(from, to)
+}
+
+// ChangedSince returns a channel that receives the patches between heads and
+// the document's state after its next change. If the document has already
+// moved on from heads the event is delivered immediately.
+func (h *DocumentHandle) ChangedSince(heads []automerge.ChangeHash) <-chan PatchEvent {
+	return h.doc.watchPatches(heads)
+}
+
+type patchWatcher struct {
+	heads []automerge.ChangeHash
+	ch    chan PatchEvent
+}
+
+func (d *Document) watchPatches(heads []automerge.ChangeHash) <-chan PatchEvent {
+	w := patchWatcher{heads: heads, ch: make(chan PatchEvent, 1)}
+	d.ensureDoc()
+	// Checking the heads under watchersMu means a change either shows up
+	// here or notifies the registered watcher.
+	d.watchersMu.Lock()
+	if d.deleted.Load() || !sameHeads(heads, d.Doc.Heads()) {
+		d.watchersMu.Unlock()
+		d.sendPatches(w)
+		return w.ch
+	}
+	d.patchWatchers = append(d.patchWatchers, w)
+	d.watchersMu.Unlock()
+	return w.ch
+}
+
+func (d *Document) sendPatches(w patchWatcher) {
+	evt := PatchEvent{DocumentID: d.ID}
+	if d.deleted.Load() {
+		evt.Err = ErrDocumentDeleted
+	} else {
+		evt.Heads = d.Doc.Heads()
+		evt.Patches, evt.Err = d.Diff(w.heads, evt.Heads)
+	}
+	w.ch <- evt
+}
+
+func child(path []interface{}, elem interface{}) []interface{} {
+	p := make([]interface{}, len(path)+1)
+	copy(p, path)
+	p[len(path)] = elem
+	return p
+}
+
+func diffMaps(patches *[]Patch, path []interface{}, a, b *automerge.Map) {
+	av, _ := a.Values()
+	bv, _ := b.Values()
+	keys := make([]string, 0, len(av)+len(bv))
+	for k := range av {
+		keys = append(keys, k)
+	}
+	for k := range bv {
+		if _, ok := av[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		old, inA := av[k]
+		cur, inB := bv[k]
+		switch {
+		case !inB:
+			*patches = append(*patches, Patch{Action: PatchDelete, Path: child(path, k)})
+		case !inA:
+			*patches = append(*patches, Patch{Action: PatchPut, Path: child(path, k), Value: cur.Interface()})
+		default:
+			diffValues(patches, child(path, k), old, cur)
+		}
+	}
+}
+
+func diffValues(patches *[]Patch, path []interface{}, a, b *automerge.Value) {
+	if a.Kind() == b.Kind() {
+		switch a.Kind() {
+		case automerge.KindMap:
+			diffMaps(patches, path, a.Map(), b.Map())
+			return
+		case automerge.KindList:
+			diffLists(patches, path, a.List(), b.List())
+			return
+		case automerge.KindText:
+			as, _ := a.Text().Get()
+			bs, _ := b.Text().Get()
+			diffText(patches, path, as, bs)
+			return
+		case automerge.KindCounter:
+			ac, _ := a.Counter().Get()
+			bc, _ := b.Counter().Get()
+			if ac != bc {
+				*patches = append(*patches, Patch{Action: PatchIncrement, Path: path, Value: bc - ac})
+			}
+			return
+		}
+		if reflect.DeepEqual(a.Interface(), b.Interface()) {
+			return
+		}
+	}
+	*patches = append(*patches, Patch{Action: PatchPut, Path: path, Value: b.Interface()})
+}
+
+func sameValue(a, b *automerge.Value) bool {
+	return a.Kind() == b.Kind() && reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+func diffLists(patches *[]Patch, path []interface{}, a, b *automerge.List) {
+	av, _ := a.Values()
+	bv, _ := b.Values()
+	start := 0
+	for start < len(av) && start < len(bv) && sameValue(av[start], bv[start]) {
+		start++
+	}
+	endA, endB := len(av), len(bv)
+	for endA > start && endB > start && sameValue(av[endA-1], bv[endB-1]) {
+		endA--
+		endB--
+	}
+	if endA-start == endB-start {
+		// same shape: compare element by element
+		for i := start; i < endA; i++ {
+			diffValues(patches, child(path, i), av[i], bv[i])
+		}
+		return
+	}
+	if endA > start {
+		*patches = append(*patches, Patch{Action: PatchDelete, Path: child(path, start), Length: endA - start})
+	}
+	if endB > start {
+		values := make([]interface{}, 0, endB-start)
+		for _, v := range bv[start:endB] {
+			values = append(values, v.Interface())
+		}
+		*patches = append(*patches, Patch{Action: PatchInsert, Path: child(path, start), Value: values})
+	}
+}
+
+func diffText(patches *[]Patch, path []interface{}, a, b string) {
+	ar, br := []rune(a), []rune(b)
+	start := 0
+	for start < len(ar) && start < len(br) && ar[start] == br[start] {
+		start++
+	}
+	endA, endB := len(ar), len(br)
+	for endA > start && endB > start && ar[endA-1] == br[endB-1] {
+		endA--
+		endB--
+	}
+	if endA > start {
+		*patches = append(*patches, Patch{Action: PatchDelete, Path: child(path, start), Length: endA - start})
+	}
+	if endB > start {
+		*patches = append(*patches, Patch{Action: PatchSplice, Path: child(path, start), Value: string(br[start:endB])})
+	}
+}
@@ -0,0 +1,163 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+func TestDocumentDiff(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+
+	if err := h.WithDocMut(func(doc *automerge.Doc) error {
+		root := doc.RootMap()
+		if err := root.Set("title", "draft"); err != nil {
+			return err
+		}
+		if err := root.Set("removed", true); err != nil {
+			return err
+		}
+		if err := root.Set("tags", []string{"a", "c"}); err != nil {
+			return err
+		}
+		if err := root.Set("body", automerge.NewText("hello world")); err != nil {
+			return err
+		}
+		return root.Set("views", automerge.NewCounter(1))
+	}); err != nil {
+		t.Fatalf("WithDocMut failed: %v", err)
+	}
+	from := h.Heads()
+
+	if err := h.WithDocMut(func(doc *automerge.Doc) error {
+		root := doc.RootMap()
+		if err := root.Set("title", "final"); err != nil {
+			return err
+		}
+		if err := root.Delete("removed"); err != nil {
+			return err
+		}
+		tags, err := root.Get("tags")
+		if err != nil {
+			return err
+		}
+		if err := tags.List().Insert(1, "b"); err != nil {
+			return err
+		}
+		body, err := root.Get("body")
+		if err != nil {
+			return err
+		}
+		if err := body.Text().Splice(6, 5, "there"); err != nil {
+			return err
+		}
+		views, err := root.Get("views")
+		if err != nil {
+			return err
+		}
+		return views.Counter().Inc(2)
+	}); err != nil {
+		t.Fatalf("WithDocMut failed: %v", err)
+	}
+
+	patches, err := h.Diff(from, h.Heads())
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	want := []Patch{
+		{Action: PatchDelete, Path: []interface{}{"body", 6}, Length: 5},
+		{Action: PatchSplice, Path: []interface{}{"body", 6}, Value: "there"},
+		{Action: PatchDelete, Path: []interface{}{"removed"}},
+		{Action: PatchInsert, Path: []interface{}{"tags", 1}, Value: []interface{}{"b"}},
+		{Action: PatchPut, Path: []interface{}{"title"}, Value: "final"},
+		{Action: PatchIncrement, Path: []interface{}{"views"}, Value: int64(2)},
+	}
+	if !reflect.DeepEqual(patches, want) {
+		t.Fatalf("unexpected patches:\n got %#v\nwant %#v", patches, want)
+	}
+
+	// from the empty document everything is a put
+	patches, err = h.Diff(nil, from)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	if len(patches) != 5 {
+		t.Fatalf("expected 5 puts from empty document, got %#v", patches)
+	}
+}
+
+func TestDocumentHandleChangedSince(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+
+	ch := h.ChangedSince(h.Heads())
+	select {
+	case evt := <-ch:
+		t.Fatalf("unexpected event before change: %#v", evt)
+	default:
+	}
+
+	if err := h.WithDocMut(func(doc *automerge.Doc) error {
+		return doc.RootMap().Set("k", "v")
+	}); err != nil {
+		t.Fatalf("WithDocMut failed: %v", err)
+	}
+	select {
+	case evt := <-ch:
+		if evt.Err != nil || evt.DocumentID != h.DocID() || !sameHeads(evt.Heads, h.Heads()) {
+			t.Fatalf("unexpected event %#v", evt)
+		}
+		if len(evt.Patches) != 1 || evt.Patches[0].Action != PatchPut || evt.Patches[0].Value != "v" {
+			t.Fatalf("unexpected patches %#v", evt.Patches)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for patches")
+	}
+
+	// stale heads are answered immediately
+	select {
+	case evt := <-h.ChangedSince(nil):
+		if len(evt.Patches) != 1 {
+			t.Fatalf("unexpected patches %#v", evt.Patches)
+		}
+	default:
+		t.Fatal("expected immediate event for stale heads")
+	}
+
+	ch = h.ChangedSince(h.Heads())
+	if err := r.Delete(h.DocID()); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if evt := <-ch; !errors.Is(evt.Err, ErrDocumentDeleted) {
+		t.Fatalf("expected ErrDocumentDeleted, got %#v", evt)
+	}
+}
+
+func TestDocumentDiffSharedByWatchers(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+	ch1, stop1 := h.Subscribe(context.Background())
+	defer stop1()
+	ch2, stop2 := h.Subscribe(context.Background())
+	defer stop2()
+	changed := h.ChangedSince(h.Heads())
+
+	if err := h.SetPath([]interface{}{"title"}, "draft"); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+	e1, e2 := nextChange(t, ch1), nextChange(t, ch2)
+	var pe PatchEvent
+	select {
+	case pe = <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for patches")
+	}
+	if len(e1.Patches) != 1 || &e1.Patches[0] != &e2.Patches[0] || &pe.Patches[0] != &e1.Patches[0] {
+		t.Fatalf("expected the watchers to share one diff: %v %v %v", e1.Patches, e2.Patches, pe.Patches)
+	}
+}
@@ -1,14 +1,18 @@
 package repo
 
 import (
+	"sync/atomic"
+
 	automerge "github.com/automerge/automerge-go"
+	"github.com/google/uuid"
 )
 
 // DocumentHandle provides access to a document along with a mechanism
 // to wait for changes. It is the primary way to interact with a document.
 type DocumentHandle struct {
-	doc  *Document
-	repo *Repo
+	doc    *Document
+	repo   *Repo
+	closed atomic.Bool
 }
 
 // DocID returns the ID of the document.
@@ -37,6 +41,7 @@ func (h *DocumentHandle) Compact() error {
 
 // Changed returns a channel that will receive a single notification when
 // the document is next modified.
+// Use Subscribe to be told about every change.
 func (h *DocumentHandle) Changed() <-chan struct{} {
 	return h.doc.watch()
 }
@@ -49,28 +54,77 @@ func (h *DocumentHandle) WithDoc(f func(*automerge.Doc)) {
 }
 
 // WithDocMut runs f with the document and commits the result. A change
-// notification is sent if the document was modified.
-func (h *DocumentHandle) WithDocMut(f func(*automerge.Doc) error) error {
+// notification is sent if the document was modified. The commit message and
+// timestamp can be set with CommitOptions.
+func (h *DocumentHandle) WithDocMut(f func(*automerge.Doc) error, opts ...CommitOptions) error {
+	if h.doc.deleted.Load() {
+		return ErrDocumentDeleted
+	}
+	msg, commitOpts := commitOptions(opts)
+	if h.repo != nil && h.repo.schemaFor(h.doc.ID, h.doc.Doc) != nil {
+		return h.withValidatedDocMut(f, msg, commitOpts)
+	}
 	h.doc.ensureDoc()
-	if err := f(h.doc.Doc); err != nil {
-		return err
+	h.doc.mutMu.Lock()
+	before := h.doc.Doc.Heads()
+	err := f(h.doc.Doc)
+	if err == nil {
+		_, err = h.doc.Doc.Commit(msg, commitOpts...)
 	}
-	if _, err := h.doc.Doc.Commit("update"); err != nil {
+	after := h.doc.Doc.Heads()
+	h.doc.mutMu.Unlock()
+	if err != nil {
 		return err
 	}
-	h.doc.notifyWatchers()
+	h.doc.changed(before, after, h.origin())
 	return nil
 }
 
+// origin is the ChangeOrigin of local changes made through h.
+func (h *DocumentHandle) origin() ChangeOrigin {
+	return ChangeOrigin{Kind: OriginLocal, handle: h}
+}
+
+// commitOptions converts CommitOptions into a commit message and automerge
+// options.
+func commitOptions(opts []CommitOptions) (string, []automerge.CommitOptions) {
+	msg := "update"
+	var commitOpts []automerge.CommitOptions
+	for _, o := range opts {
+		if o.Message != "" {
+			msg = o.Message
+		}
+		if !o.Time.IsZero() {
+			t := o.Time
+			commitOpts = []automerge.CommitOptions{{Time: &t}}
+		}
+	}
+	return msg, commitOpts
+}
+
+// withDocMutAtomic is WithDocMut for changes that can fail after making some
+// of their operations. f runs on a fork that is merged back only if it
+// succeeds, as automerge cannot roll back uncommitted operations.
+func (h *DocumentHandle) withDocMutAtomic(f func(*automerge.Doc) error, opts ...CommitOptions) error {
+	if h.doc.deleted.Load() {
+		return ErrDocumentDeleted
+	}
+	msg, commitOpts := commitOptions(opts)
+	return h.withValidatedDocMut(f, msg, commitOpts)
+}
+
 // NewDocHandle creates a new document and returns a handle to it.
 func (r *Repo) NewDocHandle() *DocumentHandle {
-	doc := r.NewDoc()
+	doc := &Document{ID: uuid.New(), Doc: automerge.New()}
+	doc.pin(pinHandle)
+	r.putDoc(doc)
 	return &DocumentHandle{doc: doc, repo: r}
 }
 
-// GetDocHandle returns a handle for the document with the given id.
+// GetDocHandle returns a handle for the document with the given id, reloading
+// it from the store if it was evicted from memory.
 func (r *Repo) GetDocHandle(id DocumentID) (*DocumentHandle, bool) {
-	d, ok := r.GetDoc(id)
+	d, ok := r.getDoc(id, pinHandle)
 	if !ok {
 		return nil, false
 	}
@@ -85,6 +139,15 @@ func (d *Document) ensureDoc() {
 	}
 }
 
+// fork returns a copy of the document as of heads, or of its current state
+// if heads is empty. Forking commits pending operations, so it waits for any
+// change in progress.
+func (d *Document) fork(heads ...automerge.ChangeHash) (*automerge.Doc, error) {
+	d.mutMu.Lock()
+	defer d.mutMu.Unlock()
+	return d.Doc.Fork(heads...)
+}
+
 func (d *Document) watch() <-chan struct{} {
 	ch := make(chan struct{}, 1)
 	d.watchersMu.Lock()
@@ -93,10 +156,36 @@ func (d *Document) watch() <-chan struct{} {
 	return ch
 }
 
-func (d *Document) notifyWatchers() {
+// changed records a change that took the document from before to after and
+// tells observers and watchers about it. after must be read under d.mutMu
+// together with the change, as later changes may already have landed.
+func (d *Document) changed(before, after []automerge.ChangeHash, origin ChangeOrigin) {
+	d.recordChanges(before)
+	if origin.handle != nil {
+		d.watchersMu.Lock()
+		observers := make([]func(before, after []automerge.ChangeHash), 0, len(d.localObservers[origin.handle]))
+		for _, f := range d.localObservers[origin.handle] {
+			observers = append(observers, f)
+		}
+		d.watchersMu.Unlock()
+		for _, f := range observers {
+			f(before, after)
+		}
+		origin.handle = nil
+	}
+	d.notifyWatchers(origin)
+}
+
+func (d *Document) notifyWatchers(origin ChangeOrigin) {
 	d.watchersMu.Lock()
 	w := d.watchers
+	pw := d.patchWatchers
+	subs := make([]*subscription, 0, len(d.subscriptions))
+	for s := range d.subscriptions {
+		subs = append(subs, s)
+	}
 	d.watchers = nil
+	d.patchWatchers = nil
 	d.watchersMu.Unlock()
 	for _, ch := range w {
 		select {
@@ -104,4 +193,11 @@ func (d *Document) notifyWatchers() {
 		default:
 		}
 	}
+	// patches are computed off the goroutine that made the change
+	for _, p := range pw {
+		go d.sendPatches(p)
+	}
+	for _, s := range subs {
+		d.publish(s, origin)
+	}
 }
\ No newline at end of file
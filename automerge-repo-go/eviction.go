@@ -0,0 +1,249 @@
+package repo
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// pin selects which usage counter keeps a document from being evicted.
+type pin int
+
+const (
+	// pinHandle is held by an open DocumentHandle.
+	pinHandle pin = iota
+	// pinSync is held while the repo syncs, saves, compacts or imports the
+	// document.
+	pinSync
+	// pinExposed is taken by GetDoc and NewDoc. Their callers have no way to
+	// release it, so such documents are never evicted.
+	pinExposed
+)
+
+func (d *Document) pin(p pin) {
+	switch p {
+	case pinHandle:
+		d.handles.Add(1)
+	case pinSync:
+		d.syncing.Add(1)
+	case pinExposed:
+		d.exposed.Store(true)
+	}
+	d.touch()
+}
+
+func (d *Document) unpin(p pin) {
+	switch p {
+	case pinHandle:
+		d.handles.Add(-1)
+	case pinSync:
+		d.syncing.Add(-1)
+	}
+	d.touch()
+}
+
+func (d *Document) touch() {
+	d.lastUsed.Store(time.Now().UnixNano())
+}
+
+// idle reports whether the document has no open handles, no sync in flight
+// and was never handed out by GetDoc or NewDoc.
+func (d *Document) idle() bool {
+	return d.handles.Load() == 0 && d.syncing.Load() == 0 && !d.exposed.Load()
+}
+
+// MemoryStats reports how many documents are held in memory, their
+// approximate encoded size and how often documents have been evicted and
+// reloaded.
+type MemoryStats struct {
+	Resident      int
+	ResidentBytes int64
+	Evicted       int
+	Evictions     uint64
+	Reloads       uint64
+}
+
+// WithMemoryLimit bounds the number of documents kept in memory. When the
+// limit is exceeded the least recently used documents that have no open
+// DocumentHandle and no sync in flight are saved to the store and dropped
+// from memory. They are reloaded on demand by GetDocHandle and Find.
+// Documents returned by GetDoc or NewDoc are never evicted, as their callers
+// cannot tell the repo when they are done with them.
+// Eviction requires a store; a limit of zero disables it.
+func (r *Repo) WithMemoryLimit(maxDocs int) *Repo {
+	r.mu.Lock()
+	r.maxResident = maxDocs
+	r.mu.Unlock()
+	return r
+}
+
+// WithMemoryBudget bounds the approximate encoded size, in bytes, of the
+// documents kept in memory. Documents are evicted as with WithMemoryLimit
+// while the budget is exceeded. A budget of zero disables it.
+func (r *Repo) WithMemoryBudget(maxBytes int64) *Repo {
+	r.mu.Lock()
+	r.maxResidentBytes = maxBytes
+	r.mu.Unlock()
+	return r
+}
+
+// MemoryStats returns the current eviction counters.
+func (r *Repo) MemoryStats() MemoryStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	stats := MemoryStats{
+		Resident:  len(r.docs),
+		Evicted:   len(r.evicted),
+		Evictions: r.evictions,
+		Reloads:   r.reloads,
+	}
+	for _, d := range r.docs {
+		stats.ResidentBytes += d.sizeBytes()
+	}
+	return stats
+}
+
+// Evict drops idle documents from memory until the repo is within its memory
+// limit.
+func (r *Repo) Evict() {
+	r.evictIfNeeded(DocumentID{})
+}
+
+// Find returns a handle for the document, loading it from the store if it is
+// not in memory. Deleted documents return ErrDocumentDeleted.
+func (r *Repo) Find(id DocumentID) (*DocumentHandle, error) {
+	if h, ok := r.GetDocHandle(id); ok {
+		return h, nil
+	}
+	if r.store == nil {
+		return nil, fmt.Errorf("document %s not found", id)
+	}
+	if r.isDeleted(id) {
+		return nil, ErrDocumentDeleted
+	}
+	doc, err := r.store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	if _, ok := r.deleted[id]; ok {
+		// deleted while we were loading
+		r.mu.Unlock()
+		return nil, ErrDocumentDeleted
+	}
+	if existing, ok := r.docs[id]; ok {
+		// loaded concurrently by someone else
+		doc = existing
+	} else {
+		r.docs[id] = doc
+	}
+	doc.pin(pinHandle)
+	r.mu.Unlock()
+	r.evictIfNeeded(id)
+	return &DocumentHandle{doc: doc, repo: r}, nil
+}
+
+// Close releases the handle so that the document may be evicted from memory
+// once it is idle. The handle should not be used afterwards.
+func (h *DocumentHandle) Close() {
+	if h.closed.Swap(true) {
+		return
+	}
+	h.doc.unpin(pinHandle)
+	if h.repo != nil {
+		h.repo.evictIfNeeded(DocumentID{})
+	}
+}
+
+// reload loads an evicted document back into memory.
+func (r *Repo) reload(id DocumentID, p pin) (*Document, bool) {
+	if r.store == nil {
+		return nil, false
+	}
+	doc, err := r.store.Load(id)
+	if err != nil {
+		log.Printf("reloading evicted document %s: %v", id, err)
+		return nil, false
+	}
+	r.mu.Lock()
+	if existing, ok := r.docs[id]; ok {
+		existing.pin(p)
+		r.mu.Unlock()
+		return existing, true
+	}
+	if _, ok := r.evicted[id]; !ok {
+		// deleted while we were loading
+		r.mu.Unlock()
+		return nil, false
+	}
+	doc.pin(p)
+	doc.touch()
+	r.docs[id] = doc
+	delete(r.evicted, id)
+	r.reloads++
+	r.mu.Unlock()
+	r.evictIfNeeded(id)
+	return doc, true
+}
+
+// evictIfNeeded saves and drops least recently used idle documents while the
+// repo is over its memory limit or budget. The document keep is never
+// evicted.
+func (r *Repo) evictIfNeeded(keep DocumentID) {
+	if r.store == nil {
+		return
+	}
+	r.mu.RLock()
+	if r.maxResident <= 0 && r.maxResidentBytes <= 0 {
+		r.mu.RUnlock()
+		return
+	}
+	over := 0
+	if r.maxResident > 0 {
+		over = len(r.docs) - r.maxResident
+	}
+	var overBytes int64
+	if r.maxResidentBytes > 0 {
+		overBytes = -r.maxResidentBytes
+		for _, d := range r.docs {
+			overBytes += d.sizeBytes()
+		}
+	}
+	if over <= 0 && overBytes <= 0 {
+		r.mu.RUnlock()
+		return
+	}
+	candidates := make([]*Document, 0, len(r.docs))
+	for id, d := range r.docs {
+		if id != keep && d.idle() {
+			candidates = append(candidates, d)
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed.Load() < candidates[j].lastUsed.Load()
+	})
+	for _, d := range candidates {
+		if over <= 0 && overBytes <= 0 {
+			return
+		}
+		heads := d.Doc.Heads()
+		if err := r.saveDoc(d); err != nil {
+			log.Printf("evicting %s: %v", d.ID, err)
+			continue
+		}
+		r.mu.Lock()
+		// Only drop the document if nobody started using or changing it
+		// while it was being saved.
+		if r.docs[d.ID] == d && d.idle() && sameHeads(heads, d.Doc.Heads()) {
+			delete(r.docs, d.ID)
+			r.evicted[d.ID] = d.sizeBytes()
+			r.evictions++
+			over--
+			overBytes -= d.sizeBytes()
+		}
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,124 @@
+package repo
+
+import (
+	"testing"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+func TestRepoMemoryLimitEvictsIdleDocs(t *testing.T) {
+	store := newMemStore()
+	r := NewWithStore(store).WithMemoryLimit(2)
+
+	held := r.NewDocHandle()
+	if err := held.WithDocMut(func(doc *automerge.Doc) error {
+		return doc.RootMap().Set("k", "held")
+	}); err != nil {
+		t.Fatalf("mutate err: %v", err)
+	}
+
+	var idle []DocumentID
+	for i := 0; i < 3; i++ {
+		h := r.NewDocHandle()
+		if err := h.WithDocMut(func(doc *automerge.Doc) error {
+			return doc.RootMap().Set("k", int64(i))
+		}); err != nil {
+			t.Fatalf("mutate err: %v", err)
+		}
+		h.Close()
+		idle = append(idle, h.DocID())
+	}
+
+	stats := r.MemoryStats()
+	if stats.Resident != 2 || stats.Evicted != 2 || stats.Evictions != 2 {
+		t.Fatalf("unexpected stats after eviction: %#v", stats)
+	}
+	if _, ok := r.docs[held.DocID()]; !ok {
+		t.Fatalf("document with an open handle was evicted")
+	}
+	if _, ok := r.docs[idle[0]]; ok {
+		t.Fatalf("least recently used document was not evicted")
+	}
+
+	// evicted documents are reloaded on demand
+	h, err := r.Find(idle[0])
+	if err != nil {
+		t.Fatalf("find err: %v", err)
+	}
+	var v int64
+	h.WithDoc(func(doc *automerge.Doc) {
+		v, _ = automerge.As[int64](doc.RootMap().Get("k"))
+	})
+	if v != 0 {
+		t.Fatalf("unexpected value after reload: %v", v)
+	}
+	if stats := r.MemoryStats(); stats.Reloads != 1 {
+		t.Fatalf("expected one reload, got %#v", stats)
+	}
+	if _, ok := r.GetDoc(idle[1]); !ok {
+		t.Fatalf("GetDoc did not reload evicted document")
+	}
+}
+
+func TestRepoMemoryLimitRequiresStore(t *testing.T) {
+	r := New().WithMemoryLimit(1)
+	for i := 0; i < 3; i++ {
+		r.NewDocHandle().Close()
+	}
+	if stats := r.MemoryStats(); stats.Resident != 3 || stats.Evictions != 0 {
+		t.Fatalf("documents evicted without a store: %#v", stats)
+	}
+}
+
+func TestRepoMemoryLimitKeepsExposedDocs(t *testing.T) {
+	store := newMemStore()
+	r := NewWithStore(store).WithMemoryLimit(1)
+
+	h := r.NewDocHandle()
+	id := h.DocID()
+	h.Close()
+	doc, ok := r.GetDoc(id)
+	if !ok {
+		t.Fatalf("GetDoc failed")
+	}
+	for i := 0; i < 3; i++ {
+		r.NewDocHandle().Close()
+	}
+	if err := doc.Set("k", "v"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if _, ok := r.docs[id]; !ok {
+		t.Fatalf("document returned by GetDoc was evicted")
+	}
+	got, _ := r.GetDoc(id)
+	if v, _ := got.Get("k"); v != "v" {
+		t.Fatalf("write through GetDoc lost: %v", v)
+	}
+}
+
+func TestRepoMemoryBudget(t *testing.T) {
+	store := newMemStore()
+	r := NewWithStore(store)
+
+	var ids []DocumentID
+	for i := 0; i < 4; i++ {
+		h := r.NewDocHandle()
+		if err := h.WithDocMut(func(doc *automerge.Doc) error {
+			return doc.RootMap().Set("data", make([]byte, 4096))
+		}); err != nil {
+			t.Fatalf("mutate err: %v", err)
+		}
+		h.Close()
+		ids = append(ids, h.DocID())
+	}
+	size := r.docs[ids[0]].sizeBytes()
+	r.WithMemoryBudget(2*size + size/2).Evict()
+
+	stats := r.MemoryStats()
+	if stats.Resident != 2 || stats.ResidentBytes > 2*size+size/2 || stats.Evictions != 2 {
+		t.Fatalf("unexpected stats after eviction: %#v", stats)
+	}
+	if _, ok := r.docs[ids[3]]; !ok {
+		t.Fatalf("most recently used document was evicted")
+	}
+}
@@ -0,0 +1,216 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ErrSlowConsumer is returned when a message cannot be queued for a peer
+// whose outgoing queue is full and the SlowConsumerPolicy is
+// SlowConsumerDrop or SlowConsumerDisconnect.
+var ErrSlowConsumer = errors.New("peer outgoing queue full")
+
+// RateLimit is a token bucket: Rate tokens are added per second up to Burst.
+// A zero Rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// SlowConsumerPolicy decides what happens to a message for a peer whose
+// outgoing queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerBlock makes the sender wait until the queue has room.
+	SlowConsumerBlock SlowConsumerPolicy = iota
+	// SlowConsumerDrop discards the message. A dropped sync message resets
+	// the peer's sync state for the document so that the next sync starts
+	// over.
+	SlowConsumerDrop
+	// SlowConsumerDisconnect closes the connection to the peer.
+	SlowConsumerDisconnect
+)
+
+// FlowControl limits the traffic exchanged with each peer. The zero value
+// applies no limits and writes messages on the sender's goroutine.
+type FlowControl struct {
+	// Messages and Bytes limit incoming messages and sync payload bytes. Once
+	// a bucket is empty the peer's connection is not read until it refills,
+	// so that the backpressure reaches the sender.
+	Messages RateLimit
+	Bytes    RateLimit
+	// QueueSize enables a bounded outgoing queue of this many messages per
+	// peer, drained by a writer goroutine.
+	QueueSize int
+	// SlowConsumer applies when the outgoing queue is full.
+	SlowConsumer SlowConsumerPolicy
+}
+
+// PeerStats reports the traffic exchanged with one peer.
+type PeerStats struct {
+	MessagesIn  uint64
+	BytesIn     uint64
+	MessagesOut uint64
+	// Throttled counts the times reading from the peer paused for a rate limit.
+	Throttled uint64
+	// Dropped counts outgoing messages discarded by SlowConsumerDrop.
+	Dropped uint64
+	// Queued is the number of messages waiting in the outgoing queue.
+	Queued int
+}
+
+// WithFlowControl sets the limits applied to connections added afterwards.
+func (h *RepoHandle) WithFlowControl(fc FlowControl) *RepoHandle {
+	h.mu.Lock()
+	h.flow = fc
+	h.mu.Unlock()
+	return h
+}
+
+// PeerStats returns the traffic statistics of a connected peer.
+func (h *RepoHandle) PeerStats(remote RepoID) (PeerStats, bool) {
+	h.mu.Lock()
+	pi, ok := h.peers[remote]
+	h.mu.Unlock()
+	if !ok {
+		return PeerStats{}, false
+	}
+	return PeerStats{
+		MessagesIn:  pi.stats.messagesIn.Load(),
+		BytesIn:     pi.stats.bytesIn.Load(),
+		MessagesOut: pi.stats.messagesOut.Load(),
+		Throttled:   pi.stats.throttled.Load(),
+		Dropped:     pi.stats.dropped.Load(),
+		Queued:      len(pi.out),
+	}, true
+}
+
+type peerStats struct {
+	messagesIn, bytesIn, messagesOut, throttled, dropped atomic.Uint64
+}
+
+// tokenBucket implements RateLimit. Taking more tokens than are available
+// leaves the bucket in debt, so a message larger than Burst still passes
+// once the bucket has refilled.
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(l RateLimit) *tokenBucket {
+	if l.Rate <= 0 {
+		return nil
+	}
+	if l.Burst <= 0 {
+		l.Burst = 1
+	}
+	return &tokenBucket{limit: l, tokens: float64(l.Burst), last: time.Now()}
+}
+
+// take removes n tokens and returns how long to wait before proceeding.
+func (b *tokenBucket) take(n int, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if max := float64(b.limit.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.limit.Rate * float64(time.Second))
+}
+
+// throttle accounts for a received message and pauses until the peer's
+// rate limits allow it through. It returns false if the peer was removed
+// while waiting.
+func (h *RepoHandle) throttle(remote RepoID, pi *peerInfo, msg RepoMessage) bool {
+	pi.stats.messagesIn.Add(1)
+	pi.stats.bytesIn.Add(uint64(len(msg.Message)))
+	now := time.Now()
+	wait := pi.msgLimit.take(1, now)
+	if w := pi.byteLimit.take(len(msg.Message), now); w > wait {
+		wait = w
+	}
+	if wait <= 0 {
+		return true
+	}
+	pi.stats.throttled.Add(1)
+	h.tryEmitEvent(HandleEvent{Type: EventRateLimited, Peer: remote, DocumentID: msg.DocumentID})
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-pi.stop:
+		return false
+	}
+}
+
+// send writes msg to the peer, through its outgoing queue if it has one.
+func (h *RepoHandle) send(remote RepoID, pi *peerInfo, msg RepoMessage) error {
+	if pi.out == nil {
+		if err := pi.conn.SendMessage(msg); err != nil {
+			return err
+		}
+		pi.stats.messagesOut.Add(1)
+		return nil
+	}
+	select {
+	case pi.out <- msg:
+		return nil
+	case <-pi.stop:
+		return errPeerGone(remote)
+	default:
+	}
+	switch pi.slow {
+	case SlowConsumerDrop:
+		pi.stats.dropped.Add(1)
+		if msg.Type == "sync" {
+			h.mu.Lock()
+			delete(pi.syncStates, msg.DocumentID)
+			h.mu.Unlock()
+		}
+		h.tryEmitEvent(HandleEvent{Type: EventSlowConsumer, Peer: remote, DocumentID: msg.DocumentID, Err: ErrSlowConsumer})
+		return ErrSlowConsumer
+	case SlowConsumerDisconnect:
+		h.tryEmitEvent(HandleEvent{Type: EventSlowConsumer, Peer: remote, DocumentID: msg.DocumentID, Err: ErrSlowConsumer})
+		h.dropConn(remote, pi, ConnFinished{Kind: ConnFinishedSendError, Err: ErrSlowConsumer})
+		return ErrSlowConsumer
+	}
+	h.tryEmitEvent(HandleEvent{Type: EventSlowConsumer, Peer: remote, DocumentID: msg.DocumentID})
+	select {
+	case pi.out <- msg:
+		return nil
+	case <-pi.stop:
+		return errPeerGone(remote)
+	}
+}
+
+func errPeerGone(remote RepoID) error {
+	return fmt.Errorf("peer %s not found", remote)
+}
+
+// writeLoop drains the peer's outgoing queue onto its connection.
+func (h *RepoHandle) writeLoop(remote RepoID, pi *peerInfo) {
+	for {
+		select {
+		case <-pi.stop:
+			return
+		case msg := <-pi.out:
+			if err := pi.conn.SendMessage(msg); err != nil {
+				h.emitEvent(HandleEvent{Type: EventConnError, Peer: remote, Err: err})
+				h.dropConn(remote, pi, ConnFinished{Kind: ConnFinishedSendError, Err: err})
+				return
+			}
+			pi.stats.messagesOut.Add(1)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package repo
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// stalledConn never completes a send until it is closed.
+type stalledConn struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newStalledConn() *stalledConn {
+	return &stalledConn{closed: make(chan struct{})}
+}
+
+func (c *stalledConn) SendMessage(m RepoMessage) error {
+	<-c.closed
+	return io.ErrClosedPipe
+}
+
+func (c *stalledConn) RecvMessage() (RepoMessage, error) {
+	<-c.closed
+	return RepoMessage{}, io.EOF
+}
+
+func (c *stalledConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(RateLimit{Rate: 10, Burst: 2})
+	now := time.Now()
+	if w := b.take(1, now); w != 0 {
+		t.Fatalf("expected no wait within burst, got %v", w)
+	}
+	if w := b.take(1, now); w != 0 {
+		t.Fatalf("expected no wait within burst, got %v", w)
+	}
+	if w := b.take(1, now); w != 100*time.Millisecond {
+		t.Fatalf("expected 100ms wait, got %v", w)
+	}
+	// the debt carries over to the next message
+	if w := b.take(1, now.Add(100*time.Millisecond)); w != 100*time.Millisecond {
+		t.Fatalf("expected 100ms wait, got %v", w)
+	}
+	if w := b.take(5, now.Add(time.Second)); w != 300*time.Millisecond {
+		t.Fatalf("expected oversized take to wait 300ms, got %v", w)
+	}
+	if newTokenBucket(RateLimit{}).take(100, now) != 0 {
+		t.Fatalf("expected zero rate to mean no limit")
+	}
+}
+
+func TestRepoHandleRateLimit(t *testing.T) {
+	h1 := NewRepoHandle(New())
+	h2 := NewRepoHandle(New()).WithFlowControl(FlowControl{Messages: RateLimit{Rate: 50, Burst: 1}})
+	defer h1.Close()
+	defer h2.Close()
+	c1, c2 := newMockConn()
+	_ = h1.AddConn(h2.Repo.ID, c1)
+	_ = h2.AddConn(h1.Repo.ID, c2)
+	<-h1.Events
+	<-h2.Events
+
+	start := time.Now()
+	go func() {
+		for i := 0; i < 5; i++ {
+			_ = h1.SendMessage(h2.Repo.ID, RepoMessage{Type: "note", FromRepoID: h1.Repo.ID, ToRepoID: h2.Repo.ID})
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		select {
+		case <-h2.Inbox:
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for message %d", i)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond {
+		t.Fatalf("expected rate limit to spread messages, took %v", elapsed)
+	}
+	waitEvent(t, h2, EventRateLimited)
+	stats, ok := h2.PeerStats(h1.Repo.ID)
+	if !ok || stats.MessagesIn != 5 || stats.Throttled == 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRepoHandleSlowConsumer(t *testing.T) {
+	msg := RepoMessage{Type: "note"}
+
+	h := NewRepoHandle(New()).WithFlowControl(FlowControl{QueueSize: 1, SlowConsumer: SlowConsumerDrop})
+	defer h.Close()
+	peer := uuid.New()
+	h.AddConn(peer, newStalledConn())
+	<-h.Events
+	// the writer takes one message and stalls, the next fills the queue
+	var err error
+	for i := 0; i < 4 && err == nil; i++ {
+		err = h.SendMessage(peer, msg)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !errors.Is(err, ErrSlowConsumer) {
+		t.Fatalf("expected ErrSlowConsumer, got %v", err)
+	}
+	if evt := waitEvent(t, h, EventSlowConsumer); !errors.Is(evt.Err, ErrSlowConsumer) {
+		t.Fatalf("unexpected event %+v", evt)
+	}
+	stats, _ := h.PeerStats(peer)
+	if stats.Dropped != 1 || stats.Queued != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	h = NewRepoHandle(New()).WithFlowControl(FlowControl{QueueSize: 1, SlowConsumer: SlowConsumerDisconnect})
+	defer h.Close()
+	cc := h.AddConn(peer, newStalledConn())
+	<-h.Events
+	err = nil
+	for i := 0; i < 4 && err == nil; i++ {
+		err = h.SendMessage(peer, msg)
+		time.Sleep(5 * time.Millisecond)
+	}
+	if res := cc.Await(); res.Kind != ConnFinishedSendError || !errors.Is(res.Err, ErrSlowConsumer) {
+		t.Fatalf("expected slow consumer disconnect, got %+v", res)
+	}
+	if _, ok := h.PeerStats(peer); ok {
+		t.Fatalf("slow peer still connected")
+	}
+}
+
+func TestRepoHandleRateLimitUnreadEvents(t *testing.T) {
+	h1 := NewRepoHandle(New())
+	h2 := NewRepoHandle(New()).WithFlowControl(FlowControl{Messages: RateLimit{Rate: 1000, Burst: 1}})
+	defer h1.Close()
+	defer h2.Close()
+	c1, c2 := newMockConn()
+	_ = h1.AddConn(h2.Repo.ID, c1)
+	_ = h2.AddConn(h1.Repo.ID, c2)
+
+	// nobody reads h2.Events, so throttling must not block on it
+	go func() {
+		for i := 0; i < 30; i++ {
+			_ = h1.SendMessage(h2.Repo.ID, RepoMessage{Type: "note", FromRepoID: h1.Repo.ID, ToRepoID: h2.Repo.ID})
+		}
+	}()
+	for i := 0; i < 30; i++ {
+		select {
+		case <-h2.Inbox:
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for message %d", i)
+		}
+	}
+}
@@ -2,8 +2,10 @@ package repo
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	automerge "github.com/automerge/automerge-go"
@@ -11,9 +13,13 @@ import (
 
 // HandleEvent represents a peer connection lifecycle event emitted by RepoHandle.
 type HandleEvent struct {
-	Type string
-	Peer RepoID
-	Err  error
+	Type       string
+	Peer       RepoID
+	DocumentID DocumentID
+	Err        error
+	// Attempt numbers EventConnAttempt events, counting from 1 since the
+	// last healthy connection.
+	Attempt int
 }
 
 const (
@@ -23,6 +29,25 @@ const (
 	EventPeerDisconnected = "peer_disconnected"
 	// EventConnError is emitted when a connection error occurs.
 	EventConnError = "conn_error"
+	// EventDocTombstone is emitted when a peer reports that it deleted a document.
+	EventDocTombstone = "doc_tombstone"
+	// EventQuotaExceeded is emitted when a sync message is rejected because it
+	// would exceed the repo's Quota. Err holds the *QuotaError.
+	EventQuotaExceeded = "quota_exceeded"
+	// EventValidationFailed is emitted when a peer sends changes that violate
+	// the document's schema. Err holds the *ValidationError.
+	EventValidationFailed = "validation_failed"
+	// EventRateLimited is emitted when reading from a peer pauses because it
+	// exceeded a FlowControl rate limit. It is dropped when Events is full.
+	EventRateLimited = "rate_limited"
+	// EventSlowConsumer is emitted when a peer's outgoing queue is full. Err
+	// is ErrSlowConsumer if the message was dropped or the peer disconnected.
+	// It is dropped when Events is full.
+	EventSlowConsumer = "slow_consumer"
+	// EventConnAttempt is emitted before each dial of a retry loop started
+	// with AddConnWithRetry or AddConnWithRetryPolicy. It is dropped when
+	// Events is full.
+	EventConnAttempt = "conn_attempt"
 )
 
 // Conn abstracts a bidirectional channel capable of sending and receiving
@@ -49,6 +74,8 @@ type RepoHandle struct {
 	// Events publishes connection lifecycle notifications such as when peers
 	// connect or disconnect.
 	Events chan HandleEvent
+
+	flow FlowControl
 }
 
 func (h *RepoHandle) emitEvent(e HandleEvent) {
@@ -59,6 +86,20 @@ func (h *RepoHandle) emitEvent(e HandleEvent) {
 	h.Events <- e
 }
 
+// tryEmitEvent publishes e only if Events has room. It is used for
+// high-frequency events so that a handle whose Events nobody reads does not
+// stall its connections.
+func (h *RepoHandle) tryEmitEvent(e HandleEvent) {
+	if h.Events == nil {
+		return
+	}
+	defer func() { recover() }()
+	select {
+	case h.Events <- e:
+	default:
+	}
+}
+
 // ConnFinishedKind describes why a connection goroutine exited.
 type ConnFinishedKind int
 
@@ -69,8 +110,15 @@ const (
 	ConnFinishedSendError
 	// ConnFinishedLocalClose indicates the connection was closed locally via RemoveConn.
 	ConnFinishedLocalClose
+	// ConnFinishedTimeout indicates the peer stopped responding, detected by
+	// a receive failing with ErrConnTimeout.
+	ConnFinishedTimeout
 )
 
+// ErrConnTimeout is wrapped by receive errors of connections that detect an
+// unresponsive or idle peer, such as a missed pong.
+var ErrConnTimeout = errors.New("connection timed out")
+
 // ConnFinished provides the reason a connection goroutine exited.
 type ConnFinished struct {
 	Kind ConnFinishedKind
@@ -90,94 +138,148 @@ type peerInfo struct {
 	conn       Conn
 	complete   chan ConnFinished
 	syncStates map[DocumentID]*automerge.SyncState
+	// tombstoned holds documents the peer told us it deleted.
+	tombstoned map[DocumentID]struct{}
+
+	// stop is closed when the peer is removed.
+	stop     chan struct{}
+	stopOnce sync.Once
+	// out is the outgoing queue drained by writeLoop, nil without one.
+	out       chan RepoMessage
+	slow      SlowConsumerPolicy
+	msgLimit  *tokenBucket
+	byteLimit *tokenBucket
+	stats     peerStats
+	// identity is the authenticated identity of this connection, if any.
+	identity *Identity
+	// removed is set by the first call that tears the connection down.
+	removed atomic.Bool
+}
+
+func (pi *peerInfo) shutdown() {
+	pi.stopOnce.Do(func() { close(pi.stop) })
+	pi.conn.Close()
 }
 
 // NewRepoHandle wraps r with connection management and returns the handle.
 func NewRepoHandle(r *Repo) *RepoHandle {
-	return &RepoHandle{
+	h := &RepoHandle{
 		Repo:   r,
 		peers:  make(map[RepoID]*peerInfo),
 		Inbox:  make(chan RepoMessage, 16),
 		Events: make(chan HandleEvent, 8),
 	}
+	r.onDelete(h.docDeleted)
+	return h
 }
 
 // AddConn registers a connection to a remote peer and starts a goroutine to
 // forward its messages onto the handle's Inbox channel. It returns a
 // ConnComplete that resolves when the connection goroutine exits.
+//
+// A new connection for a peer that is already connected replaces the old
+// one, which is closed. If the old connection is authenticated, the new one
+// must carry an identity with the same Subject; otherwise it is closed and
+// its ConnComplete resolves with ErrPeerIdentity, so that nobody can take
+// over an authenticated peer by claiming its repo ID.
 func (h *RepoHandle) AddConn(remote RepoID, c Conn) ConnComplete {
+	var identity *Identity
+	if a, ok := c.(Authenticated); ok {
+		identity = a.Identity()
+	}
+	done := make(chan ConnFinished, 1)
 	h.mu.Lock()
 	if h.peers == nil {
 		h.peers = make(map[RepoID]*peerInfo)
 	}
-	done := make(chan ConnFinished, 1)
-	h.peers[remote] = &peerInfo{conn: c, complete: done, syncStates: make(map[DocumentID]*automerge.SyncState)}
+	old := h.peers[remote]
+	if old != nil && old.identity != nil && (identity == nil || identity.Subject != old.identity.Subject) {
+		h.mu.Unlock()
+		c.Close()
+		done <- ConnFinished{Kind: ConnFinishedLocalClose, Err: fmt.Errorf("%w: %s is connected as %q", ErrPeerIdentity, remote, old.identity.Subject)}
+		close(done)
+		return ConnComplete{ch: done}
+	}
+	pi := &peerInfo{
+		conn:       c,
+		complete:   done,
+		syncStates: make(map[DocumentID]*automerge.SyncState),
+		tombstoned: make(map[DocumentID]struct{}),
+		stop:       make(chan struct{}),
+		slow:       h.flow.SlowConsumer,
+		msgLimit:   newTokenBucket(h.flow.Messages),
+		byteLimit:  newTokenBucket(h.flow.Bytes),
+		identity:   identity,
+	}
+	if h.flow.QueueSize > 0 {
+		pi.out = make(chan RepoMessage, h.flow.QueueSize)
+		go h.writeLoop(remote, pi)
+	}
+	h.peers[remote] = pi
 	h.mu.Unlock()
+	if old != nil {
+		h.dropConn(remote, old, ConnFinished{Kind: ConnFinishedLocalClose, Err: errReplaced})
+	}
 
-	go h.readLoop(remote, c, done)
+	go h.readLoop(remote, pi)
 	h.emitEvent(HandleEvent{Type: EventPeerConnected, Peer: remote})
+	if ids := h.Repo.tombstones(); len(ids) > 0 {
+		go h.sendTombstones(remote, pi, ids)
+	}
 	return ConnComplete{ch: done}
 }
 
-// AddConnWithRetry repeatedly dials the remote using dial and registers the
-// connection with AddConn. If the connection closes with an error it will be
-// retried after delay until ctx is canceled. The returned ConnComplete resolves
-// when the retry loop exits.
-func (h *RepoHandle) AddConnWithRetry(ctx context.Context, remote RepoID, dial func(context.Context) (Conn, error), delay time.Duration) ConnComplete {
-	done := make(chan ConnFinished, 1)
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				h.removePeer(remote, ConnFinished{Kind: ConnFinishedLocalClose, Err: ctx.Err()})
-				done <- ConnFinished{Kind: ConnFinishedLocalClose, Err: ctx.Err()}
-				close(done)
-				return
-			default:
-			}
-
-			conn, err := dial(ctx)
-			if err != nil {
-				done <- ConnFinished{Kind: ConnFinishedRecvError, Err: err}
-				close(done)
-				return
-			}
-			cc := h.AddConn(remote, conn)
-			cc.Await()
-
-			if ctx.Err() != nil {
-				h.removePeer(remote, ConnFinished{Kind: ConnFinishedLocalClose, Err: ctx.Err()})
-				done <- ConnFinished{Kind: ConnFinishedLocalClose, Err: ctx.Err()}
-				close(done)
-				return
-			}
-
-			// wait before reconnecting regardless of reason
-			time.Sleep(delay)
+// sendTombstones tells a newly connected peer about documents deleted with
+// DeleteOptions.Tombstone, so that it stops syncing them to us.
+func (h *RepoHandle) sendTombstones(remote RepoID, pi *peerInfo, ids []DocumentID) {
+	for _, id := range ids {
+		if h.shareDecision(SharePolicy.ShouldAnnounce, id, remote, pi) == DontShare {
 			continue
 		}
-	}()
-	return ConnComplete{ch: done}
+		msg := RepoMessage{Type: "tombstone", FromRepoID: h.Repo.ID, ToRepoID: remote, DocumentID: id}
+		if err := h.send(remote, pi, msg); err != nil {
+			return
+		}
+	}
 }
 
-// readLoop continuously receives messages from c and publishes them to Inbox.
-func (h *RepoHandle) readLoop(remote RepoID, c Conn, done chan ConnFinished) {
+// AddConnWithRetry repeatedly dials the remote using dial and registers the
+// connection with AddConn. Failed dials and closed connections are retried
+// after delay until ctx is canceled. The returned ConnComplete resolves when
+// the retry loop exits. See AddConnWithRetryPolicy for backoff and limits.
+func (h *RepoHandle) AddConnWithRetry(ctx context.Context, remote RepoID, dial func(context.Context) (Conn, error), delay time.Duration) ConnComplete {
+	return h.AddConnWithRetryPolicy(ctx, remote, dial, RetryPolicy{InitialDelay: delay})
+}
+
+// readLoop continuously receives messages from the peer and publishes them to Inbox.
+func (h *RepoHandle) readLoop(remote RepoID, pi *peerInfo) {
 	var err error
 	for {
 		var msg RepoMessage
-		msg, err = c.RecvMessage()
+		msg, err = pi.conn.RecvMessage()
 		if err != nil {
 			h.emitEvent(HandleEvent{Type: EventConnError, Peer: remote, Err: err})
 			break
 		}
+		if !h.throttle(remote, pi, msg) {
+			break
+		}
 		if msg.Type == "sync" {
-			h.handleSyncMessage(remote, msg)
+			h.handleSyncMessage(remote, pi, msg)
+			continue
+		}
+		if msg.Type == "tombstone" {
+			h.handleTombstone(remote, pi, msg)
 			continue
 		}
 		fmt.Printf("readLoop: Sending message type %s to Inbox for doc %s\n", msg.Type, msg.DocumentID)
 		h.Inbox <- msg
 	}
-	h.removePeer(remote, ConnFinished{Kind: ConnFinishedRecvError, Err: err})
+	kind := ConnFinishedRecvError
+	if errors.Is(err, ErrConnTimeout) {
+		kind = ConnFinishedTimeout
+	}
+	h.dropConn(remote, pi, ConnFinished{Kind: kind, Err: err})
 }
 
 // RemoveConn closes and deletes the connection associated with the peer.
@@ -185,21 +287,47 @@ func (h *RepoHandle) RemoveConn(remote RepoID) {
 	h.removePeer(remote, ConnFinished{Kind: ConnFinishedLocalClose})
 }
 
+// errReplaced finishes a connection replaced by a newer one for the same peer.
+var errReplaced = errors.New("connection replaced")
+
 func (h *RepoHandle) removePeer(remote RepoID, reason ConnFinished) {
 	h.mu.Lock()
 	pi, ok := h.peers[remote]
+	h.mu.Unlock()
 	if ok {
+		h.dropConn(remote, pi, reason)
+	}
+}
+
+// removeConn drops remote's connection only if it is still the one whose
+// ConnComplete is cc.
+func (h *RepoHandle) removeConn(remote RepoID, cc ConnComplete, reason ConnFinished) {
+	h.mu.Lock()
+	pi, ok := h.peers[remote]
+	h.mu.Unlock()
+	if ok && pi.complete == cc.ch {
+		h.dropConn(remote, pi, reason)
+	}
+}
+
+// dropConn closes the connection pi to remote and resolves its ConnComplete
+// with reason. The peer is forgotten only if pi is still its connection, so
+// that a replaced connection cannot remove its successor.
+func (h *RepoHandle) dropConn(remote RepoID, pi *peerInfo, reason ConnFinished) {
+	if !pi.removed.CompareAndSwap(false, true) {
+		return
+	}
+	h.mu.Lock()
+	if h.peers[remote] == pi {
 		delete(h.peers, remote)
 	}
 	h.mu.Unlock()
 
-	if ok {
-		pi.conn.Close()
-		h.emitEvent(HandleEvent{Type: EventPeerDisconnected, Peer: remote})
-		if pi.complete != nil {
-			pi.complete <- reason
-			close(pi.complete)
-		}
+	pi.shutdown()
+	h.emitEvent(HandleEvent{Type: EventPeerDisconnected, Peer: remote})
+	if pi.complete != nil {
+		pi.complete <- reason
+		close(pi.complete)
 	}
 }
 
@@ -211,9 +339,11 @@ func (h *RepoHandle) SendMessage(remote RepoID, msg RepoMessage) error {
 	if !ok {
 		return fmt.Errorf("peer %s not found", remote)
 	}
-	if err := pi.conn.SendMessage(msg); err != nil {
-		h.emitEvent(HandleEvent{Type: EventConnError, Peer: remote, Err: err})
-		h.removePeer(remote, ConnFinished{Kind: ConnFinishedSendError, Err: err})
+	if err := h.send(remote, pi, msg); err != nil {
+		if pi.out == nil {
+			h.emitEvent(HandleEvent{Type: EventConnError, Peer: remote, Err: err})
+			h.dropConn(remote, pi, ConnFinished{Kind: ConnFinishedSendError, Err: err})
+		}
 		return err
 	}
 	return nil
@@ -223,18 +353,20 @@ func (h *RepoHandle) SendMessage(remote RepoID, msg RepoMessage) error {
 // failure encountered.
 func (h *RepoHandle) Broadcast(msg RepoMessage) error {
 	h.mu.Lock()
-	conns := make([]Conn, 0, len(h.peers))
+	peers := make([]*peerInfo, 0, len(h.peers))
 	ids := make([]RepoID, 0, len(h.peers))
-	for id := range h.peers {
+	for id, pi := range h.peers {
 		ids = append(ids, id)
-		conns = append(conns, h.peers[id].conn)
+		peers = append(peers, pi)
 	}
 	h.mu.Unlock()
-	for i, c := range conns {
-		if err := c.SendMessage(msg); err != nil {
-			remote := ids[i]
-			h.emitEvent(HandleEvent{Type: EventConnError, Peer: remote, Err: err})
-			h.removePeer(remote, ConnFinished{Kind: ConnFinishedSendError, Err: err})
+	for i, pi := range peers {
+		if err := h.send(ids[i], pi, msg); err != nil {
+			if pi.out == nil {
+				remote := ids[i]
+				h.emitEvent(HandleEvent{Type: EventConnError, Peer: remote, Err: err})
+				h.dropConn(remote, pi, ConnFinished{Kind: ConnFinishedSendError, Err: err})
+			}
 			return err
 		}
 	}
@@ -248,12 +380,15 @@ func (h *RepoHandle) Close() {
 	h.peers = make(map[RepoID]*peerInfo)
 	h.mu.Unlock()
 	for id, pi := range conns {
-		pi.conn.Close()
+		if !pi.removed.CompareAndSwap(false, true) {
+			continue
+		}
+		pi.shutdown()
 		if pi.complete != nil {
 			pi.complete <- ConnFinished{Kind: ConnFinishedLocalClose}
 			close(pi.complete)
 		}
-		h.emitEvent(HandleEvent{Type: EventPeerDisconnected, Peer: id})
+		h.tryEmitEvent(HandleEvent{Type: EventPeerDisconnected, Peer: id})
 	}
 	close(h.Inbox)
 	if h.Events != nil {
@@ -263,11 +398,20 @@ func (h *RepoHandle) Close() {
 
 // SyncDocument exchanges sync messages for the given document with the remote peer.
 func (h *RepoHandle) SyncDocument(remote RepoID, docID DocumentID) error {
+	// the document may have to be reloaded from the store, so it is looked
+	// up before taking h.mu
+	doc, docOK := h.Repo.getDoc(docID, pinSync)
+	if docOK {
+		defer doc.unpin(pinSync)
+	}
 	h.mu.Lock()
 	pi, ok := h.peers[remote]
-	doc, docOK := h.Repo.GetDoc(docID)
 	if ok && docOK {
-		if h.Repo.sharePolicy != nil && h.Repo.sharePolicy.ShouldSync(docID, remote) == DontShare {
+		if h.shareDecision(SharePolicy.ShouldSync, docID, remote, pi) == DontShare {
+			h.mu.Unlock()
+			return nil
+		}
+		if _, gone := pi.tombstoned[docID]; gone {
 			h.mu.Unlock()
 			return nil
 		}
@@ -283,7 +427,7 @@ func (h *RepoHandle) SyncDocument(remote RepoID, docID DocumentID) error {
 				break
 			}
 			msg := RepoMessage{Type: "sync", FromRepoID: h.Repo.ID, ToRepoID: remote, DocumentID: docID, Message: data}
-			if err := pi.conn.SendMessage(msg); err != nil {
+			if err := h.send(remote, pi, msg); err != nil {
 				return err
 			}
 		}
@@ -297,26 +441,53 @@ func (h *RepoHandle) SyncDocument(remote RepoID, docID DocumentID) error {
 }
 
 // handleSyncMessage applies a sync message from a peer and responds with any updates.
-func (h *RepoHandle) handleSyncMessage(remote RepoID, msg RepoMessage) {
+// Messages from a connection that has since been replaced are ignored.
+func (h *RepoHandle) handleSyncMessage(remote RepoID, pi *peerInfo, msg RepoMessage) {
 	h.mu.Lock()
-	pi, ok := h.peers[remote]
-	if !ok {
+	if h.peers[remote] != pi {
+		h.mu.Unlock()
+		return
+	}
+	if h.shareDecision(SharePolicy.ShouldSync, msg.DocumentID, remote, pi) == DontShare {
 		h.mu.Unlock()
 		return
 	}
-	if h.Repo.sharePolicy != nil && h.Repo.sharePolicy.ShouldSync(msg.DocumentID, remote) == DontShare {
+	if opts, deleted := h.Repo.deletion(msg.DocumentID); deleted {
 		h.mu.Unlock()
+		if opts.Tombstone {
+			// the peer missed the tombstone, or ignored it
+			_ = h.send(remote, pi, RepoMessage{Type: "tombstone", FromRepoID: h.Repo.ID, ToRepoID: remote, DocumentID: msg.DocumentID})
+		}
 		return
 	}
-	doc, docOK := h.Repo.GetDoc(msg.DocumentID)
+	delete(pi.tombstoned, msg.DocumentID)
+	h.mu.Unlock()
+
+	// loading, creating or evicting documents may touch the store, so it
+	// happens without holding h.mu
+	doc, docOK := h.Repo.getDoc(msg.DocumentID, pinSync)
 	if !docOK {
-		if h.Repo.sharePolicy != nil && h.Repo.sharePolicy.ShouldRequest(msg.DocumentID, remote) == DontShare {
-			h.mu.Unlock()
+		if h.shareDecision(SharePolicy.ShouldRequest, msg.DocumentID, remote, pi) == DontShare {
+			return
+		}
+		if err := h.Repo.checkSyncQuota(msg.DocumentID, nil, msg.Message); err != nil {
+			h.emitEvent(HandleEvent{Type: EventQuotaExceeded, Peer: remote, DocumentID: msg.DocumentID, Err: err})
 			return
 		}
 		// create empty document if not present
-		doc = &Document{ID: msg.DocumentID, Doc: automerge.New()}
-		h.Repo.docs[msg.DocumentID] = doc
+		doc = h.Repo.putDocIfAbsent(&Document{ID: msg.DocumentID, Doc: automerge.New()}, pinSync)
+	}
+	defer doc.unpin(pinSync)
+	if docOK {
+		if err := h.Repo.checkSyncQuota(msg.DocumentID, doc, msg.Message); err != nil {
+			h.emitEvent(HandleEvent{Type: EventQuotaExceeded, Peer: remote, DocumentID: msg.DocumentID, Err: err})
+			return
+		}
+	}
+	h.mu.Lock()
+	if h.peers[remote] != pi {
+		h.mu.Unlock()
+		return
 	}
 	state := pi.syncStates[msg.DocumentID]
 	if state == nil {
@@ -325,20 +496,62 @@ func (h *RepoHandle) handleSyncMessage(remote RepoID, msg RepoMessage) {
 	}
 	h.mu.Unlock()
 
-	_ = doc.ReceiveSyncMessage(state, msg.Message)
+	origin := ChangeOrigin{Kind: OriginPeer, Peer: remote}
+	if ok, err := h.Repo.validateSync(doc, msg.Message, origin); err != nil {
+		h.emitEvent(HandleEvent{Type: EventValidationFailed, Peer: remote, DocumentID: msg.DocumentID, Err: err})
+		if !ok {
+			// answer anyway, so that the peer learns which changes we took
+			// and gets ours, instead of waiting for a reply that never comes
+			_ = h.SyncDocument(remote, msg.DocumentID)
+			return
+		}
+	}
+	_ = doc.receiveSyncMessage(state, msg.Message, origin)
 	_ = h.SyncDocument(remote, msg.DocumentID)
 }
 
+// handleTombstone records that the peer deleted a document so that we stop
+// sending it sync messages for it.
+func (h *RepoHandle) handleTombstone(remote RepoID, pi *peerInfo, msg RepoMessage) {
+	h.mu.Lock()
+	ok := h.peers[remote] == pi
+	if ok {
+		delete(pi.syncStates, msg.DocumentID)
+		pi.tombstoned[msg.DocumentID] = struct{}{}
+	}
+	h.mu.Unlock()
+	if ok {
+		h.emitEvent(HandleEvent{Type: EventDocTombstone, Peer: remote, DocumentID: msg.DocumentID})
+	}
+}
+
+// docDeleted drops the sync state of a deleted document and, if requested,
+// tells every peer about the deletion.
+func (h *RepoHandle) docDeleted(id DocumentID, opts DeleteOptions) {
+	h.mu.Lock()
+	remotes := make([]RepoID, 0, len(h.peers))
+	for remote, pi := range h.peers {
+		delete(pi.syncStates, id)
+		remotes = append(remotes, remote)
+	}
+	h.mu.Unlock()
+	if !opts.Tombstone {
+		return
+	}
+	for _, remote := range remotes {
+		msg := RepoMessage{Type: "tombstone", FromRepoID: h.Repo.ID, ToRepoID: remote, DocumentID: id}
+		_ = h.SendMessage(remote, msg)
+	}
+}
+
 // SyncAll sends sync messages for all documents to the remote peer.
 func (h *RepoHandle) SyncAll(remote RepoID) error {
 	h.mu.Lock()
-	ids := make([]DocumentID, 0, len(h.Repo.docs))
-	for id := range h.Repo.docs {
-		ids = append(ids, id)
-	}
+	pi := h.peers[remote]
 	h.mu.Unlock()
+	ids := h.Repo.docIDs()
 	for _, id := range ids {
-		if h.Repo.sharePolicy != nil && h.Repo.sharePolicy.ShouldAnnounce(id, remote) == DontShare {
+		if h.shareDecision(SharePolicy.ShouldAnnounce, id, remote, pi) == DontShare {
 			continue
 		}
 		if err := h.SyncDocument(remote, id); err != nil {
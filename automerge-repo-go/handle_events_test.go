@@ -103,6 +103,9 @@ func TestRepoHandleReconnect(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	cc := h1.AddConnWithRetry(ctx, h2.Repo.ID, dial, 10*time.Millisecond)
 
+	if evt := <-h1.Events; evt.Type != EventConnAttempt || evt.Attempt != 1 {
+		t.Fatalf("expected first attempt event, got %#v", evt)
+	}
 	if evt := <-h1.Events; evt.Type != EventPeerConnected || evt.Peer != h2.Repo.ID {
 		t.Fatalf("expected peer connected event, got %#v", evt)
 	}
@@ -113,6 +116,9 @@ func TestRepoHandleReconnect(t *testing.T) {
 	if evt := <-h1.Events; evt.Type != EventPeerDisconnected {
 		t.Fatalf("expected peer disconnected, got %#v", evt)
 	}
+	if evt := <-h1.Events; evt.Type != EventConnAttempt {
+		t.Fatalf("expected reconnect attempt, got %#v", evt)
+	}
 
 	if evt := <-h1.Events; evt.Type != EventPeerConnected {
 		t.Fatalf("expected peer reconnected, got %#v", evt)
@@ -46,7 +46,13 @@ func newMockConn() (*mockConn, *mockConn) {
 	return c1, c2
 }
 
-func (c *mockConn) SendMessage(m RepoMessage) error {
+func (c *mockConn) SendMessage(m RepoMessage) (err error) {
+	// a sync round may still be answering when the other side closes
+	defer func() {
+		if recover() != nil {
+			err = io.ErrClosedPipe
+		}
+	}()
 	c.sendCh <- m
 	return nil
 }
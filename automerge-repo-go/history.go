@@ -0,0 +1,73 @@
+package repo
+
+import (
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+// ChangeInfo describes a single change in a document's history.
+type ChangeInfo struct {
+	Hash  automerge.ChangeHash
+	Actor string
+	Seq   uint64
+	// Timestamp has millisecond precision and is the zero time if the change
+	// was committed without one.
+	Timestamp time.Time
+	Message   string
+	Deps      []automerge.ChangeHash
+}
+
+func newChangeInfo(c *automerge.Change) ChangeInfo {
+	info := ChangeInfo{
+		Hash:    c.Hash(),
+		Actor:   c.ActorID(),
+		Seq:     c.ActorSeq(),
+		Message: c.Message(),
+		Deps:    c.Dependencies(),
+	}
+	if ts := c.Timestamp(); ts.UnixMilli() != 0 {
+		info.Timestamp = ts
+	}
+	return info
+}
+
+// CommitOptions customise the change committed by DocumentHandle.WithDocMut.
+type CommitOptions struct {
+	// Message is the commit message. It defaults to "update".
+	Message string
+	// Time is the change timestamp. It defaults to the current time.
+	Time time.Time
+}
+
+// Heads returns the hashes of the document's current heads.
+func (h *DocumentHandle) Heads() []automerge.ChangeHash {
+	h.doc.ensureDoc()
+	return h.doc.Doc.Heads()
+}
+
+// History returns every change in the document in causal order, oldest first.
+func (h *DocumentHandle) History() ([]ChangeInfo, error) {
+	h.doc.ensureDoc()
+	h.doc.mutMu.Lock()
+	changes, err := h.doc.Doc.Changes()
+	h.doc.mutMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]ChangeInfo, len(changes))
+	for i, c := range changes {
+		infos[i] = newChangeInfo(c)
+	}
+	return infos, nil
+}
+
+// Change returns the change with the given hash.
+func (h *DocumentHandle) Change(hash automerge.ChangeHash) (ChangeInfo, error) {
+	h.doc.ensureDoc()
+	c, err := h.doc.Doc.Change(hash)
+	if err != nil {
+		return ChangeInfo{}, err
+	}
+	return newChangeInfo(c), nil
+}
@@ -0,0 +1,58 @@
+package repo
+
+import (
+	"testing"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+func TestDocumentHandleHistory(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+
+	at := time.UnixMilli(1700000000000)
+	if err := h.WithDocMut(func(doc *automerge.Doc) error {
+		return doc.RootMap().Set("title", "draft")
+	}, CommitOptions{Message: "create title", Time: at}); err != nil {
+		t.Fatalf("WithDocMut failed: %v", err)
+	}
+	if err := h.WithDocMut(func(doc *automerge.Doc) error {
+		return doc.RootMap().Set("title", "final")
+	}); err != nil {
+		t.Fatalf("WithDocMut failed: %v", err)
+	}
+
+	history, err := h.History()
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expected 2 changes, got %d", len(history))
+	}
+	first, second := history[0], history[1]
+	if first.Message != "create title" || !first.Timestamp.Equal(at) || first.Seq != 1 {
+		t.Fatalf("unexpected first change %+v", first)
+	}
+	if second.Message != "update" || second.Seq != 2 || second.Actor != first.Actor {
+		t.Fatalf("unexpected second change %+v", second)
+	}
+	if len(second.Deps) != 1 || second.Deps[0] != first.Hash {
+		t.Fatalf("expected second change to depend on first, got %v", second.Deps)
+	}
+
+	heads := h.Heads()
+	if len(heads) != 1 || heads[0] != second.Hash {
+		t.Fatalf("unexpected heads %v", heads)
+	}
+	c, err := h.Change(first.Hash)
+	if err != nil {
+		t.Fatalf("Change failed: %v", err)
+	}
+	if c.Hash != first.Hash || c.Message != first.Message {
+		t.Fatalf("unexpected change %+v", c)
+	}
+	if _, err := h.Change(automerge.ChangeHash{}); err == nil {
+		t.Fatalf("expected error for unknown hash")
+	}
+}
@@ -0,0 +1,510 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+	"github.com/google/uuid"
+)
+
+// JSONOptions control how JSON values are mapped to automerge types.
+type JSONOptions struct {
+	// StringsAsText stores JSON strings as collaborative automerge.Text
+	// instead of plain strings.
+	StringsAsText bool
+}
+
+// ErrJSONPatchTest is returned when a JSON Patch "test" operation fails.
+var ErrJSONPatchTest = errors.New("json patch test failed")
+
+// NewDocFromJSON creates a document holding the JSON object data and returns
+// a handle to it. JSON numbers without a fraction or exponent are stored as
+// int64 (or uint64 if they only fit that), all others as float64.
+func (r *Repo) NewDocFromJSON(data []byte, opts ...JSONOptions) (*DocumentHandle, error) {
+	v, err := decodeJSON(data, jsonOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("json document must be an object")
+	}
+	doc := automerge.New()
+	for k, v := range obj {
+		if err := doc.RootMap().Set(k, v); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := doc.Commit("from json", automerge.CommitOptions{AllowEmpty: true}); err != nil {
+		return nil, err
+	}
+	d := &Document{ID: uuid.New(), Doc: doc}
+	d.pin(pinHandle)
+	r.putDoc(d)
+	return &DocumentHandle{doc: d, repo: r}, nil
+}
+
+// JSON returns the document encoded as canonical JSON: object keys are
+// sorted, there is no insignificant whitespace and float64 values always
+// carry a fraction or exponent so that they stay floats when imported again.
+func (h *DocumentHandle) JSON() ([]byte, error) {
+	h.doc.ensureDoc()
+	return h.doc.JSON()
+}
+
+// ApplyJSONPatch applies an RFC 6902 JSON Patch to the document as a single
+// change. Either every operation applies or the document is left untouched.
+// Adding or replacing the root, path "", replaces the whole document with an
+// object, since the root of an automerge document is always a map.
+// A failed "test" operation returns ErrJSONPatchTest, and a patch that would
+// violate the document's schema a *ValidationError.
+func (h *DocumentHandle) ApplyJSONPatch(patch []byte, opts ...JSONOptions) error {
+	if h.doc.deleted.Load() {
+		return ErrDocumentDeleted
+	}
+	o := jsonOptions(opts)
+	var ops []jsonPatchOp
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return fmt.Errorf("invalid json patch: %w", err)
+	}
+	values := make([]interface{}, len(ops))
+	for i, op := range ops {
+		if op.Path == nil {
+			return fmt.Errorf("json patch operation %d: missing path", i)
+		}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return fmt.Errorf("json patch operation %d: missing value", i)
+			}
+			vo := o
+			if op.Op == "test" {
+				// compared against plain values, never stored
+				vo = JSONOptions{}
+			}
+			var err error
+			if values[i], err = decodeJSON(op.Value, vo); err != nil {
+				return fmt.Errorf("json patch operation %d: %w", i, err)
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return fmt.Errorf("json patch operation %d: missing from", i)
+			}
+		}
+	}
+	// The patch is applied to a fork that is only merged back once every
+	// operation succeeded, as automerge cannot roll back uncommitted operations.
+	return h.doc.withLocalFork(h.origin(), func(fork *automerge.Doc) (bool, error) {
+		changed := false
+		for i, op := range ops {
+			if err := applyPatchOp(fork, op.Op, *op.Path, op.From, values[i]); err != nil {
+				return false, fmt.Errorf("json patch operation %d (%s %s): %w", i, op.Op, *op.Path, err)
+			}
+			changed = changed || op.Op != "test"
+		}
+		if !changed {
+			return false, nil
+		}
+		if h.repo != nil {
+			if err := h.repo.validate(h.doc.ID, fork); err != nil {
+				return false, err
+			}
+		}
+		if _, err := fork.Commit("json patch"); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// jsonPatchOp is a single RFC 6902 operation.
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+func jsonOptions(opts []JSONOptions) JSONOptions {
+	var o JSONOptions
+	for _, opt := range opts {
+		if opt.StringsAsText {
+			o.StringsAsText = true
+		}
+	}
+	return o
+}
+
+// decodeJSON parses data into values accepted by automerge's Set.
+func decodeJSON(data []byte, o JSONOptions) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after json value")
+	}
+	return fromJSON(v, o)
+}
+
+func fromJSON(v interface{}, o JSONOptions) (interface{}, error) {
+	switch v := v.(type) {
+	case json.Number:
+		s := v.String()
+		if !strings.ContainsAny(s, ".eE") {
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return i, nil
+			}
+			if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+				return u, nil
+			}
+		}
+		return strconv.ParseFloat(s, 64)
+	case string:
+		if o.StringsAsText {
+			return automerge.NewText(v), nil
+		}
+		return v, nil
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			ev, err := fromJSON(e, o)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = ev
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			ev, err := fromJSON(e, o)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = ev
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// encodeJSON writes v, as returned by automerge.Value.Interface, as canonical JSON.
+func encodeJSON(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case int64:
+		buf.WriteString(strconv.FormatInt(v, 10))
+	case uint64:
+		buf.WriteString(strconv.FormatUint(v, 10))
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return fmt.Errorf("cannot encode %v as json", v)
+		}
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		buf.WriteString(s)
+	case string, []byte, time.Time:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeJSON(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			kb, _ := json.Marshal(k)
+			buf.Write(kb)
+			buf.WriteByte(':')
+			if err := encodeJSON(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("cannot encode %T as json", v)
+	}
+	return nil
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its reference tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("invalid json pointer %q", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// lookupPointer resolves tokens from the document root.
+func lookupPointer(doc *automerge.Doc, tokens []string) (*automerge.Value, error) {
+	v := doc.Root()
+	for _, t := range tokens {
+		var err error
+		switch v.Kind() {
+		case automerge.KindMap:
+			v, err = v.Map().Get(t)
+		case automerge.KindList:
+			i, perr := listIndex(t, v.List().Len(), false)
+			if perr != nil {
+				return nil, perr
+			}
+			v, err = v.List().Get(i)
+		default:
+			return nil, ErrPathType
+		}
+		if err != nil {
+			return nil, err
+		}
+		if v.IsVoid() {
+			return nil, ErrPathNotFound
+		}
+	}
+	return v, nil
+}
+
+// listIndex parses a list index token. With insert set, "-" and the list
+// length are accepted as the position after the last element.
+func listIndex(t string, n int, insert bool) (int, error) {
+	if insert && t == "-" {
+		return n, nil
+	}
+	if t == "" || (len(t) > 1 && t[0] == '0') {
+		return 0, fmt.Errorf("invalid list index %q", t)
+	}
+	i, err := strconv.Atoi(t)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid list index %q", t)
+	}
+	if i > n || (!insert && i == n) {
+		return 0, ErrPathNotFound
+	}
+	return i, nil
+}
+
+func applyPatchOp(doc *automerge.Doc, op, path string, from *string, value interface{}) error {
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return err
+	}
+	switch op {
+	case "add":
+		return pointerAdd(doc, tokens, value)
+	case "remove":
+		return pointerRemove(doc, tokens)
+	case "replace":
+		if _, err := lookupPointer(doc, tokens); err != nil {
+			return err
+		}
+		if len(tokens) == 0 {
+			// the root cannot be removed, but adding it replaces its contents
+			return pointerAdd(doc, tokens, value)
+		}
+		if err := pointerRemove(doc, tokens); err != nil {
+			return err
+		}
+		return pointerAdd(doc, tokens, value)
+	case "move", "copy":
+		fromTokens, err := parsePointer(*from)
+		if err != nil {
+			return err
+		}
+		if op == "move" && len(fromTokens) < len(tokens) && reflect.DeepEqual(fromTokens, tokens[:len(fromTokens)]) {
+			return fmt.Errorf("cannot move a value into itself")
+		}
+		v, err := lookupPointer(doc, fromTokens)
+		if err != nil {
+			return err
+		}
+		value := copyValue(v)
+		if op == "move" {
+			if err := pointerRemove(doc, fromTokens); err != nil {
+				return err
+			}
+		}
+		return pointerAdd(doc, tokens, value)
+	case "test":
+		v, err := lookupPointer(doc, tokens)
+		if err != nil {
+			return err
+		}
+		if !jsonEqual(v.Interface(), value) {
+			return ErrJSONPatchTest
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown operation %q", op)
+	}
+}
+
+func pointerAdd(doc *automerge.Doc, tokens []string, value interface{}) error {
+	if len(tokens) == 0 {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("document root must be an object")
+		}
+		root := doc.RootMap()
+		keys, err := root.Keys()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := root.Delete(k); err != nil {
+				return err
+			}
+		}
+		for k, v := range obj {
+			if err := root.Set(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	parent, err := lookupPointer(doc, tokens[:len(tokens)-1])
+	if err != nil {
+		return err
+	}
+	last := tokens[len(tokens)-1]
+	switch parent.Kind() {
+	case automerge.KindMap:
+		return parent.Map().Set(last, value)
+	case automerge.KindList:
+		i, err := listIndex(last, parent.List().Len(), true)
+		if err != nil {
+			return err
+		}
+		return parent.List().Insert(i, value)
+	default:
+		return ErrPathType
+	}
+}
+
+func pointerRemove(doc *automerge.Doc, tokens []string) error {
+	if len(tokens) == 0 {
+		return fmt.Errorf("cannot remove the document root")
+	}
+	if _, err := lookupPointer(doc, tokens); err != nil {
+		return err
+	}
+	parent, _ := lookupPointer(doc, tokens[:len(tokens)-1])
+	last := tokens[len(tokens)-1]
+	if parent.Kind() == automerge.KindMap {
+		return parent.Map().Delete(last)
+	}
+	i, _ := listIndex(last, parent.List().Len(), false)
+	return parent.List().Delete(i)
+}
+
+// copyValue converts v into a value for Set that keeps text and counters.
+func copyValue(v *automerge.Value) interface{} {
+	switch v.Kind() {
+	case automerge.KindMap:
+		values, _ := v.Map().Values()
+		out := make(map[string]interface{}, len(values))
+		for k, e := range values {
+			out[k] = copyValue(e)
+		}
+		return out
+	case automerge.KindList:
+		values, _ := v.List().Values()
+		out := make([]interface{}, len(values))
+		for i, e := range values {
+			out[i] = copyValue(e)
+		}
+		return out
+	case automerge.KindText:
+		s, _ := v.Text().Get()
+		return automerge.NewText(s)
+	case automerge.KindCounter:
+		n, _ := v.Counter().Get()
+		return automerge.NewCounter(n)
+	}
+	return v.Interface()
+}
+
+// jsonEqual compares two decoded JSON values, treating numbers by value.
+func jsonEqual(a, b interface{}) bool {
+	if af, ok := toFloat(a); ok {
+		bf, ok := toFloat(b)
+		return ok && af == bf
+	}
+	switch a := a.(type) {
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, av := range a {
+			bv, ok := b[k]
+			if !ok || !jsonEqual(av, bv) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
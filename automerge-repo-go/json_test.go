@@ -0,0 +1,120 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDocumentHandleJSONRoundTrip(t *testing.T) {
+	r := New()
+	in := `{"title":"notes","count":3,"ratio":2.0,"big":18446744073709551615,"tags":["a","b"],"meta":{"ok":true,"none":null}}`
+	h, err := r.NewDocFromJSON([]byte(in))
+	if err != nil {
+		t.Fatalf("NewDocFromJSON failed: %v", err)
+	}
+	if v, _ := h.GetPath("count"); v != int64(3) {
+		t.Fatalf("expected int64 count, got %T %v", v, v)
+	}
+	if v, _ := h.GetPath("ratio"); v != 2.0 {
+		t.Fatalf("expected float64 ratio, got %T %v", v, v)
+	}
+	if v, _ := h.GetPath("big"); v != uint64(18446744073709551615) {
+		t.Fatalf("expected uint64 big, got %T %v", v, v)
+	}
+	out, err := h.JSON()
+	if err != nil {
+		t.Fatalf("JSON failed: %v", err)
+	}
+	want := `{"big":18446744073709551615,"count":3,"meta":{"none":null,"ok":true},"ratio":2.0,"tags":["a","b"],"title":"notes"}`
+	if string(out) != want {
+		t.Fatalf("unexpected JSON:\n got %s\nwant %s", out, want)
+	}
+
+	text, err := r.NewDocFromJSON([]byte(`{"body":"hello"}`), JSONOptions{StringsAsText: true})
+	if err != nil {
+		t.Fatalf("NewDocFromJSON failed: %v", err)
+	}
+	if err := text.Splice([]interface{}{"body"}, 5, 0, "!"); err != nil {
+		t.Fatalf("expected text body: %v", err)
+	}
+
+	if _, err := r.NewDocFromJSON([]byte(`[1,2]`)); err == nil {
+		t.Fatalf("expected error for non-object JSON")
+	}
+}
+
+func TestDocumentHandleApplyJSONPatch(t *testing.T) {
+	r := New()
+	h, err := r.NewDocFromJSON([]byte(`{"title":"notes","tags":["a","c"],"meta":{"owner":"ana"}}`))
+	if err != nil {
+		t.Fatalf("NewDocFromJSON failed: %v", err)
+	}
+	before := len(mustHistory(t, h))
+
+	patch := `[
+		{"op":"test","path":"/title","value":"notes"},
+		{"op":"add","path":"/tags/1","value":"b"},
+		{"op":"add","path":"/tags/-","value":"d"},
+		{"op":"replace","path":"/title","value":"todo"},
+		{"op":"copy","from":"/meta/owner","path":"/author"},
+		{"op":"move","from":"/meta","path":"/info"},
+		{"op":"remove","path":"/tags/0"},
+		{"op":"add","path":"/a~1b","value":1}
+	]`
+	if err := h.ApplyJSONPatch([]byte(patch)); err != nil {
+		t.Fatalf("ApplyJSONPatch failed: %v", err)
+	}
+	out, err := h.JSON()
+	if err != nil {
+		t.Fatalf("JSON failed: %v", err)
+	}
+	want := `{"a/b":1,"author":"ana","info":{"owner":"ana"},"tags":["b","c","d"],"title":"todo"}`
+	if string(out) != want {
+		t.Fatalf("unexpected JSON:\n got %s\nwant %s", out, want)
+	}
+	if after := len(mustHistory(t, h)); after != before+1 {
+		t.Fatalf("expected one change, got %d", after-before)
+	}
+
+	// a failing operation leaves the document untouched
+	bad := `[{"op":"replace","path":"/title","value":"x"},{"op":"test","path":"/author","value":"bob"}]`
+	if err := h.ApplyJSONPatch([]byte(bad)); !errors.Is(err, ErrJSONPatchTest) {
+		t.Fatalf("expected ErrJSONPatchTest, got %v", err)
+	}
+	bad = `[{"op":"remove","path":"/title"},{"op":"remove","path":"/missing"}]`
+	if err := h.ApplyJSONPatch([]byte(bad)); !errors.Is(err, ErrPathNotFound) {
+		t.Fatalf("expected ErrPathNotFound, got %v", err)
+	}
+	if out2, _ := h.JSON(); string(out2) != want {
+		t.Fatalf("document changed by failed patch: %s", out2)
+	}
+
+	if err := h.ApplyJSONPatch([]byte(`[{"op":"test","path":"/a~1b","value":1.0}]`)); err != nil {
+		t.Fatalf("numeric test failed: %v", err)
+	}
+
+	// replacing the root swaps the whole document
+	if err := h.ApplyJSONPatch([]byte(`[{"op":"replace","path":"","value":{"title":"new","n":2}}]`)); err != nil {
+		t.Fatalf("root replace failed: %v", err)
+	}
+	if out, _ := h.JSON(); string(out) != `{"n":2,"title":"new"}` {
+		t.Fatalf("unexpected JSON after root replace: %s", out)
+	}
+	if err := h.ApplyJSONPatch([]byte(`[{"op":"replace","path":"","value":[1]}]`)); err == nil {
+		t.Fatalf("expected an error replacing the root with a non-object")
+	}
+}
+
+func TestApplyJSONPatchConcurrentWithDocMut(t *testing.T) {
+	h := New().NewDocHandle()
+	fillDoc(t, h, 2000)
+	concurrentWrites(t, h, 20, func(i int) error {
+		return h.ApplyJSONPatch([]byte(fmt.Sprintf(`[{"op": "add", "path": "/patch%d", "value": %d}]`, i, i)))
+	})
+	for i := 0; i < 20; i++ {
+		if v, _ := h.GetPath(fmt.Sprintf("patch%d", i)); v != int64(i) {
+			t.Fatalf("patch %d lost: %v", i, v)
+		}
+	}
+}
@@ -8,10 +8,11 @@ import (
 	"github.com/google/uuid"
 )
 
-// RepoMessage represents a sync or ephemeral message exchanged between repositories.
-// Type should be either "sync" or "ephemeral".
+// RepoMessage represents a sync, ephemeral or tombstone message exchanged
+// between repositories. A "tombstone" message tells the peer that the sender
+// deleted the document and it should stop requesting it.
 type RepoMessage struct {
-	Type       string // "sync" or "ephemeral"
+	Type       string // "sync", "ephemeral" or "tombstone"
 	FromRepoID RepoID
 	ToRepoID   RepoID
 	DocumentID DocumentID
@@ -30,7 +31,7 @@ type repoMessageCBOR struct {
 
 // Encode converts the RepoMessage into CBOR bytes for transmission.
 func (m RepoMessage) Encode() ([]byte, error) {
-	if m.Type != "sync" && m.Type != "ephemeral" {
+	if !validMessageType(m.Type) {
 		return nil, fmt.Errorf("invalid RepoMessage type %q", m.Type)
 	}
 	wire := repoMessageCBOR{
@@ -49,7 +50,7 @@ func DecodeRepoMessage(data []byte) (RepoMessage, error) {
 	if err := cbor.Unmarshal(data, &wire); err != nil {
 		return RepoMessage{}, err
 	}
-	if wire.Type != "sync" && wire.Type != "ephemeral" {
+	if !validMessageType(wire.Type) {
 		return RepoMessage{}, fmt.Errorf("invalid RepoMessage type %q", wire.Type)
 	}
 	log.Printf("The user is sending UUID: %s", wire.DocumentID)
@@ -68,3 +69,6 @@ func DecodeRepoMessage(data []byte) (RepoMessage, error) {
 	}, nil
 }
 
+func validMessageType(t string) bool {
+	return t == "sync" || t == "ephemeral" || t == "tombstone"
+}
@@ -22,8 +22,9 @@ const (
 
 
 type handshakeMessage struct {
-	Type     string `cbor:"type"`
-	SenderID string `cbor:"senderId"`
+	Type         string       `cbor:"type"`
+	SenderID     string       `cbor:"senderId"`
+	PeerMetadata PeerMetadata `cbor:"peerMetadata,omitempty"`
 }
 
 // Handshake performs a simple join/peer handshake over the given connection.
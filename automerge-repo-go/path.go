@@ -0,0 +1,243 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+var (
+	// ErrPathNotFound is returned when a path does not lead to a value.
+	ErrPathNotFound = errors.New("path not found")
+	// ErrPathType is returned when a value on a path has the wrong type for
+	// the operation, for example indexing into a map with an int.
+	ErrPathType = errors.New("wrong type at path")
+)
+
+// PathError records the operation and path that failed.
+type PathError struct {
+	Op   string
+	Path []interface{}
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, formatPath(e.Path), e.Err)
+}
+
+func (e *PathError) Unwrap() error { return e.Err }
+
+func formatPath(path []interface{}) string {
+	var b strings.Builder
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			b.WriteString("/" + p)
+		default:
+			fmt.Fprintf(&b, "/%v", p)
+		}
+	}
+	if b.Len() == 0 {
+		return "/"
+	}
+	return b.String()
+}
+
+// GetPath returns the value at path, where path holds map keys as strings
+// and list indexes as ints. Maps, lists, text and counters are converted to
+// map[string]interface{}, []interface{}, string and int64.
+func (h *DocumentHandle) GetPath(path ...interface{}) (interface{}, error) {
+	h.doc.ensureDoc()
+	v, err := resolvePath(h.doc.Doc, "get", path, false)
+	if err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
+
+// GetPathAs returns the value at path converted to T with automerge.As.
+func GetPathAs[T any](h *DocumentHandle, path ...interface{}) (T, error) {
+	h.doc.ensureDoc()
+	var zero T
+	v, err := resolvePath(h.doc.Doc, "get", path, false)
+	if err != nil {
+		return zero, err
+	}
+	out, err := automerge.As[T](v)
+	if err != nil {
+		return zero, &PathError{Op: "get", Path: path, Err: err}
+	}
+	return out, nil
+}
+
+// SetPath sets the value at path and commits the change. Missing maps along
+// the path are created. The last element of path must be an existing list
+// index when it is an int; use Insert to grow a list. A failed set leaves the
+// document unchanged.
+func (h *DocumentHandle) SetPath(path []interface{}, value interface{}) error {
+	if len(path) == 0 {
+		return &PathError{Op: "set", Path: path, Err: ErrPathType}
+	}
+	// only create maps when the final key is a map key
+	_, create := path[len(path)-1].(string)
+	set := func(doc *automerge.Doc) error {
+		parent, err := resolvePath(doc, "set", path[:len(path)-1], create)
+		if err != nil {
+			return err
+		}
+		switch key := path[len(path)-1].(type) {
+		case string:
+			if parent.Kind() != automerge.KindMap {
+				return &PathError{Op: "set", Path: path, Err: ErrPathType}
+			}
+			err = parent.Map().Set(key, value)
+		case int:
+			if parent.Kind() != automerge.KindList {
+				return &PathError{Op: "set", Path: path, Err: ErrPathType}
+			}
+			if key < 0 || key >= parent.List().Len() {
+				return &PathError{Op: "set", Path: path, Err: ErrPathNotFound}
+			}
+			err = parent.List().Set(key, value)
+		default:
+			return &PathError{Op: "set", Path: path, Err: ErrPathType}
+		}
+		if err != nil {
+			return &PathError{Op: "set", Path: path, Err: err}
+		}
+		return nil
+	}
+	h.doc.ensureDoc()
+	if _, err := resolvePath(h.doc.Doc, "set", path[:len(path)-1], false); err != nil {
+		if !create || !errors.Is(err, ErrPathNotFound) {
+			return err
+		}
+		// maps have to be created before the rest of the path can be
+		// checked, so do it on a fork that is discarded on failure
+		return h.withDocMutAtomic(set)
+	}
+	return h.WithDocMut(set)
+}
+
+// Insert inserts values into the list at path before index and commits the
+// change. An index equal to the list length appends.
+func (h *DocumentHandle) Insert(path []interface{}, index int, values ...interface{}) error {
+	return h.WithDocMut(func(doc *automerge.Doc) error {
+		v, err := resolvePath(doc, "insert", path, false)
+		if err != nil {
+			return err
+		}
+		if v.Kind() != automerge.KindList {
+			return &PathError{Op: "insert", Path: path, Err: ErrPathType}
+		}
+		if index < 0 || index > v.List().Len() {
+			return &PathError{Op: "insert", Path: child(path, index), Err: ErrPathNotFound}
+		}
+		if err := v.List().Insert(index, values...); err != nil {
+			return &PathError{Op: "insert", Path: path, Err: err}
+		}
+		return nil
+	})
+}
+
+// Delete removes the map key or list element at path and commits the change.
+func (h *DocumentHandle) Delete(path ...interface{}) error {
+	if len(path) == 0 {
+		return &PathError{Op: "delete", Path: path, Err: ErrPathType}
+	}
+	return h.WithDocMut(func(doc *automerge.Doc) error {
+		if _, err := resolvePath(doc, "delete", path, false); err != nil {
+			return err
+		}
+		parent, _ := resolvePath(doc, "delete", path[:len(path)-1], false)
+		var err error
+		switch key := path[len(path)-1].(type) {
+		case string:
+			err = parent.Map().Delete(key)
+		case int:
+			err = parent.List().Delete(key)
+		}
+		if err != nil {
+			return &PathError{Op: "delete", Path: path, Err: err}
+		}
+		return nil
+	})
+}
+
+// Increment adds delta to the counter at path and commits the change.
+func (h *DocumentHandle) Increment(path []interface{}, delta int64) error {
+	return h.WithDocMut(func(doc *automerge.Doc) error {
+		v, err := resolvePath(doc, "increment", path, false)
+		if err != nil {
+			return err
+		}
+		if v.Kind() != automerge.KindCounter {
+			return &PathError{Op: "increment", Path: path, Err: ErrPathType}
+		}
+		if err := v.Counter().Inc(delta); err != nil {
+			return &PathError{Op: "increment", Path: path, Err: err}
+		}
+		return nil
+	})
+}
+
+// Splice deletes del characters from the text at path starting at pos,
+// inserts s in their place and commits the change. Positions count unicode
+// code points.
+func (h *DocumentHandle) Splice(path []interface{}, pos, del int, s string) error {
+	return h.WithDocMut(func(doc *automerge.Doc) error {
+		v, err := resolvePath(doc, "splice", path, false)
+		if err != nil {
+			return err
+		}
+		if v.Kind() != automerge.KindText {
+			return &PathError{Op: "splice", Path: path, Err: ErrPathType}
+		}
+		if pos < 0 || del < 0 || pos+del > v.Text().Len() {
+			return &PathError{Op: "splice", Path: child(path, pos), Err: ErrPathNotFound}
+		}
+		if err := v.Text().Splice(pos, del, s); err != nil {
+			return &PathError{Op: "splice", Path: path, Err: err}
+		}
+		return nil
+	})
+}
+
+// resolvePath walks path from the document root. With create set, missing
+// map keys are filled with empty maps.
+func resolvePath(doc *automerge.Doc, op string, path []interface{}, create bool) (*automerge.Value, error) {
+	v := doc.Root()
+	for i, p := range path {
+		var next *automerge.Value
+		var err error
+		switch key := p.(type) {
+		case string:
+			if v.Kind() != automerge.KindMap {
+				return nil, &PathError{Op: op, Path: path[:i+1], Err: ErrPathType}
+			}
+			next, err = v.Map().Get(key)
+			if err == nil && next.IsVoid() && create {
+				if err = v.Map().Set(key, automerge.NewMap()); err == nil {
+					next, err = v.Map().Get(key)
+				}
+			}
+		case int:
+			if v.Kind() != automerge.KindList {
+				return nil, &PathError{Op: op, Path: path[:i+1], Err: ErrPathType}
+			}
+			next, err = v.List().Get(key)
+		default:
+			return nil, &PathError{Op: op, Path: path[:i+1], Err: ErrPathType}
+		}
+		if err != nil {
+			return nil, &PathError{Op: op, Path: path[:i+1], Err: err}
+		}
+		if next.IsVoid() {
+			return nil, &PathError{Op: op, Path: path[:i+1], Err: ErrPathNotFound}
+		}
+		v = next
+	}
+	return v, nil
+}
@@ -0,0 +1,123 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+func TestDocumentHandlePaths(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+
+	if err := h.SetPath([]interface{}{"todos"}, []interface{}{}); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+	if err := h.Insert([]interface{}{"todos"}, 0, map[string]interface{}{"title": "write"}, map[string]interface{}{"title": "test"}); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := h.SetPath([]interface{}{"todos", 1, "title"}, "review"); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+	title, err := GetPathAs[string](h, "todos", 1, "title")
+	if err != nil || title != "review" {
+		t.Fatalf("unexpected title %q, %v", title, err)
+	}
+
+	// intermediate maps are created
+	if err := h.SetPath([]interface{}{"meta", "owner", "name"}, "ana"); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+	if v, err := h.GetPath("meta", "owner", "name"); err != nil || v != "ana" {
+		t.Fatalf("unexpected nested value %v, %v", v, err)
+	}
+
+	if err := h.SetPath([]interface{}{"views"}, automerge.NewCounter(1)); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+	if err := h.Increment([]interface{}{"views"}, 4); err != nil {
+		t.Fatalf("Increment failed: %v", err)
+	}
+	if n, err := GetPathAs[int64](h, "views"); err != nil || n != 5 {
+		t.Fatalf("unexpected counter %d, %v", n, err)
+	}
+
+	if err := h.SetPath([]interface{}{"body"}, automerge.NewText("hello world")); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+	if err := h.Splice([]interface{}{"body"}, 6, 5, "there"); err != nil {
+		t.Fatalf("Splice failed: %v", err)
+	}
+	if s, err := GetPathAs[string](h, "body"); err != nil || s != "hello there" {
+		t.Fatalf("unexpected text %q, %v", s, err)
+	}
+
+	if err := h.Delete("todos", 0); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	todos, err := h.GetPath("todos")
+	if err != nil {
+		t.Fatalf("GetPath failed: %v", err)
+	}
+	if l := todos.([]interface{}); len(l) != 1 || l[0].(map[string]interface{})["title"] != "review" {
+		t.Fatalf("unexpected todos %v", todos)
+	}
+
+	_, err = h.GetPath("todos", 5, "title")
+	var pe *PathError
+	if !errors.Is(err, ErrPathNotFound) || !errors.As(err, &pe) || len(pe.Path) != 2 {
+		t.Fatalf("expected not found at todos/5, got %v", err)
+	}
+	if err.Error() != "get /todos/5: path not found" {
+		t.Fatalf("unexpected error text %q", err.Error())
+	}
+	if _, err := h.GetPath("todos", "title"); !errors.Is(err, ErrPathType) {
+		t.Fatalf("expected ErrPathType, got %v", err)
+	}
+	if err := h.Increment([]interface{}{"body"}, 1); !errors.Is(err, ErrPathType) {
+		t.Fatalf("expected ErrPathType, got %v", err)
+	}
+	if err := h.Delete("missing"); !errors.Is(err, ErrPathNotFound) {
+		t.Fatalf("expected ErrPathNotFound, got %v", err)
+	}
+	if err := h.SetPath([]interface{}{"todos", 3}, "x"); !errors.Is(err, ErrPathNotFound) {
+		t.Fatalf("expected ErrPathNotFound, got %v", err)
+	}
+}
+
+func TestSetPathFailureLeavesNoMaps(t *testing.T) {
+	h := New().NewDocHandle()
+	if err := h.SetPath([]interface{}{"a", 0, "x"}, "v"); !errors.Is(err, ErrPathType) {
+		t.Fatalf("expected ErrPathType, got %v", err)
+	}
+	if err := h.SetPath([]interface{}{"b", "c"}, make(chan int)); err == nil {
+		t.Fatalf("expected unsupported value to fail")
+	}
+	// a later commit must not pick up maps created by the failed sets
+	if err := h.SetPath([]interface{}{"k"}, "v"); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+	if _, err := h.GetPath("a"); !errors.Is(err, ErrPathNotFound) {
+		t.Fatalf("failed set left a map at /a: %v", err)
+	}
+	if _, err := h.GetPath("b"); !errors.Is(err, ErrPathNotFound) {
+		t.Fatalf("failed set left a map at /b: %v", err)
+	}
+}
+
+func TestSetPathCreateConcurrentWithDocMut(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+	r.WithSchema(h.DocID(), MustCompileSchema(`{"type": "object"}`))
+	fillDoc(t, h, 2000)
+	concurrentWrites(t, h, 20, func(i int) error {
+		return h.SetPath([]interface{}{fmt.Sprintf("m%d", i), "x"}, int64(i))
+	})
+	for i := 0; i < 20; i++ {
+		if v, err := h.GetPath(fmt.Sprintf("m%d", i), "x"); err != nil || v != int64(i) {
+			t.Fatalf("SetPath %d lost: %v %v", i, v, err)
+		}
+	}
+}
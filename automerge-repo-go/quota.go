@@ -0,0 +1,136 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+// ErrQuotaExceeded is matched by every QuotaError.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits how much data peers may sync into a repo. Zero values mean
+// no limit. Document sizes are approximated by the encoded size of their
+// changes.
+type Quota struct {
+	// MaxDocs is the maximum number of documents, including evicted ones.
+	MaxDocs int
+	// MaxDocBytes is the maximum size of a single document.
+	MaxDocBytes int64
+	// MaxTotalBytes is the maximum size of all documents together.
+	MaxTotalBytes int64
+}
+
+// QuotaLimit names the limit a QuotaError refers to.
+type QuotaLimit string
+
+const (
+	// QuotaDocs is the limit on the number of documents.
+	QuotaDocs QuotaLimit = "docs"
+	// QuotaDocBytes is the limit on the size of a single document.
+	QuotaDocBytes QuotaLimit = "doc_bytes"
+	// QuotaTotalBytes is the limit on the size of all documents.
+	QuotaTotalBytes QuotaLimit = "total_bytes"
+)
+
+// QuotaError reports a sync rejected because it would exceed a Quota.
+type QuotaError struct {
+	Limit      QuotaLimit
+	DocumentID DocumentID
+	// Size is the value the sync would have reached and Max the configured limit.
+	Size int64
+	Max  int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded for document %s: %s would reach %d, limit %d", e.DocumentID, e.Limit, e.Size, e.Max)
+}
+
+// Is reports whether target is ErrQuotaExceeded.
+func (e *QuotaError) Is(target error) bool { return target == ErrQuotaExceeded }
+
+// WithQuota limits the documents peers can sync into the repo. Sync messages
+// that would exceed the quota are dropped and reported through an
+// EventQuotaExceeded event on the RepoHandle.
+func (r *Repo) WithQuota(q Quota) *Repo {
+	r.quota = q
+	return r
+}
+
+// sizeBytes returns the approximate encoded size of the document.
+func (d *Document) sizeBytes() int64 {
+	// The size is measured by saving the document, which must not happen
+	// during a change. sizeBytes is called with the repo lock held, so rather
+	// than wait for the change it tries again next time.
+	if !d.sizeKnown.Load() && d.mutMu.TryLock() {
+		var n int64
+		if d.Doc != nil {
+			n = int64(len(d.Doc.Save()))
+		}
+		d.mutMu.Unlock()
+		d.size.Store(n)
+		d.sizeKnown.Store(true)
+	}
+	return d.size.Load()
+}
+
+// checkSyncQuota returns a QuotaError if applying the sync message msg to the
+// document id would exceed the repo's quota. doc is nil if the document does
+// not exist yet.
+func (r *Repo) checkSyncQuota(id DocumentID, doc *Document, msg []byte) error {
+	q := r.quota
+	if q == (Quota{}) {
+		return nil
+	}
+	if doc == nil && q.MaxDocs > 0 {
+		r.mu.RLock()
+		n := len(r.docs) + len(r.evicted)
+		r.mu.RUnlock()
+		if n >= q.MaxDocs {
+			return &QuotaError{Limit: QuotaDocs, DocumentID: id, Size: int64(n + 1), Max: int64(q.MaxDocs)}
+		}
+	}
+	if q.MaxDocBytes <= 0 && q.MaxTotalBytes <= 0 {
+		return nil
+	}
+	sm, err := automerge.LoadSyncMessage(msg)
+	if err != nil {
+		return nil
+	}
+	var incoming int64
+	for _, c := range sm.Changes() {
+		incoming += int64(len(c.Save()))
+	}
+	if incoming == 0 {
+		return nil
+	}
+	var current int64
+	if doc != nil {
+		current = doc.sizeBytes()
+	}
+	if q.MaxDocBytes > 0 && current+incoming > q.MaxDocBytes {
+		return &QuotaError{Limit: QuotaDocBytes, DocumentID: id, Size: current + incoming, Max: q.MaxDocBytes}
+	}
+	if q.MaxTotalBytes > 0 {
+		total := r.totalBytes()
+		if total+incoming > q.MaxTotalBytes {
+			return &QuotaError{Limit: QuotaTotalBytes, DocumentID: id, Size: total + incoming, Max: q.MaxTotalBytes}
+		}
+	}
+	return nil
+}
+
+// totalBytes returns the approximate size of every document in the repo.
+func (r *Repo) totalBytes() int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var total int64
+	for _, d := range r.docs {
+		total += d.sizeBytes()
+	}
+	for _, n := range r.evicted {
+		total += n
+	}
+	return total
+}
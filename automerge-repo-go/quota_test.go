@@ -0,0 +1,89 @@
+package repo
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func connectedHandles(t *testing.T, r1, r2 *Repo) (*RepoHandle, *RepoHandle) {
+	t.Helper()
+	h1 := NewRepoHandle(r1)
+	h2 := NewRepoHandle(r2)
+	c1, c2 := newMockConn()
+	_ = h1.AddConn(h2.Repo.ID, c1)
+	_ = h2.AddConn(h1.Repo.ID, c2)
+	<-h1.Events
+	<-h2.Events
+	return h1, h2
+}
+
+func waitQuotaEvent(t *testing.T, h *RepoHandle) HandleEvent {
+	t.Helper()
+	for {
+		select {
+		case evt := <-h.Events:
+			if evt.Type == EventQuotaExceeded {
+				return evt
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for quota event")
+		}
+	}
+}
+
+func TestRepoQuotaMaxDocs(t *testing.T) {
+	h1, h2 := connectedHandles(t, New(), New().WithQuota(Quota{MaxDocs: 1}))
+	defer h1.Close()
+	defer h2.Close()
+
+	first := h1.Repo.NewDoc()
+	if err := h1.SyncDocument(h2.Repo.ID, first.ID); err != nil {
+		t.Fatalf("sync err: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := h2.Repo.GetDoc(first.ID); !ok {
+		t.Fatalf("first document not synced")
+	}
+
+	second := h1.Repo.NewDoc()
+	if err := h1.SyncDocument(h2.Repo.ID, second.ID); err != nil {
+		t.Fatalf("sync err: %v", err)
+	}
+	evt := waitQuotaEvent(t, h2)
+	var qe *QuotaError
+	if !errors.As(evt.Err, &qe) || qe.Limit != QuotaDocs || evt.DocumentID != second.ID || evt.Peer != h1.Repo.ID {
+		t.Fatalf("unexpected event %#v", evt)
+	}
+	if !errors.Is(evt.Err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", evt.Err)
+	}
+	if _, ok := h2.Repo.GetDoc(second.ID); ok {
+		t.Fatalf("document created despite quota")
+	}
+}
+
+func TestRepoQuotaMaxDocBytes(t *testing.T) {
+	h1, h2 := connectedHandles(t, New(), New().WithQuota(Quota{MaxDocBytes: 1024}))
+	defer h1.Close()
+	defer h2.Close()
+
+	doc := h1.Repo.NewDoc()
+	if err := doc.Set("big", strings.Repeat("x", 4096)); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := h1.SyncDocument(h2.Repo.ID, doc.ID); err != nil {
+		t.Fatalf("sync err: %v", err)
+	}
+	evt := waitQuotaEvent(t, h2)
+	var qe *QuotaError
+	if !errors.As(evt.Err, &qe) || qe.Limit != QuotaDocBytes || qe.Max != 1024 {
+		t.Fatalf("unexpected event %#v", evt)
+	}
+	if d, ok := h2.Repo.GetDoc(doc.ID); ok {
+		if v, _ := d.Get("big"); v != nil {
+			t.Fatalf("oversized change applied")
+		}
+	}
+}
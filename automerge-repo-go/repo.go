@@ -2,7 +2,10 @@ package repo
 
 import (
 	"fmt"
+	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	automerge "github.com/automerge/automerge-go"
 	"github.com/google/uuid"
@@ -19,11 +22,41 @@ type Document struct {
 	ID  DocumentID
 	Doc *automerge.Doc
 
-	lastHeads           []automerge.ChangeHash
-	changesSinceCompact int
+	lastHeads []automerge.ChangeHash
+	deleted   atomic.Bool
 
-	watchers   []chan struct{}
-	watchersMu sync.Mutex
+	// handles, syncing and lastUsed let the repo pick idle documents to evict.
+	handles  atomic.Int32
+	syncing  atomic.Int32
+	exposed  atomic.Bool
+	lastUsed atomic.Int64
+
+	// size approximates the encoded size of the document once sizeKnown is set.
+	size      atomic.Int64
+	sizeKnown atomic.Bool
+
+	stats   CompactionStats
+	statsMu sync.Mutex
+	saveMu  sync.Mutex
+	// mutMu is held while Doc is modified or written out. Automerge commits
+	// pending operations whenever a document is saved, merged or synced,
+	// which would otherwise split a WithDocMut change in two.
+	mutMu sync.Mutex
+
+	watchers      []chan struct{}
+	patchWatchers []patchWatcher
+	subscriptions map[*subscription]struct{}
+
+	// diffs caches recent results of Diff, and diffDoc is the version at
+	// diffHeads the last diff led to.
+	diffMu    sync.Mutex
+	diffs     []cachedDiff
+	diffDoc   *automerge.Doc
+	diffHeads []automerge.ChangeHash
+	// localObservers are called synchronously after each local change made
+	// through the handle they are registered for.
+	localObservers map[*DocumentHandle]map[*UndoManager]func(before, after []automerge.ChangeHash)
+	watchersMu     sync.Mutex
 }
 
 // NewSyncState returns a sync state for exchanging changes of this document with a peer.
@@ -36,36 +69,85 @@ func (d *Document) NewSyncState() *automerge.SyncState {
 
 // ReceiveSyncMessage applies a sync message to the document using the given state.
 func (d *Document) ReceiveSyncMessage(state *automerge.SyncState, msg []byte) error {
+	return d.receiveSyncMessage(state, msg, ChangeOrigin{Kind: OriginPeer})
+}
+
+func (d *Document) receiveSyncMessage(state *automerge.SyncState, msg []byte, origin ChangeOrigin) error {
+	d.mutMu.Lock()
 	state.Doc = d.Doc
+	before := d.Doc.Heads()
 	_, err := state.ReceiveMessage(msg)
-	if err == nil {
-		d.notifyWatchers()
+	after := d.Doc.Heads()
+	d.mutMu.Unlock()
+	if err == nil && !sameHeads(before, after) {
+		d.changed(before, after, origin)
 	}
 	return err
 }
 
 // GenerateSyncMessage produces the next sync message for the peer using the given state.
 func (d *Document) GenerateSyncMessage(state *automerge.SyncState) ([]byte, bool) {
+	d.mutMu.Lock()
 	state.Doc = d.Doc
 	sm, valid := state.GenerateMessage()
+	d.mutMu.Unlock()
 	if !valid {
 		return nil, false
 	}
 	return sm.Bytes(), true
 }
 
+// merge applies the changes from other that the document does not have yet and
+// notifies watchers if anything changed. It reports whether the document changed.
+func (d *Document) merge(other *automerge.Doc, origin ChangeOrigin) (bool, error) {
+	d.ensureDoc()
+	d.mutMu.Lock()
+	before := d.Doc.Heads()
+	_, err := d.Doc.Merge(other)
+	after := d.Doc.Heads()
+	d.mutMu.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if sameHeads(before, after) {
+		return false, nil
+	}
+	d.changed(before, after, origin)
+	return true, nil
+}
+
+// sameHeads reports whether a and b contain the same change hashes.
+func sameHeads(a, b []automerge.ChangeHash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[automerge.ChangeHash]struct{}, len(a))
+	for _, h := range a {
+		seen[h] = struct{}{}
+	}
+	for _, h := range b {
+		if _, ok := seen[h]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
 // Set assigns a value in the document.
 func (d *Document) Set(key string, value interface{}) error {
 	if d.Doc == nil {
 		d.Doc = automerge.New()
 	}
-	if err := d.Doc.RootMap().Set(key, value); err != nil {
-		return err
+	d.mutMu.Lock()
+	before := d.Doc.Heads()
+	err := d.Doc.RootMap().Set(key, value)
+	if err == nil {
+		_, err = d.Doc.Commit("set")
 	}
-	_, err := d.Doc.Commit("set")
+	after := d.Doc.Heads()
+	d.mutMu.Unlock()
 	if err == nil {
-		d.changesSinceCompact++
-		d.notifyWatchers()
+		d.changed(before, after, ChangeOrigin{Kind: OriginLocal})
 	}
 	return err
 }
@@ -111,6 +193,23 @@ type Repo struct {
 	docs        map[DocumentID]*Document
 	store       StorageAdapter
 	sharePolicy SharePolicy
+	compaction  CompactionPolicy
+	quota       Quota
+
+	schemas       map[DocumentID]*Schema
+	typeSchemas   map[string]*Schema
+	strictSchemas bool
+	quarantine    map[DocumentID][]*automerge.Change
+
+	mu          sync.RWMutex
+	deleted     map[DocumentID]DeleteOptions
+	deleteHooks []func(DocumentID, DeleteOptions)
+
+	maxResident      int
+	maxResidentBytes int64
+	evicted          map[DocumentID]int64 // size of each evicted document
+	evictions        uint64
+	reloads          uint64
 }
 
 // New returns a new empty repository with a random identifier.
@@ -118,28 +217,109 @@ func New() *Repo {
 	return &Repo{
 		ID:          uuid.New(),
 		docs:        make(map[DocumentID]*Document),
+		deleted:     make(map[DocumentID]DeleteOptions),
+		evicted:     make(map[DocumentID]int64),
+		schemas:     make(map[DocumentID]*Schema),
+		typeSchemas: make(map[string]*Schema),
+		quarantine:  make(map[DocumentID][]*automerge.Change),
 		sharePolicy: PermissiveSharePolicy{},
+		compaction:  CompactAfterChanges(10),
 	}
 }
 
-// NewWithStore creates a repository that will persist documents using the provided store.
+// NewWithStore creates a repository that will persist documents using the
+// provided store. Deletions recorded by a TombstoneStorage are restored.
 func NewWithStore(store StorageAdapter) *Repo {
 	r := New()
 	r.store = store
+	if ts, ok := store.(TombstoneStorage); ok {
+		tombstones, err := ts.Tombstones()
+		if err != nil {
+			log.Printf("loading tombstones: %v", err)
+		}
+		for id, opts := range tombstones {
+			r.deleted[id] = opts
+		}
+	}
 	return r
 }
 
-// NewDoc creates a new document within the repository and returns it.
+// NewDoc creates a new document within the repository and returns it. The
+// document is never evicted from memory; use NewDocHandle for documents
+// that may be.
 func (r *Repo) NewDoc() *Document {
 	doc := &Document{ID: uuid.New(), Doc: automerge.New()}
-	r.docs[doc.ID] = doc
+	doc.pin(pinExposed)
+	r.putDoc(doc)
 	return doc
 }
 
-// GetDoc retrieves a document by id.
+// GetDoc retrieves a document by id. Documents that were evicted from memory
+// are transparently reloaded from the store. The returned document is never
+// evicted again, since writes to an evicted copy would be lost; use
+// GetDocHandle and close the handle to let it go.
 func (r *Repo) GetDoc(id DocumentID) (*Document, bool) {
+	return r.getDoc(id, pinExposed)
+}
+
+// getDoc looks up a document, reloading it if it was evicted, and pins it
+// with p while the repo lock is held so that it cannot be evicted before the
+// caller unpins it.
+func (r *Repo) getDoc(id DocumentID, p pin) (*Document, bool) {
+	r.mu.RLock()
 	d, ok := r.docs[id]
-	return d, ok
+	if ok {
+		d.pin(p)
+	}
+	_, evicted := r.evicted[id]
+	r.mu.RUnlock()
+	if ok {
+		return d, true
+	}
+	if !evicted {
+		return nil, false
+	}
+	return r.reload(id, p)
+}
+
+// putDoc adds doc to the repo, evicting idle documents if this takes the repo
+// over its memory limit.
+func (r *Repo) putDoc(doc *Document) {
+	doc.touch()
+	r.mu.Lock()
+	r.docs[doc.ID] = doc
+	delete(r.evicted, doc.ID)
+	r.mu.Unlock()
+	r.evictIfNeeded(doc.ID)
+}
+
+// putDocIfAbsent adds doc to the repo pinned with p, unless a document with
+// the same ID was added concurrently, in which case that one is pinned and
+// returned instead.
+func (r *Repo) putDocIfAbsent(doc *Document, p pin) *Document {
+	r.mu.Lock()
+	if existing, ok := r.docs[doc.ID]; ok {
+		existing.pin(p)
+		r.mu.Unlock()
+		return existing
+	}
+	doc.pin(p)
+	r.docs[doc.ID] = doc
+	delete(r.evicted, doc.ID)
+	r.mu.Unlock()
+	r.evictIfNeeded(doc.ID)
+	return doc
+}
+
+// docIDs returns the IDs of all documents currently held in memory.
+func (r *Repo) docIDs() []DocumentID {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]DocumentID, 0, len(r.docs))
+	for id := range r.docs {
+		ids = append(ids, id)
+	}
+	return ids
 }
 
 // CompactDoc writes a full snapshot of the document to disk.
@@ -147,27 +327,72 @@ func (r *Repo) CompactDoc(id DocumentID) error {
 	if r.store == nil {
 		return fmt.Errorf("no store configured")
 	}
-	doc, ok := r.docs[id]
+	doc, err := r.docForSave(id)
+	if err != nil {
+		return err
+	}
+	defer doc.unpin(pinSync)
+	doc.saveMu.Lock()
+	defer doc.saveMu.Unlock()
+	return r.compact(doc)
+}
+
+// docForSave looks up a document that is about to be written to storage and
+// pins it with pinSync. The caller must unpin it.
+func (r *Repo) docForSave(id DocumentID) (*Document, error) {
+	doc, ok := r.getDoc(id, pinSync)
 	if !ok {
-		return fmt.Errorf("document %s not found", id)
+		if r.isDeleted(id) {
+			return nil, ErrDocumentDeleted
+		}
+		return nil, fmt.Errorf("document %s not found", id)
+	}
+	return doc, nil
+}
+
+// compact writes a snapshot of doc. Callers must hold doc.saveMu.
+func (r *Repo) compact(doc *Document) error {
+	if doc.deleted.Load() {
+		return ErrDocumentDeleted
+	}
+	doc.mutMu.Lock()
+	err := r.store.Compact(doc)
+	doc.mutMu.Unlock()
+	if err != nil {
+		return err
 	}
-	doc.changesSinceCompact = 0
-	return r.store.Compact(doc)
+	doc.statsMu.Lock()
+	doc.stats = CompactionStats{LastCompact: time.Now()}
+	doc.statsMu.Unlock()
+	return nil
 }
 
 // SaveDoc writes a document to disk using the repo's store.
-// It will append changes incrementally and compact the document every 10 changes.
+// It will append changes incrementally and compact the document whenever the
+// repo's CompactionPolicy asks for it.
 func (r *Repo) SaveDoc(id DocumentID) error {
 	if r.store == nil {
 		return fmt.Errorf("no store configured")
 	}
-	doc, ok := r.docs[id]
-	if !ok {
-		return fmt.Errorf("document %s not found", id)
+	doc, err := r.docForSave(id)
+	if err != nil {
+		return err
+	}
+	defer doc.unpin(pinSync)
+	return r.saveDoc(doc)
+}
+
+func (r *Repo) saveDoc(doc *Document) error {
+	doc.saveMu.Lock()
+	defer doc.saveMu.Unlock()
+	if doc.deleted.Load() {
+		return ErrDocumentDeleted
 	}
-	if doc.changesSinceCompact >= 10 {
-		return r.CompactDoc(id)
+	if r.compaction != nil && r.compaction.ShouldCompact(doc.CompactionStats()) {
+		return r.compact(doc)
 	}
+	doc.mutMu.Lock()
+	defer doc.mutMu.Unlock()
 	return r.store.Save(doc)
 }
 
@@ -180,7 +405,7 @@ func (r *Repo) LoadDoc(id DocumentID) (*Document, error) {
 	if err != nil {
 		return nil, err
 	}
-	r.docs[id] = doc
+	r.putDoc(doc)
 	return doc, nil
 }
 
@@ -193,5 +418,8 @@ func (r *Repo) WithSharePolicy(sp SharePolicy) *Repo {
 
 // ClearDocs removes all documents from the repo. This is useful for testing.
 func (r *Repo) ClearDocs() {
+	r.mu.Lock()
 	r.docs = make(map[DocumentID]*Document)
+	r.evicted = make(map[DocumentID]int64)
+	r.mu.Unlock()
 }
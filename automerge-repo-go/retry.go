@@ -0,0 +1,151 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ErrRetriesExhausted is wrapped by the ConnFinished error of a retry loop
+// that gave up because of its RetryPolicy limits.
+var ErrRetriesExhausted = errors.New("connection retries exhausted")
+
+// RetryPolicy controls how AddConnWithRetryPolicy reconnects to a peer. The
+// n-th consecutive failure waits InitialDelay * Multiplier^(n-1), capped at
+// MaxDelay, before the next attempt.
+type RetryPolicy struct {
+	InitialDelay time.Duration
+	// MaxDelay caps the delay. Zero means no cap.
+	MaxDelay time.Duration
+	// Multiplier grows the delay after each failure. Values below 1 are
+	// treated as 1, giving a constant delay.
+	Multiplier float64
+	// Jitter randomly shortens each delay by up to this fraction of it, so
+	// that many clients do not reconnect in lockstep. It is clamped to [0, 1].
+	Jitter float64
+	// MaxAttempts gives up after this many consecutive attempts. Zero means
+	// no limit.
+	MaxAttempts int
+	// MaxElapsed gives up once this much time has passed since the first of
+	// the consecutive attempts. Zero means no limit.
+	MaxElapsed time.Duration
+	// ResetAfter is how long a connection must stay up to count as healthy.
+	// Ending a healthy connection starts the backoff, attempt count and
+	// elapsed time afresh. Zero treats every established connection as
+	// healthy.
+	ResetAfter time.Duration
+}
+
+// DefaultRetryPolicy backs off exponentially from 100ms to 30s with 20%
+// jitter and never gives up.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialDelay: 100 * time.Millisecond,
+	MaxDelay:     30 * time.Second,
+	Multiplier:   2,
+	Jitter:       0.2,
+	ResetAfter:   10 * time.Second,
+}
+
+// Delay returns the delay before the attempt following the given number of
+// consecutive failures, without jitter.
+func (p RetryPolicy) Delay(failures int) time.Duration {
+	if failures < 1 {
+		failures = 1
+	}
+	m := p.Multiplier
+	if m < 1 {
+		m = 1
+	}
+	d := float64(p.InitialDelay) * math.Pow(m, float64(failures-1))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	if d > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+func (p RetryPolicy) jittered(failures int) time.Duration {
+	d := p.Delay(failures)
+	j := math.Min(math.Max(p.Jitter, 0), 1)
+	return d - time.Duration(float64(d)*j*rand.Float64())
+}
+
+// AddConnWithRetryPolicy dials the remote with dial and registers each
+// connection with AddConn, dialing again according to p whenever the dial
+// fails or the connection ends. An EventConnAttempt event is emitted before
+// every dial. Canceling ctx interrupts dialing, waiting and the connection
+// itself. The returned ConnComplete resolves when the loop exits: with
+// ConnFinishedLocalClose and ctx's error on cancellation, or with the last
+// failure wrapped in ErrRetriesExhausted when p gives up. The loop also stops
+// without redialing when another AddConn replaces its connection, resolving
+// with that connection's ConnFinished.
+func (h *RepoHandle) AddConnWithRetryPolicy(ctx context.Context, remote RepoID, dial func(context.Context) (Conn, error), p RetryPolicy) ConnComplete {
+	done := make(chan ConnFinished, 1)
+	finish := func(f ConnFinished) {
+		done <- f
+		close(done)
+	}
+	canceled := func() {
+		finish(ConnFinished{Kind: ConnFinishedLocalClose, Err: ctx.Err()})
+	}
+	go func() {
+		attempt := 0
+		start := time.Now()
+		for {
+			attempt++
+			h.tryEmitEvent(HandleEvent{Type: EventConnAttempt, Peer: remote, Attempt: attempt})
+			conn, err := dial(ctx)
+			if ctx.Err() != nil {
+				if err == nil {
+					conn.Close()
+				}
+				canceled()
+				return
+			}
+
+			var fin ConnFinished
+			if err != nil {
+				fin = ConnFinished{Kind: ConnFinishedRecvError, Err: err}
+			} else {
+				connected := time.Now()
+				cc := h.AddConn(remote, conn)
+				select {
+				case fin = <-cc.ch:
+				case <-ctx.Done():
+					h.removeConn(remote, cc, ConnFinished{Kind: ConnFinishedLocalClose, Err: ctx.Err()})
+					canceled()
+					return
+				}
+				if errors.Is(fin.Err, errReplaced) {
+					// Someone else connected this peer; they own it now.
+					finish(fin)
+					return
+				}
+				if time.Since(connected) >= p.ResetAfter {
+					attempt = 0
+					start = time.Now()
+				}
+			}
+
+			delay := p.jittered(attempt)
+			if (p.MaxAttempts > 0 && attempt >= p.MaxAttempts) || (p.MaxElapsed > 0 && time.Since(start)+delay > p.MaxElapsed) {
+				finish(ConnFinished{Kind: fin.Kind, Err: fmt.Errorf("%w after %d attempts: %v", ErrRetriesExhausted, attempt, fin.Err)})
+				return
+			}
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				canceled()
+				return
+			}
+		}
+	}()
+	return ConnComplete{ch: done}
+}
@@ -0,0 +1,175 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second, Multiplier: 2}
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		if d := p.Delay(i + 1); d != w*time.Millisecond {
+			t.Fatalf("delay after %d failures: expected %v, got %v", i+1, w*time.Millisecond, d)
+		}
+	}
+	if d := (RetryPolicy{InitialDelay: time.Second}).Delay(10); d != time.Second {
+		t.Fatalf("expected constant delay without multiplier, got %v", d)
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.jittered(1); d < 50*time.Millisecond || d > 100*time.Millisecond {
+			t.Fatalf("jittered delay %v out of range", d)
+		}
+	}
+}
+
+func failingDial(n *atomic.Int32) func(context.Context) (Conn, error) {
+	return func(context.Context) (Conn, error) {
+		n.Add(1)
+		return nil, errors.New("refused")
+	}
+}
+
+func TestAddConnWithRetryPolicyLimits(t *testing.T) {
+	h := NewRepoHandle(New())
+	defer h.Close()
+	peer := New().ID
+
+	var dials atomic.Int32
+	p := RetryPolicy{InitialDelay: time.Millisecond, Multiplier: 2, MaxAttempts: 3}
+	res := h.AddConnWithRetryPolicy(context.Background(), peer, failingDial(&dials), p).Await()
+	if !errors.Is(res.Err, ErrRetriesExhausted) || dials.Load() != 3 {
+		t.Fatalf("expected to give up after 3 dials, got %+v after %d", res, dials.Load())
+	}
+	for i := 1; i <= 3; i++ {
+		if evt := <-h.Events; evt.Type != EventConnAttempt || evt.Attempt != i {
+			t.Fatalf("expected attempt %d event, got %#v", i, evt)
+		}
+	}
+
+	dials.Store(0)
+	p = RetryPolicy{InitialDelay: 20 * time.Millisecond, MaxElapsed: 100 * time.Millisecond}
+	start := time.Now()
+	res = h.AddConnWithRetryPolicy(context.Background(), peer, failingDial(&dials), p).Await()
+	if !errors.Is(res.Err, ErrRetriesExhausted) {
+		t.Fatalf("expected ErrRetriesExhausted, got %+v", res)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond || dials.Load() < 3 {
+		t.Fatalf("gave up after %v and %d dials", elapsed, dials.Load())
+	}
+}
+
+func TestAddConnWithRetryPolicyCancel(t *testing.T) {
+	h := NewRepoHandle(New())
+	defer h.Close()
+	peer := New().ID
+
+	// cancel while waiting for the next attempt
+	var dials atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	cc := h.AddConnWithRetryPolicy(ctx, peer, failingDial(&dials), RetryPolicy{InitialDelay: time.Hour})
+	<-h.Events
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	done := make(chan ConnFinished)
+	go func() { done <- cc.Await() }()
+	select {
+	case res := <-done:
+		if res.Kind != ConnFinishedLocalClose || !errors.Is(res.Err, context.Canceled) {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancel did not interrupt the backoff")
+	}
+
+	// cancel while connected
+	ctx, cancel = context.WithCancel(context.Background())
+	c1, _ := newMockConn()
+	cc = h.AddConnWithRetryPolicy(ctx, peer, func(context.Context) (Conn, error) { return c1, nil }, DefaultRetryPolicy)
+	waitEvent(t, h, EventPeerConnected)
+	cancel()
+	go func() { done <- cc.Await() }()
+	select {
+	case res := <-done:
+		if res.Kind != ConnFinishedLocalClose {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancel did not close the connection")
+	}
+	if _, ok := h.PeerStats(peer); ok {
+		t.Fatalf("peer still connected after cancel")
+	}
+}
+
+func TestAddConnWithRetryPolicyUnreadEvents(t *testing.T) {
+	h := NewRepoHandle(New())
+	defer h.Close()
+	var dials atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	// nobody reads h.Events, so attempts beyond its buffer must not block
+	cc := h.AddConnWithRetryPolicy(ctx, New().ID, failingDial(&dials), RetryPolicy{InitialDelay: time.Millisecond})
+	deadline := time.Now().Add(time.Second)
+	for dials.Load() < 20 {
+		if time.Now().After(deadline) {
+			t.Fatalf("retry loop stalled after %d dials", dials.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	done := make(chan ConnFinished, 1)
+	go func() { done <- cc.Await() }()
+	select {
+	case res := <-done:
+		if res.Kind != ConnFinishedLocalClose {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("retry loop ignored cancellation")
+	}
+}
+
+func TestAddConnWithRetryPolicyReplaced(t *testing.T) {
+	h := NewRepoHandle(New())
+	defer h.Close()
+	peer := New().ID
+
+	var dials atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c1, _ := newMockConn()
+	cc := h.AddConnWithRetryPolicy(ctx, peer, func(context.Context) (Conn, error) {
+		dials.Add(1)
+		return c1, nil
+	}, RetryPolicy{InitialDelay: time.Millisecond})
+	waitEvent(t, h, EventPeerConnected)
+
+	// a connection added by someone else replaces the loop's and ends it
+	c2, _ := newMockConn()
+	h.AddConn(peer, c2)
+	done := make(chan ConnFinished, 1)
+	go func() { done <- cc.Await() }()
+	select {
+	case res := <-done:
+		if !errors.Is(res.Err, errReplaced) {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("retry loop did not stop after being replaced")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("dialed %d times, want 1", n)
+	}
+
+	// canceling the finished loop leaves the replacement connected
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := h.PeerStats(peer); !ok {
+		t.Fatal("replacement connection removed")
+	}
+}
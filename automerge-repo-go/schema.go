@@ -0,0 +1,466 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a compiled JSON Schema. The supported subset of draft 2020-12
+// covers type, enum, const, the numeric and string bounds, pattern,
+// properties, required, additionalProperties, minProperties, maxProperties,
+// items, prefixItems, minItems, maxItems, uniqueItems, allOf, anyOf, oneOf
+// and not. Other keywords are ignored.
+type Schema struct {
+	// always holds the result of a boolean schema.
+	always *bool
+
+	types      []string
+	enum       []interface{}
+	constValue *interface{}
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+	multipleOf                         *float64
+
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+	minProperties        *int
+	maxProperties        *int
+
+	items       *Schema
+	prefixItems []*Schema
+	minItems    *int
+	maxItems    *int
+	uniqueItems bool
+
+	allOf, anyOf, oneOf []*Schema
+	not                 *Schema
+}
+
+// SchemaError describes one way a value violates a schema.
+type SchemaError struct {
+	// Path is a JSON Pointer to the offending value.
+	Path    string
+	Keyword string
+	Message string
+}
+
+func (e SchemaError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "/"
+	}
+	return fmt.Sprintf("%s: %s: %s", path, e.Keyword, e.Message)
+}
+
+// CompileSchema parses a JSON Schema.
+func CompileSchema(data []byte) (*Schema, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw interface{}
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	return compileSchema(raw, "")
+}
+
+// MustCompileSchema is like CompileSchema but panics on error.
+func MustCompileSchema(data string) *Schema {
+	s, err := CompileSchema([]byte(data))
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func compileSchema(raw interface{}, at string) (*Schema, error) {
+	if b, ok := raw.(bool); ok {
+		return &Schema{always: &b}, nil
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid schema at %q: expected object or boolean", at)
+	}
+	s := &Schema{}
+	var err error
+	fail := func(kw string, e error) error {
+		return fmt.Errorf("invalid schema at %q: %s: %w", at+"/"+kw, kw, e)
+	}
+	errType := errors.New("wrong type")
+
+	for kw, v := range m {
+		switch kw {
+		case "type":
+			switch t := v.(type) {
+			case string:
+				s.types = []string{t}
+			case []interface{}:
+				for _, e := range t {
+					str, ok := e.(string)
+					if !ok {
+						return nil, fail(kw, errType)
+					}
+					s.types = append(s.types, str)
+				}
+			default:
+				return nil, fail(kw, errType)
+			}
+		case "enum":
+			l, ok := v.([]interface{})
+			if !ok {
+				return nil, fail(kw, errType)
+			}
+			s.enum = l
+		case "const":
+			c := v
+			s.constValue = &c
+		case "minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum", "multipleOf":
+			n, ok := schemaNumber(v)
+			if !ok {
+				return nil, fail(kw, errType)
+			}
+			switch kw {
+			case "minimum":
+				s.minimum = &n
+			case "maximum":
+				s.maximum = &n
+			case "exclusiveMinimum":
+				s.exclusiveMinimum = &n
+			case "exclusiveMaximum":
+				s.exclusiveMaximum = &n
+			case "multipleOf":
+				s.multipleOf = &n
+			}
+		case "minLength", "maxLength", "minItems", "maxItems", "minProperties", "maxProperties":
+			n, ok := schemaNumber(v)
+			if !ok || n < 0 || n != math.Trunc(n) {
+				return nil, fail(kw, errType)
+			}
+			i := int(n)
+			switch kw {
+			case "minLength":
+				s.minLength = &i
+			case "maxLength":
+				s.maxLength = &i
+			case "minItems":
+				s.minItems = &i
+			case "maxItems":
+				s.maxItems = &i
+			case "minProperties":
+				s.minProperties = &i
+			case "maxProperties":
+				s.maxProperties = &i
+			}
+		case "pattern":
+			p, ok := v.(string)
+			if !ok {
+				return nil, fail(kw, errType)
+			}
+			if s.pattern, err = regexp.Compile(p); err != nil {
+				return nil, fail(kw, err)
+			}
+		case "properties":
+			props, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fail(kw, errType)
+			}
+			s.properties = make(map[string]*Schema, len(props))
+			for name, p := range props {
+				if s.properties[name], err = compileSchema(p, at+"/properties/"+name); err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			l, ok := v.([]interface{})
+			if !ok {
+				return nil, fail(kw, errType)
+			}
+			for _, e := range l {
+				str, ok := e.(string)
+				if !ok {
+					return nil, fail(kw, errType)
+				}
+				s.required = append(s.required, str)
+			}
+		case "additionalProperties", "items", "not":
+			sub, err := compileSchema(v, at+"/"+kw)
+			if err != nil {
+				return nil, err
+			}
+			switch kw {
+			case "additionalProperties":
+				s.additionalProperties = sub
+			case "items":
+				s.items = sub
+			case "not":
+				s.not = sub
+			}
+		case "prefixItems", "allOf", "anyOf", "oneOf":
+			l, ok := v.([]interface{})
+			if !ok || len(l) == 0 {
+				return nil, fail(kw, errType)
+			}
+			subs := make([]*Schema, len(l))
+			for i, e := range l {
+				if subs[i], err = compileSchema(e, at+"/"+kw+"/"+strconv.Itoa(i)); err != nil {
+					return nil, err
+				}
+			}
+			switch kw {
+			case "prefixItems":
+				s.prefixItems = subs
+			case "allOf":
+				s.allOf = subs
+			case "anyOf":
+				s.anyOf = subs
+			case "oneOf":
+				s.oneOf = subs
+			}
+		case "uniqueItems":
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fail(kw, errType)
+			}
+			s.uniqueItems = b
+		}
+	}
+	return s, nil
+}
+
+func schemaNumber(v interface{}) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// Validate checks v, a value as returned by automerge.Value.Interface or
+// decoded from JSON, against the schema and returns every violation found.
+func (s *Schema) Validate(v interface{}) []SchemaError {
+	var errs []SchemaError
+	s.validate(v, "", &errs)
+	return errs
+}
+
+func (s *Schema) validate(v interface{}, path string, errs *[]SchemaError) {
+	add := func(kw, format string, args ...interface{}) {
+		*errs = append(*errs, SchemaError{Path: path, Keyword: kw, Message: fmt.Sprintf(format, args...)})
+	}
+	if s.always != nil {
+		if !*s.always {
+			add("false", "no value is allowed")
+		}
+		return
+	}
+	if len(s.types) > 0 {
+		ok := false
+		for _, t := range s.types {
+			if hasSchemaType(v, t) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			add("type", "expected %s, got %s", strings.Join(s.types, " or "), schemaTypeOf(v))
+			return
+		}
+	}
+	if s.enum != nil {
+		ok := false
+		for _, e := range s.enum {
+			if jsonEqual(v, schemaValue(e)) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			add("enum", "value is not one of the allowed values")
+		}
+	}
+	if s.constValue != nil && !jsonEqual(v, schemaValue(*s.constValue)) {
+		add("const", "value does not match")
+	}
+
+	if n, ok := toFloat(v); ok {
+		if s.minimum != nil && n < *s.minimum {
+			add("minimum", "%v is less than %v", n, *s.minimum)
+		}
+		if s.maximum != nil && n > *s.maximum {
+			add("maximum", "%v is greater than %v", n, *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && n <= *s.exclusiveMinimum {
+			add("exclusiveMinimum", "%v is not greater than %v", n, *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && n >= *s.exclusiveMaximum {
+			add("exclusiveMaximum", "%v is not less than %v", n, *s.exclusiveMaximum)
+		}
+		if s.multipleOf != nil && *s.multipleOf != 0 {
+			if q := n / *s.multipleOf; q != math.Trunc(q) {
+				add("multipleOf", "%v is not a multiple of %v", n, *s.multipleOf)
+			}
+		}
+	}
+
+	if str, ok := v.(string); ok {
+		n := utf8.RuneCountInString(str)
+		if s.minLength != nil && n < *s.minLength {
+			add("minLength", "length %d is less than %d", n, *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			add("maxLength", "length %d is greater than %d", n, *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			add("pattern", "does not match %q", s.pattern.String())
+		}
+	}
+
+	if obj, ok := v.(map[string]interface{}); ok {
+		for _, name := range s.required {
+			if _, ok := obj[name]; !ok {
+				add("required", "missing property %q", name)
+			}
+		}
+		if s.minProperties != nil && len(obj) < *s.minProperties {
+			add("minProperties", "%d properties, need at least %d", len(obj), *s.minProperties)
+		}
+		if s.maxProperties != nil && len(obj) > *s.maxProperties {
+			add("maxProperties", "%d properties, allowed at most %d", len(obj), *s.maxProperties)
+		}
+		for name, pv := range obj {
+			child := path + "/" + escapePointer(name)
+			if ps, ok := s.properties[name]; ok {
+				ps.validate(pv, child, errs)
+			} else if s.additionalProperties != nil {
+				s.additionalProperties.validate(pv, child, errs)
+			}
+		}
+	}
+
+	if list, ok := v.([]interface{}); ok {
+		if s.minItems != nil && len(list) < *s.minItems {
+			add("minItems", "%d items, need at least %d", len(list), *s.minItems)
+		}
+		if s.maxItems != nil && len(list) > *s.maxItems {
+			add("maxItems", "%d items, allowed at most %d", len(list), *s.maxItems)
+		}
+		for i, e := range list {
+			child := path + "/" + strconv.Itoa(i)
+			if i < len(s.prefixItems) {
+				s.prefixItems[i].validate(e, child, errs)
+			} else if s.items != nil {
+				s.items.validate(e, child, errs)
+			}
+		}
+		if s.uniqueItems {
+			for i := range list {
+				for j := i + 1; j < len(list); j++ {
+					if jsonEqual(list[i], list[j]) {
+						add("uniqueItems", "items %d and %d are equal", i, j)
+					}
+				}
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(v, path, errs)
+	}
+	if len(s.anyOf) > 0 {
+		ok := false
+		for _, sub := range s.anyOf {
+			if len(sub.Validate(v)) == 0 {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			add("anyOf", "value matches none of the schemas")
+		}
+	}
+	if len(s.oneOf) > 0 {
+		n := 0
+		for _, sub := range s.oneOf {
+			if len(sub.Validate(v)) == 0 {
+				n++
+			}
+		}
+		if n != 1 {
+			add("oneOf", "value matches %d schemas, expected exactly one", n)
+		}
+	}
+	if s.not != nil && len(s.not.Validate(v)) == 0 {
+		add("not", "value matches a schema it must not match")
+	}
+}
+
+func hasSchemaType(v interface{}, t string) bool {
+	switch t {
+	case "integer":
+		n, ok := toFloat(v)
+		return ok && n == math.Trunc(n)
+	case "number":
+		_, ok := toFloat(v)
+		return ok
+	}
+	return schemaTypeOf(v) == t
+}
+
+func schemaTypeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case int64, uint64:
+		return "integer"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// schemaValue converts a value from a compiled schema, whose numbers are
+// json.Number, for comparison with document values.
+func schemaValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = schemaValue(e)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = schemaValue(e)
+		}
+		return out
+	}
+	return v
+}
+
+func escapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
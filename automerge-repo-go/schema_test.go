@@ -0,0 +1,358 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+const taskSchema = `{
+	"type": "object",
+	"required": ["title"],
+	"properties": {
+		"@type": {"const": "task"},
+		"title": {"type": "string", "minLength": 1},
+		"priority": {"type": "integer", "minimum": 1, "maximum": 5},
+		"tags": {"type": "array", "items": {"type": "string"}, "uniqueItems": true},
+		"state": {"enum": ["open", "done"]}
+	},
+	"additionalProperties": false
+}`
+
+func TestSchemaValidate(t *testing.T) {
+	s := MustCompileSchema(taskSchema)
+	ok := map[string]interface{}{"title": "write", "priority": int64(2), "tags": []interface{}{"a", "b"}, "state": "open"}
+	if errs := s.Validate(ok); len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	bad := map[string]interface{}{"priority": 2.5, "tags": []interface{}{"a", "a"}, "state": "gone", "extra": true}
+	errs := s.Validate(bad)
+	got := map[string]string{}
+	for _, e := range errs {
+		got[e.Keyword] = e.Path
+	}
+	want := map[string]string{
+		"required":    "",
+		"type":        "/priority",
+		"uniqueItems": "/tags",
+		"enum":        "/state",
+		"false":       "/extra",
+	}
+	for kw, path := range want {
+		if p, ok := got[kw]; !ok || p != path {
+			t.Fatalf("expected %s error at %q, got %v", kw, path, errs)
+		}
+	}
+	if _, err := CompileSchema([]byte(`{"minLength": "x"}`)); err == nil {
+		t.Fatalf("expected error for invalid schema")
+	}
+}
+
+func TestRepoSchemaRejectsLocalChanges(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+	r.WithSchema(h.DocID(), MustCompileSchema(taskSchema))
+
+	if err := h.SetPath([]interface{}{"title"}, "write"); err != nil {
+		t.Fatalf("valid change rejected: %v", err)
+	}
+	before := h.Heads()
+	err := h.WithDocMut(func(doc *automerge.Doc) error {
+		return doc.RootMap().Set("priority", int64(9))
+	})
+	var verr *ValidationError
+	if !errors.As(err, &verr) || !errors.Is(err, ErrSchemaViolation) || verr.Errors[0].Path != "/priority" {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	if !sameHeads(before, h.Heads()) {
+		t.Fatalf("invalid change was committed")
+	}
+	if v, _ := h.GetPath("priority"); v != nil {
+		t.Fatalf("invalid value visible: %v", v)
+	}
+	if err := h.ApplyJSONPatch([]byte(`[{"op":"remove","path":"/title"}]`)); !errors.Is(err, ErrSchemaViolation) {
+		t.Fatalf("expected validation error from patch, got %v", err)
+	}
+
+	// later local changes still commit as the same actor
+	if err := h.SetPath([]interface{}{"priority"}, int64(3)); err != nil {
+		t.Fatalf("valid change rejected: %v", err)
+	}
+	history := mustHistory(t, h)
+	if len(history) != 2 || history[0].Actor != history[1].Actor || history[1].Seq != 2 {
+		t.Fatalf("unexpected history %+v", history)
+	}
+}
+
+func waitEvent(t *testing.T, h *RepoHandle, typ string) HandleEvent {
+	t.Helper()
+	for {
+		select {
+		case evt := <-h.Events:
+			if evt.Type == typ {
+				return evt
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %s event", typ)
+		}
+	}
+}
+
+func TestRepoSchemaSyncValidation(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		server := New().WithTypeSchema("task", MustCompileSchema(taskSchema)).WithStrictSchemas(strict)
+		h1, h2 := connectedHandles(t, New(), server)
+
+		doc := h1.Repo.NewDoc()
+		if err := doc.Set(TypeKey, "task"); err != nil {
+			t.Fatalf("set err: %v", err)
+		}
+		if err := doc.Set("priority", int64(7)); err != nil {
+			t.Fatalf("set err: %v", err)
+		}
+		if err := h1.SyncDocument(h2.Repo.ID, doc.ID); err != nil {
+			t.Fatalf("sync err: %v", err)
+		}
+		evt := waitEvent(t, h2, EventValidationFailed)
+		if !errors.Is(evt.Err, ErrSchemaViolation) || evt.DocumentID != doc.ID || evt.Peer != h1.Repo.ID {
+			t.Fatalf("unexpected event %#v", evt)
+		}
+		time.Sleep(20 * time.Millisecond)
+		synced, _ := h2.Repo.GetDoc(doc.ID)
+		v, _ := synced.Get("priority")
+		quarantined := h2.Repo.Quarantined(doc.ID)
+		if strict && (v != nil || len(quarantined) != 2) {
+			t.Fatalf("strict repo applied invalid changes: %v, %d quarantined", v, len(quarantined))
+		}
+		if !strict && (v != int64(7) || len(quarantined) != 0) {
+			t.Fatalf("lenient repo did not apply changes: %v, %d quarantined", v, len(quarantined))
+		}
+		h1.Close()
+		h2.Close()
+	}
+}
+
+// syncChanges returns a sync message carrying src's changes to an empty peer.
+func syncChanges(t *testing.T, src *automerge.Doc) []byte {
+	t.Helper()
+	a := automerge.NewSyncState(src)
+	b := automerge.NewSyncState(automerge.New())
+	m, _ := b.GenerateMessage()
+	if _, err := a.ReceiveMessage(m.Bytes()); err != nil {
+		t.Fatalf("receive err: %v", err)
+	}
+	m, ok := a.GenerateMessage()
+	if !ok || len(m.Changes()) == 0 {
+		t.Fatalf("expected a message with changes")
+	}
+	return m.Bytes()
+}
+
+func TestRepoSchemaQuarantinePartial(t *testing.T) {
+	r := New().WithTypeSchema("task", MustCompileSchema(taskSchema)).WithStrictSchemas(true)
+	src := automerge.New()
+	set := func(d *automerge.Doc, k string, v interface{}) {
+		if err := d.RootMap().Set(k, v); err != nil {
+			t.Fatalf("set err: %v", err)
+		}
+		if _, err := d.Commit(k); err != nil {
+			t.Fatalf("commit err: %v", err)
+		}
+	}
+	if err := src.RootMap().Set(TypeKey, "task"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	set(src, "title", "write")
+	branch, err := src.Fork()
+	if err != nil {
+		t.Fatalf("fork err: %v", err)
+	}
+	set(src, "priority", int64(7))
+	set(src, "state", "done") // valid, but builds on the invalid priority
+	set(branch, "state", "open")
+	if _, err := src.Merge(branch); err != nil {
+		t.Fatalf("merge err: %v", err)
+	}
+	msg := syncChanges(t, src)
+
+	doc := r.NewDoc()
+	for i := 0; i < 3; i++ {
+		ok, err := r.validateSync(doc, msg, ChangeOrigin{Kind: OriginPeer})
+		if ok || !errors.Is(err, ErrSchemaViolation) {
+			t.Fatalf("expected the message to be refused, got %v %v", ok, err)
+		}
+	}
+	if q := r.Quarantined(doc.ID); len(q) != 2 {
+		t.Fatalf("expected 2 quarantined changes after resends, got %d", len(q))
+	}
+	if v, _ := doc.Get("title"); v != "write" {
+		t.Fatalf("valid changes not applied: title %v", v)
+	}
+	if v, _ := doc.Get("state"); v != "open" {
+		t.Fatalf("expected state from the valid branch, got %v", v)
+	}
+	if v, _ := doc.Get("priority"); v != nil {
+		t.Fatalf("invalid change applied: priority %v", v)
+	}
+
+	if r.schemaFor(New().ID, automerge.New()) != nil {
+		t.Fatalf("untyped document should have no schema")
+	}
+}
+
+func TestRepoSchemaQuarantineReplies(t *testing.T) {
+	server := New().WithTypeSchema("task", MustCompileSchema(taskSchema)).WithStrictSchemas(true)
+	h1, h2 := connectedHandles(t, New(), server)
+	defer h1.Close()
+	defer h2.Close()
+
+	doc := h1.Repo.NewDoc()
+	if err := doc.Set(TypeKey, "task"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := doc.Set("title", "write"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := h1.SyncDocument(h2.Repo.ID, doc.ID); err != nil {
+		t.Fatalf("sync err: %v", err)
+	}
+	var synced *Document
+	for deadline := time.Now().Add(time.Second); ; {
+		if d, ok := h2.Repo.GetDoc(doc.ID); ok {
+			if v, _ := d.Get("title"); v == "write" {
+				synced = d
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the valid document")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the server changes the document, and the client then sends a change
+	// the server refuses together with a valid one
+	if err := synced.Set("state", "open"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := doc.Set("priority", int64(7)); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := doc.Set("title", "review"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := h1.SyncDocument(h2.Repo.ID, doc.ID); err != nil {
+		t.Fatalf("sync err: %v", err)
+	}
+	waitEvent(t, h2, EventValidationFailed)
+
+	// the server's reply brings its change to the client
+	for deadline := time.Now().Add(time.Second); ; {
+		if v, _ := doc.Get("state"); v == "open" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("client never received the server's reply")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if v, _ := synced.Get("priority"); v != nil {
+		t.Fatalf("invalid change applied: priority %v", v)
+	}
+}
+
+func TestRepoQuarantineLimit(t *testing.T) {
+	r := New()
+	id := New().ID
+	var changes []*automerge.Change
+	d := automerge.New()
+	for i := 0; i < MaxQuarantined+10; i++ {
+		if err := d.RootMap().Set("n", int64(i)); err != nil {
+			t.Fatalf("set err: %v", err)
+		}
+		if _, err := d.Commit("n"); err != nil {
+			t.Fatalf("commit err: %v", err)
+		}
+	}
+	changes, err := d.Changes()
+	if err != nil {
+		t.Fatalf("changes err: %v", err)
+	}
+	r.addQuarantine(id, changes)
+	r.addQuarantine(id, changes[len(changes)-5:])
+	q := r.Quarantined(id)
+	if len(q) != MaxQuarantined || q[len(q)-1].Hash != changes[len(changes)-1].Hash() {
+		t.Fatalf("unexpected quarantine of %d changes", len(q))
+	}
+}
+
+// concurrentWrites runs n calls of write alongside n plain WithDocMut calls on
+// the same document and fails the test if any of them errs or if a plain
+// write was lost.
+// fillDoc sets n keys on the document, so that validating or diffing it
+// keeps a fork open long enough for concurrent writers to get in.
+func fillDoc(t *testing.T, h *DocumentHandle, n int) {
+	t.Helper()
+	if err := h.WithDocMut(func(doc *automerge.Doc) error {
+		for i := 0; i < n; i++ {
+			if err := doc.RootMap().Set(fmt.Sprintf("fill%d", i), int64(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("fill failed: %v", err)
+	}
+}
+
+func concurrentWrites(t *testing.T, h *DocumentHandle, n int, write func(i int) error) {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errs <- write(i)
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			errs <- h.WithDocMut(func(doc *automerge.Doc) error {
+				return doc.RootMap().Set(fmt.Sprintf("plain%d", i), int64(i))
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent write failed: %v", err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if v, _ := h.GetPath(fmt.Sprintf("plain%d", i)); v != int64(i) {
+			t.Fatalf("plain write %d lost: %v", i, v)
+		}
+	}
+}
+
+func TestValidatedDocMutConcurrentWithDocMut(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+	concurrentWrites(t, h, 20, func(i int) error {
+		return h.withDocMutAtomic(func(doc *automerge.Doc) error {
+			// give plain writers time to commit while the fork is open
+			time.Sleep(time.Millisecond)
+			return doc.RootMap().Set(fmt.Sprintf("atomic%d", i), int64(i))
+		})
+	})
+	for i := 0; i < 20; i++ {
+		if v, _ := h.GetPath(fmt.Sprintf("atomic%d", i)); v != int64(i) {
+			t.Fatalf("atomic write %d lost: %v", i, v)
+		}
+	}
+}
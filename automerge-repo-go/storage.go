@@ -1,9 +1,34 @@
 package repo
 
+import "context"
+
 // StorageAdapter is the interface for custom storage implementations.
 type StorageAdapter interface {
 	Load(id DocumentID) (*Document, error)
 	Save(doc *Document) error
 	Compact(doc *Document) error
 	List() ([]DocumentID, error)
+	// Remove deletes the stored document. Removing a document that is not
+	// stored is not an error.
+	Remove(id DocumentID) error
+}
+
+// TombstoneStorage is implemented by stores that persist document deletions,
+// so that a repo created with NewWithStore keeps refusing deleted documents,
+// and keeps telling peers about them, after a restart.
+type TombstoneStorage interface {
+	// SaveTombstone records that the document was deleted with opts.
+	SaveTombstone(id DocumentID, opts DeleteOptions) error
+	// RemoveTombstone forgets the deletion of a document that was restored.
+	// Removing a tombstone that does not exist is not an error.
+	RemoveTombstone(id DocumentID) error
+	// Tombstones returns every recorded deletion.
+	Tombstones() (map[DocumentID]DeleteOptions, error)
+}
+
+// WatchableStorage is implemented by stores that can report documents written
+// by other processes. Watch sends the ID of every document that was created or
+// modified in the store until ctx is canceled, then closes the channel.
+type WatchableStorage interface {
+	Watch(ctx context.Context) (<-chan DocumentID, error)
 }
@@ -0,0 +1,205 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+// SubscriptionBuffer is the number of events a subscription queues before
+// further events are dropped.
+const SubscriptionBuffer = 16
+
+// OriginKind says where a change to a document came from.
+type OriginKind int
+
+const (
+	// OriginLocal is a change made in this process.
+	OriginLocal OriginKind = iota
+	// OriginPeer is a change received from a peer by sync.
+	OriginPeer
+	// OriginStorage is a change merged from storage or an imported archive.
+	OriginStorage
+)
+
+func (k OriginKind) String() string {
+	switch k {
+	case OriginLocal:
+		return "local"
+	case OriginPeer:
+		return "peer"
+	case OriginStorage:
+		return "storage"
+	default:
+		return fmt.Sprintf("OriginKind(%d)", int(k))
+	}
+}
+
+// ChangeOrigin identifies the source of a change.
+type ChangeOrigin struct {
+	Kind OriginKind
+	// Peer is the repo the change was synced from when Kind is OriginPeer.
+	// It is the zero ID if the sync message was applied outside a RepoHandle.
+	Peer RepoID
+
+	// handle is the DocumentHandle that made a local change, so that undo
+	// managers record only their own handle's changes. It is cleared before
+	// the origin is delivered to subscribers.
+	handle *DocumentHandle
+}
+
+// ChangeEvent is delivered by DocumentHandle.Subscribe for each change.
+type ChangeEvent struct {
+	DocumentID DocumentID
+	Heads      []automerge.ChangeHash
+	Origin     ChangeOrigin
+	// Patches lead from the heads of the previously delivered event, or the
+	// heads at subscription time, to Heads.
+	Patches []Patch
+	// Missed is the number of events dropped since the previous delivered
+	// event because the subscriber was not keeping up. Their patches are
+	// included in Patches.
+	Missed int
+	// Err is set if the patches could not be computed.
+	Err error
+}
+
+type subscription struct {
+	ch    chan ChangeEvent
+	done  chan struct{}
+	wake  chan struct{}
+	mu    sync.Mutex
+	heads []automerge.ChangeHash
+	// queue holds the changes not yet delivered, at most SubscriptionBuffer.
+	queue  []queuedChange
+	closed bool
+}
+
+// queuedChange is a change waiting to be delivered to a subscription.
+// missed counts the changes folded into it while the queue was full.
+type queuedChange struct {
+	heads  []automerge.ChangeHash
+	origin ChangeOrigin
+	missed int
+}
+
+// Subscribe delivers an event for every change to the document until ctx
+// ends or cancel is called, after which the channel is closed. It is also
+// closed when the document is deleted.
+//
+// Events are queued up to SubscriptionBuffer. While the queue is full, new
+// changes replace the last queued one rather than blocking the writer, so the
+// latest state is always delivered. That event reports how many events were
+// dropped in Missed. Patches are computed from the last delivered heads, so
+// applying every delivered event's patches still reproduces the document.
+// They are computed outside the goroutine that changed the document and are
+// shared between subscribers, who must not modify them.
+func (h *DocumentHandle) Subscribe(ctx context.Context) (<-chan ChangeEvent, func()) {
+	d := h.doc
+	d.ensureDoc()
+	s := &subscription{ch: make(chan ChangeEvent), done: make(chan struct{}), wake: make(chan struct{}, 1)}
+
+	d.watchersMu.Lock()
+	s.heads = d.Doc.Heads()
+	if d.deleted.Load() {
+		d.watchersMu.Unlock()
+		close(s.ch)
+		return s.ch, func() {}
+	}
+	if d.subscriptions == nil {
+		d.subscriptions = make(map[*subscription]struct{})
+	}
+	d.subscriptions[s] = struct{}{}
+	d.watchersMu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		// The subscription may also be closed by deleting the document.
+		select {
+		case <-ctx.Done():
+			d.unsubscribe(s)
+		case <-s.done:
+			cancel()
+		}
+	}()
+	go d.deliver(s)
+	return s.ch, cancel
+}
+
+func (d *Document) unsubscribe(s *subscription) {
+	d.watchersMu.Lock()
+	delete(d.subscriptions, s)
+	d.watchersMu.Unlock()
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	s.mu.Unlock()
+}
+
+// publish queues the document's current state for s without blocking.
+func (d *Document) publish(s *subscription, origin ChangeOrigin) {
+	if d.deleted.Load() {
+		d.unsubscribe(s)
+		return
+	}
+	heads := d.Doc.Heads()
+	s.mu.Lock()
+	switch n := len(s.queue); {
+	case s.closed:
+	case n == SubscriptionBuffer:
+		last := &s.queue[n-1]
+		last.heads, last.origin = heads, origin
+		last.missed++
+	default:
+		s.queue = append(s.queue, queuedChange{heads: heads, origin: origin})
+	}
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends the changes queued for s until it is closed, and then closes
+// its channel.
+func (d *Document) deliver(s *subscription) {
+	defer close(s.ch)
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		next := s.queue[0]
+		s.queue = s.queue[1:]
+		from := s.heads
+		s.mu.Unlock()
+
+		if sameHeads(next.heads, from) {
+			continue
+		}
+		evt := ChangeEvent{DocumentID: d.ID, Heads: next.heads, Origin: next.origin, Missed: next.missed}
+		evt.Patches, evt.Err = d.Diff(from, next.heads)
+		select {
+		case s.ch <- evt:
+			s.mu.Lock()
+			s.heads = next.heads
+			s.mu.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
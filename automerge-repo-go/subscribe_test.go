@@ -0,0 +1,186 @@
+package repo
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+func nextChange(t *testing.T, ch <-chan ChangeEvent) ChangeEvent {
+	t.Helper()
+	select {
+	case evt, ok := <-ch:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return evt
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for change event")
+	}
+	return ChangeEvent{}
+}
+
+func TestDocumentHandleSubscribe(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, stop := h.Subscribe(ctx)
+	defer stop()
+
+	for i, v := range []string{"one", "two"} {
+		if err := h.WithDocMut(func(doc *automerge.Doc) error {
+			return doc.RootMap().Set("k", v)
+		}); err != nil {
+			t.Fatalf("WithDocMut failed: %v", err)
+		}
+		evt := nextChange(t, ch)
+		if evt.Origin.Kind != OriginLocal || evt.Missed != 0 || !sameHeads(evt.Heads, h.Heads()) {
+			t.Fatalf("unexpected event %d: %#v", i, evt)
+		}
+		if len(evt.Patches) != 1 || evt.Patches[0].Value != v {
+			t.Fatalf("unexpected patches %d: %#v", i, evt.Patches)
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("unexpected event after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription not closed after cancel")
+	}
+}
+
+func TestDocumentHandleSubscribeOverflow(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+	ch, stop := h.Subscribe(context.Background())
+	defer stop()
+
+	for i := 0; i < SubscriptionBuffer+3; i++ {
+		if err := h.WithDocMut(func(doc *automerge.Doc) error {
+			return doc.RootMap().Set("n", int64(i))
+		}); err != nil {
+			t.Fatalf("WithDocMut failed: %v", err)
+		}
+	}
+	// changes that overflowed the queue arrive folded into the event for
+	// the latest state
+	events, missed := 0, 0
+	var last ChangeEvent
+	for !sameHeads(last.Heads, h.Heads()) {
+		last = nextChange(t, ch)
+		events++
+		missed += last.Missed
+	}
+	if events > SubscriptionBuffer+1 || missed == 0 || events+missed != SubscriptionBuffer+3 {
+		t.Fatalf("expected %d changes in at most %d events, got %d events and %d missed", SubscriptionBuffer+3, SubscriptionBuffer+1, events, missed)
+	}
+	if len(last.Patches) != 1 || last.Patches[0].Value != int64(SubscriptionBuffer+2) {
+		t.Fatalf("unexpected patches %#v", last.Patches)
+	}
+
+	if err := h.WithDocMut(func(doc *automerge.Doc) error {
+		return doc.RootMap().Set("n", int64(100))
+	}); err != nil {
+		t.Fatalf("WithDocMut failed: %v", err)
+	}
+	evt := nextChange(t, ch)
+	if evt.Missed != 0 || len(evt.Patches) != 1 || evt.Patches[0].Value != int64(100) {
+		t.Fatalf("unexpected event %#v", evt)
+	}
+}
+
+func TestDocumentHandleSubscribeOverflowClose(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+	ch, stop := h.Subscribe(context.Background())
+
+	for i := 0; i < SubscriptionBuffer+1; i++ {
+		if err := h.WithDocMut(func(doc *automerge.Doc) error {
+			return doc.RootMap().Set("n", int64(i))
+		}); err != nil {
+			t.Fatalf("WithDocMut failed: %v", err)
+		}
+	}
+	stop()
+	n := 0
+	for range ch {
+		n++
+	}
+	if n > SubscriptionBuffer+1 {
+		t.Fatalf("unexpected %d events", n)
+	}
+}
+
+func TestDocumentHandleSubscribeOrigins(t *testing.T) {
+	h1 := NewRepoHandle(New())
+	h2 := NewRepoHandle(New())
+	defer h1.Close()
+	defer h2.Close()
+	c1, c2 := newMockConn()
+	_ = h1.AddConn(h2.Repo.ID, c1)
+	_ = h2.AddConn(h1.Repo.ID, c2)
+	<-h1.Events
+	<-h2.Events
+
+	local := h2.Repo.NewDocHandle()
+	ch, stop := local.Subscribe(context.Background())
+	defer stop()
+
+	// the same document edited on the peer
+	doc := &Document{ID: local.DocID(), Doc: automerge.New()}
+	if err := doc.Set("from", "peer"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	h1.Repo.putDoc(doc)
+	if err := h1.SyncDocument(h2.Repo.ID, doc.ID); err != nil {
+		t.Fatalf("sync err: %v", err)
+	}
+	evt := nextChange(t, ch)
+	if evt.Origin.Kind != OriginPeer || evt.Origin.Peer != h1.Repo.ID {
+		t.Fatalf("expected change from peer, got %#v", evt.Origin)
+	}
+
+	if err := h2.Repo.Delete(local.DocID()); err != nil {
+		t.Fatalf("delete err: %v", err)
+	}
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("unexpected event after delete")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription not closed after delete")
+	}
+}
+
+func TestDocumentHandleSubscribeDeleteStopsWaiter(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+	before := runtime.NumGoroutine()
+	subs := make([]<-chan ChangeEvent, 20)
+	for i := range subs {
+		subs[i], _ = h.Subscribe(context.Background())
+	}
+	if err := r.Delete(h.DocID()); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	for _, ch := range subs {
+		for range ch {
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left after delete, want %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,125 @@
+package repo
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrPeerIdentity is returned when a peer announces a repo ID in the join
+// handshake that does not match its verified certificate, and when AddConn
+// refuses a connection claiming the repo ID of a peer authenticated as
+// someone else.
+var ErrPeerIdentity = errors.New("peer identity mismatch")
+
+// TCPTransport sets up LPConn connections over TCP, optionally secured with
+// TLS. The zero value uses plain TCP.
+//
+// With TLS, a peer that presents a verified certificate may only announce
+// the repo ID its certificate maps to, so it cannot claim another peer's
+// senderId. Listeners check the certificates of incoming peers whenever
+// TLS.ClientAuth verifies them, for example with
+// tls.RequireAndVerifyClientCert. Dialers check the server's certificate only
+// when Identity is set, since server certificates usually name hosts rather
+// than repos.
+type TCPTransport struct {
+	// TLS enables TLS with this configuration when not nil.
+	TLS *tls.Config
+	// Identity maps a verified peer certificate to the repo ID the peer must
+	// announce. Nil means CertRepoID.
+	Identity func(*x509.Certificate) (RepoID, error)
+	// Auth, when set, authenticates incoming peers during the handshake
+	// after their certificate has been checked.
+	Auth Authenticator
+	// Metadata is sent as this side's peerMetadata.
+	Metadata PeerMetadata
+}
+
+// CertRepoID maps a certificate to a repo ID by parsing its subject common
+// name, deriving a stable ID from names that are not UUIDs the same way the
+// join handshake does.
+func CertRepoID(cert *x509.Certificate) (RepoID, error) {
+	if cert.Subject.CommonName == "" {
+		return RepoID{}, fmt.Errorf("certificate has no common name")
+	}
+	return parseRepoID(cert.Subject.CommonName), nil
+}
+
+// Dial connects to addr and performs the handshake.
+func (t *TCPTransport) Dial(ctx context.Context, addr string, id RepoID) (*LPConn, RepoID, error) {
+	var d net.Dialer
+	var conn net.Conn
+	var err error
+	if t.TLS != nil {
+		conn, err = (&tls.Dialer{NetDialer: &d, Config: t.TLS}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, RepoID{}, err
+	}
+	lp, remote, err := t.Handshake(ctx, conn, id, Outgoing)
+	if err != nil {
+		conn.Close()
+		return nil, RepoID{}, err
+	}
+	return lp, remote, nil
+}
+
+// Listen listens on addr. Connections accepted from the listener should be
+// passed to Handshake.
+func (t *TCPTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.TLS != nil {
+		ln = tls.NewListener(ln, t.TLS)
+	}
+	return ln, nil
+}
+
+// Handshake completes the TLS handshake of a *tls.Conn, then performs the
+// join/peer handshake like Connect, rejecting a peer whose announced repo ID
+// does not match its certificate with ErrPeerIdentity and, for incoming
+// connections, a peer that Auth refuses with ErrUnauthorized. The identity
+// Auth returns is available from the LPConn. The caller closes conn on error.
+func (t *TCPTransport) Handshake(ctx context.Context, conn net.Conn, id RepoID, dir ConnDirection) (*LPConn, RepoID, error) {
+	var state *tls.ConnectionState
+	var want *RepoID
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, RepoID{}, err
+		}
+		cs := tc.ConnectionState()
+		state = &cs
+		if len(cs.VerifiedChains) > 0 && (dir == Incoming || t.Identity != nil) {
+			identity := t.Identity
+			if identity == nil {
+				identity = CertRepoID
+			}
+			certID, err := identity(cs.VerifiedChains[0][0])
+			if err != nil {
+				return nil, RepoID{}, fmt.Errorf("%w: %v", ErrPeerIdentity, err)
+			}
+			want = &certID
+		}
+	}
+	var auth Authenticator
+	if dir == Incoming {
+		auth = t.Auth
+	}
+	if want == nil && auth == nil {
+		return connect(ctx, conn, id, dir, t.Metadata, nil)
+	}
+	check := func(m handshakeMessage) (*Identity, error) {
+		if remote := parseRepoID(m.SenderID); want != nil && remote != *want {
+			return nil, fmt.Errorf("%w: certificate is for %s but peer announced %s", ErrPeerIdentity, *want, remote)
+		}
+		return Authenticate(ctx, auth, AuthRequest{TLS: state, RemoteAddr: conn.RemoteAddr()}, m.SenderID, m.PeerMetadata)
+	}
+	return connect(ctx, conn, id, dir, t.Metadata, check)
+}
@@ -0,0 +1,166 @@
+package repo
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("ca cert: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for name, valid for clients and for the
+// server address 127.0.0.1.
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("cert: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// acceptOne accepts a single connection on ln and runs the handshake.
+func acceptOne(tr *TCPTransport, ln net.Listener, id RepoID) <-chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		lp, _, err := tr.Handshake(ctx, conn, id, Incoming)
+		if err != nil {
+			conn.Close()
+		} else {
+			lp.Close()
+		}
+		errCh <- err
+	}()
+	return errCh
+}
+
+func TestTCPTransportMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	server, client := New(), New()
+	serverTr := &TCPTransport{TLS: &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, server.ID.String())},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}}
+	ln, err := serverTr.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	dial := func(cert tls.Certificate, id RepoID) (RepoID, error, error) {
+		accepted := acceptOne(serverTr, ln, server.ID)
+		tr := &TCPTransport{TLS: &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{cert}}}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		lp, remote, err := tr.Dial(ctx, ln.Addr().String(), id)
+		if err == nil {
+			lp.Close()
+		}
+		return remote, err, <-accepted
+	}
+
+	remote, dialErr, acceptErr := dial(ca.issue(t, client.ID.String()), client.ID)
+	if dialErr != nil || acceptErr != nil {
+		t.Fatalf("handshake failed: %v / %v", dialErr, acceptErr)
+	}
+	if remote != server.ID {
+		t.Fatalf("unexpected remote %s", remote)
+	}
+
+	// a client certified as one repo cannot announce another's ID
+	_, _, acceptErr = dial(ca.issue(t, client.ID.String()), New().ID)
+	if !errors.Is(acceptErr, ErrPeerIdentity) {
+		t.Fatalf("expected ErrPeerIdentity, got %v", acceptErr)
+	}
+
+	// non-UUID names map to IDs like handshake sender IDs do
+	named := parseRepoID("peer-alice")
+	if _, dialErr, acceptErr = dial(ca.issue(t, "peer-alice"), named); dialErr != nil || acceptErr != nil {
+		t.Fatalf("named peer rejected: %v / %v", dialErr, acceptErr)
+	}
+
+	// a certificate from another CA fails the TLS handshake
+	if _, _, acceptErr = dial(newTestCA(t).issue(t, client.ID.String()), client.ID); acceptErr == nil {
+		t.Fatalf("expected untrusted client certificate to be rejected")
+	}
+}
+
+func TestTCPTransportPlain(t *testing.T) {
+	var tr TCPTransport
+	ln, err := tr.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	server, client := New(), New()
+	accepted := acceptOne(&tr, ln, server.ID)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	lp, remote, err := tr.Dial(ctx, ln.Addr().String(), client.ID)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer lp.Close()
+	if err := <-accepted; err != nil || remote != server.ID {
+		t.Fatalf("unexpected handshake result %s %v", remote, err)
+	}
+}
@@ -0,0 +1,234 @@
+package repo
+
+import (
+	automerge "github.com/automerge/automerge-go"
+)
+
+// Text edits a collaborative text object in a document. Unlike a string
+// written with Set, concurrent edits to different parts of the text are
+// merged rather than one overwriting the other. Positions and lengths count
+// unicode code points.
+//
+// Text has no formatting marks: automerge-go does not bind automerge-c's
+// AMmarkCreate, AMmarkClear and AMmarks, and hides the document and object
+// IDs they take, so marks have to be added there first.
+type Text struct {
+	h    *DocumentHandle
+	path []interface{}
+}
+
+// Cursor is a position in a text that follows concurrent edits: it records
+// the index together with the heads it was taken at, and Text.Resolve finds
+// the same place between the characters around it in the current version.
+type Cursor struct {
+	Heads []automerge.ChangeHash
+	Index int
+}
+
+// cursorActor is the actor of the marker Text.Resolve inserts. It sorts
+// before every real actor, so that text inserted at the cursor by a change
+// with the same counter still ends up before the marker.
+const cursorActor = "00"
+
+// Text returns the text at path. The text must exist; create it with
+// NewText or SetPath.
+func (h *DocumentHandle) Text(path ...interface{}) *Text {
+	return &Text{h: h, path: path}
+}
+
+// NewText creates a text at path holding s, replacing any existing value,
+// and returns it.
+func (h *DocumentHandle) NewText(path []interface{}, s string) (*Text, error) {
+	if err := h.SetPath(path, automerge.NewText(s)); err != nil {
+		return nil, err
+	}
+	return h.Text(path...), nil
+}
+
+// Path returns the path of the text in the document.
+func (t *Text) Path() []interface{} {
+	return t.path
+}
+
+// String returns the current contents of the text.
+func (t *Text) String() (string, error) {
+	t.h.doc.ensureDoc()
+	v, err := t.get(t.h.doc.Doc, "get")
+	if err != nil {
+		return "", err
+	}
+	return v.Get()
+}
+
+// Len returns the length of the text in code points.
+func (t *Text) Len() (int, error) {
+	t.h.doc.ensureDoc()
+	v, err := t.get(t.h.doc.Doc, "get")
+	if err != nil {
+		return 0, err
+	}
+	return v.Len(), nil
+}
+
+// Splice deletes del code points starting at pos, inserts s in their place
+// and commits the change.
+func (t *Text) Splice(pos, del int, s string) error {
+	return t.h.Splice(t.path, pos, del, s)
+}
+
+// Insert inserts s at pos and commits the change.
+func (t *Text) Insert(pos int, s string) error {
+	return t.h.Splice(t.path, pos, 0, s)
+}
+
+// Delete deletes n code points starting at pos and commits the change.
+func (t *Text) Delete(pos, n int) error {
+	return t.h.Splice(t.path, pos, n, "")
+}
+
+// Set replaces the contents of the text with s using the smallest single
+// splice, so that concurrent edits outside the changed span are kept.
+func (t *Text) Set(s string) error {
+	return t.h.WithDocMut(func(doc *automerge.Doc) error {
+		v, err := t.get(doc, "set")
+		if err != nil {
+			return err
+		}
+		before, err := v.Get()
+		if err != nil {
+			return err
+		}
+		if before == s {
+			return nil
+		}
+		return spliceText(v, before, s)
+	})
+}
+
+// Cursor returns a cursor at index in the current version of the text.
+func (t *Text) Cursor(index int) (Cursor, error) {
+	n, err := t.Len()
+	if err != nil {
+		return Cursor{}, err
+	}
+	if index < 0 || index > n {
+		return Cursor{}, &PathError{Op: "cursor", Path: child(t.path, index), Err: ErrPathNotFound}
+	}
+	return Cursor{Heads: t.h.Heads(), Index: index}, nil
+}
+
+// Resolve returns the current index of c. It inserts a marker at c.Index
+// into a copy of the text at c.Heads, merges that into a copy of the current
+// version and reads back where the marker ended up, so the cursor stays
+// between the same two characters even in a run of repeated ones. Text
+// inserted at the cursor moves it forward and a deleted span containing it
+// moves it to the start of the span. If the text has since been removed or
+// replaced by another value, the cursor is lost and ErrPathNotFound is
+// returned.
+func (t *Text) Resolve(c Cursor) (int, error) {
+	lost := &PathError{Op: "resolve", Path: t.path, Err: ErrPathNotFound}
+	then, err := t.h.doc.fork(c.Heads...)
+	if err != nil {
+		return 0, err
+	}
+	now, err := t.h.doc.fork()
+	if err != nil {
+		return 0, err
+	}
+	v, err := t.get(now, "resolve")
+	if err != nil {
+		return 0, lost
+	}
+	s, err := v.Get()
+	if err != nil {
+		return 0, err
+	}
+	marker := cursorMarker(s)
+	old, err := t.get(then, "resolve")
+	if err != nil {
+		return 0, err
+	}
+	if err := then.SetActorID(cursorActor); err != nil {
+		return 0, err
+	}
+	if err := old.Insert(c.Index, string(marker)); err != nil {
+		return 0, &PathError{Op: "resolve", Path: child(t.path, c.Index), Err: err}
+	}
+	if _, err := then.Commit("cursor"); err != nil {
+		return 0, err
+	}
+	if _, err := now.Merge(then); err != nil {
+		return 0, err
+	}
+	if v, err = t.get(now, "resolve"); err != nil {
+		return 0, lost
+	}
+	if s, err = v.Get(); err != nil {
+		return 0, err
+	}
+	i := 0
+	for _, r := range s {
+		if r == marker {
+			return i, nil
+		}
+		i++
+	}
+	// the marker went into a text that is no longer at the path
+	return 0, lost
+}
+
+// cursorMarker returns a private use character that does not occur in s.
+func cursorMarker(s string) rune {
+	used := make(map[rune]bool)
+	for _, r := range s {
+		used[r] = true
+	}
+	r := rune(0xE000)
+	for used[r] {
+		r++
+	}
+	return r
+}
+
+// Diff returns the text patches between two sets of heads of the document,
+// with the same conventions as DocumentHandle.Diff. Each patch is a
+// PatchDelete with a Length or a PatchSplice with the inserted string, and
+// the last element of its Path is the code point index, which maps directly
+// onto the steps of a ProseMirror-style editor. If the text was replaced by
+// another value a single PatchPut or PatchDelete for Path is returned.
+func (t *Text) Diff(from, to []automerge.ChangeHash) ([]Patch, error) {
+	patches, err := t.h.Diff(from, to)
+	if err != nil {
+		return nil, err
+	}
+	var out []Patch
+	for _, p := range patches {
+		if hasPrefix(p.Path, t.path) || hasPrefix(t.path, p.Path) {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+func (t *Text) get(doc *automerge.Doc, op string) (*automerge.Text, error) {
+	v, err := resolvePath(doc, op, t.path, false)
+	if err != nil {
+		return nil, err
+	}
+	if v.Kind() != automerge.KindText {
+		return nil, &PathError{Op: op, Path: t.path, Err: ErrPathType}
+	}
+	return v.Text(), nil
+}
+
+func hasPrefix(path, prefix []interface{}) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+package repo
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTextCursorRepeatedCharacters(t *testing.T) {
+	h := New().NewDocHandle()
+	text, err := h.NewText([]interface{}{"body"}, "aaab")
+	if err != nil {
+		t.Fatalf("NewText failed: %v", err)
+	}
+	c, err := text.Cursor(1)
+	if err != nil {
+		t.Fatalf("Cursor failed: %v", err)
+	}
+	if err := text.Insert(0, "a"); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if i, err := text.Resolve(c); err != nil || i != 2 {
+		t.Fatalf("expected cursor at 2, got %d (%v)", i, err)
+	}
+	// inserting at the cursor moves it forward, deleting around it moves it
+	// to the start of the deleted span
+	if err := text.Insert(2, "aa"); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if i, _ := text.Resolve(c); i != 4 {
+		t.Fatalf("expected cursor at 4, got %d", i)
+	}
+	if err := text.Delete(1, 4); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if i, _ := text.Resolve(c); i != 1 {
+		t.Fatalf("expected cursor at 1, got %d", i)
+	}
+}
+
+func TestTextEdits(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+	text, err := h.NewText([]interface{}{"note", "body"}, "hello world")
+	if err != nil {
+		t.Fatalf("NewText failed: %v", err)
+	}
+	if err := text.Insert(5, ","); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := text.Delete(7, 5); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := text.Splice(7, 0, "there 😀"); err != nil {
+		t.Fatalf("Splice failed: %v", err)
+	}
+	if s, _ := text.String(); s != "hello, there 😀" {
+		t.Fatalf("unexpected text %q", s)
+	}
+	if n, _ := text.Len(); n != 14 {
+		t.Fatalf("expected 14 code points, got %d", n)
+	}
+
+	heads := h.Heads()
+	if err := text.Set("hello, you 😀"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	patches, err := text.Diff(heads, nil)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	want := []Patch{
+		{Action: PatchDelete, Path: []interface{}{"note", "body", 7}, Length: 5},
+		{Action: PatchSplice, Path: []interface{}{"note", "body", 7}, Value: "you"},
+	}
+	if !reflect.DeepEqual(patches, want) {
+		t.Fatalf("unexpected patches:\n got %#v\nwant %#v", patches, want)
+	}
+
+	if err := h.Text("missing").Insert(0, "x"); !errors.Is(err, ErrPathNotFound) {
+		t.Fatalf("expected ErrPathNotFound, got %v", err)
+	}
+}
+
+func TestTextCursor(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+	text, err := h.NewText([]interface{}{"body"}, "hello world")
+	if err != nil {
+		t.Fatalf("NewText failed: %v", err)
+	}
+	world, err := text.Cursor(6)
+	if err != nil {
+		t.Fatalf("Cursor failed: %v", err)
+	}
+	end, _ := text.Cursor(11)
+
+	// a peer inserts before the cursor while we delete before it too
+	remote, err := h.doc.Doc.Fork()
+	if err != nil {
+		t.Fatalf("Fork failed: %v", err)
+	}
+	body, _ := remote.RootMap().Get("body")
+	if err := body.Text().Insert(6, "big "); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if _, err := remote.Commit("remote"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if err := text.Delete(0, 5); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := h.doc.merge(remote, ChangeOrigin{Kind: OriginPeer}); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+
+	s, _ := text.String()
+	if s != " big world" {
+		t.Fatalf("unexpected text %q", s)
+	}
+	i, err := text.Resolve(world)
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if got := []rune(s)[i:]; string(got) != "world" {
+		t.Fatalf("cursor moved to %d (%q)", i, string(got))
+	}
+	if i, _ := text.Resolve(end); i != 10 {
+		t.Fatalf("expected end cursor at 10, got %d", i)
+	}
+
+	if err := h.SetPath([]interface{}{"body"}, "plain"); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+	if _, err := text.Resolve(world); !errors.Is(err, ErrPathNotFound) {
+		t.Fatalf("expected lost cursor, got %v", err)
+	}
+	if _, err := h.NewText([]interface{}{"body"}, "hello world"); err != nil {
+		t.Fatalf("NewText failed: %v", err)
+	}
+	if _, err := text.Resolve(world); !errors.Is(err, ErrPathNotFound) {
+		t.Fatalf("expected lost cursor, got %v", err)
+	}
+}
@@ -0,0 +1,302 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+// TypedHandle binds a Go struct type to a document. Field names follow
+// automerge-go's `automerge:"name"` struct tags. Two extra tag options
+// control how fields are stored:
+//
+//	Body  string `automerge:"body,text"`     // collaborative automerge.Text
+//	Views int64  `automerge:"views,counter"` // automerge.Counter
+//
+// Text fields are written with minimal splices and counter fields with
+// increments, so concurrent edits to them merge instead of overwriting each
+// other.
+type TypedHandle[T any] struct {
+	*DocumentHandle
+}
+
+// NewTypedHandle wraps h so that its contents can be read and written as T.
+func NewTypedHandle[T any](h *DocumentHandle) *TypedHandle[T] {
+	return &TypedHandle[T]{DocumentHandle: h}
+}
+
+// Get decodes the document into a T.
+func (t *TypedHandle[T]) Get() (T, error) {
+	t.doc.ensureDoc()
+	return automerge.As[T](t.doc.Doc.Root())
+}
+
+// errUnchanged aborts WithDocMut when Update made no changes.
+var errUnchanged = errors.New("unchanged")
+
+// Update decodes the document, runs f on the value and writes back only the
+// fields f changed, as a single commit. Nothing is committed if f returns an
+// error or changes nothing, and a value that cannot be written leaves the
+// document untouched.
+func (t *TypedHandle[T]) Update(f func(*T) error, opts ...CommitOptions) error {
+	// the changes are written on a fork, since a field that fails to encode
+	// would otherwise leave the fields before it uncommitted in the document
+	err := t.withDocMutAtomic(func(doc *automerge.Doc) error {
+		before, err := automerge.As[T](doc.Root())
+		if err != nil {
+			return err
+		}
+		after, err := automerge.As[T](doc.Root())
+		if err != nil {
+			return err
+		}
+		if err := f(&after); err != nil {
+			return err
+		}
+		if reflect.DeepEqual(before, after) {
+			return errUnchanged
+		}
+		bv, av := reflect.ValueOf(before), reflect.ValueOf(after)
+		if bv.Kind() != reflect.Struct {
+			return fmt.Errorf("typed handle: %T is not a struct", after)
+		}
+		return writeStruct(doc.RootMap(), bv, av)
+	}, opts...)
+	if errors.Is(err, errUnchanged) {
+		return nil
+	}
+	return err
+}
+
+type fieldTag struct {
+	name    string
+	text    bool
+	counter bool
+}
+
+func parseFieldTag(f reflect.StructField) (fieldTag, bool) {
+	tag := f.Tag.Get("automerge")
+	if tag == "-" || !f.IsExported() {
+		return fieldTag{}, false
+	}
+	name, opts, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = f.Name
+	}
+	ft := fieldTag{name: name}
+	for _, o := range strings.Split(opts, ",") {
+		switch o {
+		case "text":
+			ft.text = true
+		case "counter":
+			ft.counter = true
+		}
+	}
+	return ft, true
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// isStruct reports whether v is written as a nested map.
+func isStruct(v reflect.Value) bool {
+	return v.Kind() == reflect.Struct && v.Type() != timeType
+}
+
+// writeStruct writes the fields of after that differ from before into m.
+func writeStruct(m *automerge.Map, before, after reflect.Value) error {
+	t := after.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag, ok := parseFieldTag(t.Field(i))
+		if !ok {
+			continue
+		}
+		bf, af := before.Field(i), after.Field(i)
+		if reflect.DeepEqual(bf.Interface(), af.Interface()) {
+			continue
+		}
+		if err := writeField(m, tag, bf, af); err != nil {
+			return fmt.Errorf("field %s: %w", tag.name, err)
+		}
+	}
+	return nil
+}
+
+func writeField(m *automerge.Map, tag fieldTag, before, after reflect.Value) error {
+	cur, err := m.Get(tag.name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case tag.text && after.Kind() == reflect.String && cur.Kind() == automerge.KindText:
+		return spliceText(cur.Text(), before.String(), after.String())
+	case tag.counter && after.CanInt() && cur.Kind() == automerge.KindCounter:
+		return cur.Counter().Inc(after.Int() - before.Int())
+	case after.Kind() == reflect.Pointer && !after.IsNil() && !before.IsNil() && isStruct(after.Elem()) && cur.Kind() == automerge.KindMap:
+		return writeStruct(cur.Map(), before.Elem(), after.Elem())
+	case isStruct(after) && cur.Kind() == automerge.KindMap:
+		return writeStruct(cur.Map(), before, after)
+	case after.Kind() == reflect.Slice && after.Type().Elem().Kind() != reflect.Uint8 && !after.IsNil() && cur.Kind() == automerge.KindList:
+		return writeList(cur.List(), before, after)
+	case after.Kind() == reflect.Map && after.Type().Key().Kind() == reflect.String && !after.IsNil() && cur.Kind() == automerge.KindMap:
+		return writeMap(cur.Map(), before, after)
+	case after.Kind() == reflect.Pointer && after.IsNil():
+		return m.Delete(tag.name)
+	}
+	v, err := encodeValue(after, tag)
+	if err != nil {
+		return err
+	}
+	return m.Set(tag.name, v)
+}
+
+// writeMap updates m from the Go map before to after key by key, so that
+// concurrent edits to other keys are kept.
+func writeMap(m *automerge.Map, before, after reflect.Value) error {
+	iter := before.MapRange()
+	for iter.Next() {
+		if !after.MapIndex(iter.Key()).IsValid() {
+			if err := m.Delete(iter.Key().String()); err != nil {
+				return err
+			}
+		}
+	}
+	iter = after.MapRange()
+	for iter.Next() {
+		key := iter.Key().String()
+		av := iter.Value()
+		bv := before.MapIndex(iter.Key())
+		if !bv.IsValid() {
+			v, err := encodeValue(av, fieldTag{})
+			if err != nil {
+				return err
+			}
+			if err := m.Set(key, v); err != nil {
+				return err
+			}
+			continue
+		}
+		if reflect.DeepEqual(bv.Interface(), av.Interface()) {
+			continue
+		}
+		if err := writeField(m, fieldTag{name: key}, bv, av); err != nil {
+			return fmt.Errorf("key %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// writeList updates l from before to after by replacing the elements between
+// their common prefix and suffix. Lists of equal length are updated element
+// by element.
+func writeList(l *automerge.List, before, after reflect.Value) error {
+	start := 0
+	for start < before.Len() && start < after.Len() && reflect.DeepEqual(before.Index(start).Interface(), after.Index(start).Interface()) {
+		start++
+	}
+	endB, endA := before.Len(), after.Len()
+	for endB > start && endA > start && reflect.DeepEqual(before.Index(endB-1).Interface(), after.Index(endA-1).Interface()) {
+		endB--
+		endA--
+	}
+	if endB-start == endA-start {
+		for i := start; i < endA; i++ {
+			bi, ai := before.Index(i), after.Index(i)
+			if reflect.DeepEqual(bi.Interface(), ai.Interface()) {
+				continue
+			}
+			if isStruct(ai) {
+				if cur, err := l.Get(i); err == nil && cur.Kind() == automerge.KindMap {
+					if err := writeStruct(cur.Map(), bi, ai); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			v, err := encodeValue(ai, fieldTag{})
+			if err != nil {
+				return err
+			}
+			if err := l.Set(i, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := endB - 1; i >= start; i-- {
+		if err := l.Delete(i); err != nil {
+			return err
+		}
+	}
+	values := make([]interface{}, 0, endA-start)
+	for i := start; i < endA; i++ {
+		v, err := encodeValue(after.Index(i), fieldTag{})
+		if err != nil {
+			return err
+		}
+		values = append(values, v)
+	}
+	return l.Insert(start, values...)
+}
+
+// spliceText turns the text from before into after with a single splice.
+func spliceText(t *automerge.Text, before, after string) error {
+	br, ar := []rune(before), []rune(after)
+	start := 0
+	for start < len(br) && start < len(ar) && br[start] == ar[start] {
+		start++
+	}
+	endB, endA := len(br), len(ar)
+	for endB > start && endA > start && br[endB-1] == ar[endA-1] {
+		endB--
+		endA--
+	}
+	return t.Splice(start, endB-start, string(ar[start:endA]))
+}
+
+// encodeValue converts v into a value for automerge's Set, turning structs
+// into maps so that nested text and counter tags are honoured.
+func encodeValue(v reflect.Value, tag fieldTag) (interface{}, error) {
+	switch {
+	case tag.text && v.Kind() == reflect.String:
+		return automerge.NewText(v.String()), nil
+	case tag.counter && v.CanInt():
+		return automerge.NewCounter(v.Int()), nil
+	case v.Kind() == reflect.Pointer:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return encodeValue(v.Elem(), tag)
+	case isStruct(v):
+		out := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			ft, ok := parseFieldTag(v.Type().Field(i))
+			if !ok {
+				continue
+			}
+			fv, err := encodeValue(v.Field(i), ft)
+			if err != nil {
+				return nil, err
+			}
+			out[ft.name] = fv
+		}
+		return out, nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8:
+		if v.IsNil() {
+			return []interface{}{}, nil
+		}
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			ev, err := encodeValue(v.Index(i), fieldTag{})
+			if err != nil {
+				return nil, err
+			}
+			out[i] = ev
+		}
+		return out, nil
+	}
+	return v.Interface(), nil
+}
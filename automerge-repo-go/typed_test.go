@@ -0,0 +1,215 @@
+package repo
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type typedTask struct {
+	Title string `automerge:"title"`
+	Done  bool   `automerge:"done"`
+}
+
+type typedNote struct {
+	Title   string      `automerge:"title"`
+	Body    string      `automerge:"body,text"`
+	Views   int64       `automerge:"views,counter"`
+	Tags    []string    `automerge:"tags"`
+	Tasks   []typedTask `automerge:"tasks"`
+	Owner   *typedTask  `automerge:"owner"`
+	private string
+}
+
+func TestTypedHandleGetUpdate(t *testing.T) {
+	r := New()
+	h := NewTypedHandle[typedNote](r.NewDocHandle())
+
+	if err := h.Update(func(n *typedNote) error {
+		n.Title = "notes"
+		n.Body = "hello world"
+		n.Views = 1
+		n.Tags = []string{"a", "c"}
+		n.Tasks = []typedTask{{Title: "write"}, {Title: "test"}}
+		n.private = "ignored"
+		return nil
+	}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if v, _ := h.GetPath("body"); v != "hello world" {
+		t.Fatalf("unexpected body %v", v)
+	}
+	// stored with the requested automerge types
+	if err := h.Splice([]interface{}{"body"}, 0, 0, ">"); err != nil {
+		t.Fatalf("body is not text: %v", err)
+	}
+	if err := h.Increment([]interface{}{"views"}, 1); err != nil {
+		t.Fatalf("views is not a counter: %v", err)
+	}
+
+	before := len(mustHistory(t, h.DocumentHandle))
+	if err := h.Update(func(n *typedNote) error { return nil }); err != nil {
+		t.Fatalf("no-op Update failed: %v", err)
+	}
+	boom := errors.New("boom")
+	if err := h.Update(func(n *typedNote) error { n.Title = "x"; return boom }); !errors.Is(err, boom) {
+		t.Fatalf("expected callback error, got %v", err)
+	}
+	if after := len(mustHistory(t, h.DocumentHandle)); after != before {
+		t.Fatalf("expected no commits, got %d new", after-before)
+	}
+
+	if err := h.Update(func(n *typedNote) error {
+		n.Body = ">hello there"
+		n.Views += 3
+		n.Tags = []string{"a", "b", "c"}
+		n.Tasks[1].Done = true
+		n.Owner = &typedTask{Title: "ana"}
+		return nil
+	}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	got, err := h.Get()
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	want := typedNote{
+		Title: "notes",
+		Body:  ">hello there",
+		Views: 5,
+		Tags:  []string{"a", "b", "c"},
+		Tasks: []typedTask{{Title: "write"}, {Title: "test", Done: true}},
+		Owner: &typedTask{Title: "ana"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected value:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestTypedHandleConcurrentEditsMerge(t *testing.T) {
+	r := New()
+	h := NewTypedHandle[typedNote](r.NewDocHandle())
+	if err := h.Update(func(n *typedNote) error {
+		n.Body = "hello world"
+		n.Views = 1
+		return nil
+	}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	fork, err := h.ForkAt(h.Heads())
+	if err != nil {
+		t.Fatalf("ForkAt failed: %v", err)
+	}
+	other := NewTypedHandle[typedNote](fork)
+
+	if err := h.Update(func(n *typedNote) error {
+		n.Body = "hello brave world"
+		n.Views++
+		return nil
+	}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if err := other.Update(func(n *typedNote) error {
+		n.Body = "hello world!"
+		n.Views += 2
+		return nil
+	}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if _, err := h.doc.merge(other.doc.Doc, ChangeOrigin{Kind: OriginLocal}); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	got, err := h.Get()
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if got.Body != "hello brave world!" || got.Views != 4 {
+		t.Fatalf("edits did not merge: %+v", got)
+	}
+}
+
+func TestTypedHandleUpdateConcurrentWithDocMut(t *testing.T) {
+	h := NewTypedHandle[typedNote](New().NewDocHandle())
+	fillDoc(t, h.DocumentHandle, 2000)
+	concurrentWrites(t, h.DocumentHandle, 20, func(i int) error {
+		return h.Update(func(n *typedNote) error { n.Views++; return nil })
+	})
+	if n, err := h.Get(); err != nil || n.Views != 20 {
+		t.Fatalf("expected 20 views, got %d (%v)", n.Views, err)
+	}
+}
+
+type typedConfig struct {
+	Name  string           `automerge:"name"`
+	Attrs map[string]int64 `automerge:"attrs"`
+	Bad   chan int         `automerge:"bad"`
+}
+
+func TestTypedHandleUpdateFailureWritesNothing(t *testing.T) {
+	r := New()
+	h := NewTypedHandle[typedConfig](r.NewDocHandle())
+	if err := h.Update(func(c *typedConfig) error {
+		c.Name = "a"
+		c.Bad = make(chan int)
+		return nil
+	}); err == nil {
+		t.Fatalf("expected an error for an unsupported field")
+	}
+	if err := h.SetPath([]interface{}{"other"}, "x"); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+	if v, _ := h.GetPath("name"); v != nil {
+		t.Fatalf("failed Update left name %v in the document", v)
+	}
+}
+
+func TestTypedHandleMapMerge(t *testing.T) {
+	r := New()
+	h := NewTypedHandle[typedConfig](r.NewDocHandle())
+	if err := h.Update(func(c *typedConfig) error {
+		c.Attrs = map[string]int64{"a": 1, "b": 2, "c": 3}
+		return nil
+	}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	fork, err := h.ForkAt(h.Heads())
+	if err != nil {
+		t.Fatalf("ForkAt failed: %v", err)
+	}
+	other := NewTypedHandle[typedConfig](fork)
+
+	if err := h.Update(func(c *typedConfig) error {
+		c.Attrs["a"] = 10
+		delete(c.Attrs, "c")
+		return nil
+	}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if err := other.Update(func(c *typedConfig) error {
+		c.Attrs["b"] = 20
+		c.Attrs["d"] = 4
+		return nil
+	}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if _, err := h.doc.merge(other.doc.Doc, ChangeOrigin{Kind: OriginLocal}); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	got, err := h.Get()
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	want := map[string]int64{"a": 10, "b": 20, "d": 4}
+	if !reflect.DeepEqual(got.Attrs, want) {
+		t.Fatalf("map edits did not merge: %v", got.Attrs)
+	}
+}
+
+func mustHistory(t *testing.T, h *DocumentHandle) []ChangeInfo {
+	t.Helper()
+	history, err := h.History()
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	return history
+}
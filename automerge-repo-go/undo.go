@@ -0,0 +1,343 @@
+package repo
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+var (
+	// ErrNothingToUndo is returned by UndoManager.Undo when there is no step to undo.
+	ErrNothingToUndo = errors.New("nothing to undo")
+	// ErrNothingToRedo is returned by UndoManager.Redo when there is no step to redo.
+	ErrNothingToRedo = errors.New("nothing to redo")
+)
+
+// DefaultCaptureTimeout is how long after one local change the next is
+// still grouped into the same undo step.
+const DefaultCaptureTimeout = 500 * time.Millisecond
+
+// UndoOptions configure an UndoManager.
+type UndoOptions struct {
+	// CaptureTimeout groups local changes made within this interval of each
+	// other into one undo step. Zero means DefaultCaptureTimeout and a
+	// negative value gives every change its own step.
+	CaptureTimeout time.Duration
+}
+
+// undoStep spans one or more consecutive local changes.
+type undoStep struct {
+	before, after []automerge.ChangeHash
+}
+
+// UndoManager records the local changes made to a document through one
+// handle and undoes or redoes them as new changes by the document's actor.
+// Changes made through other handles or received from peers or storage are
+// never undone: list and text edits are inverted against
+// the version the local change produced and merged like a concurrent edit,
+// and map keys a peer has since overwritten are left alone.
+type UndoManager struct {
+	doc     *Document
+	handle  *DocumentHandle
+	timeout time.Duration
+
+	mu       sync.Mutex
+	undo     []undoStep
+	redo     []undoStep
+	lastAt   time.Time
+	boundary bool
+	// applying holds the heads of inverse changes being merged, so that the
+	// observer records them in applied rather than as new local changes.
+	applying map[automerge.ChangeHash]bool
+	applied  *undoStep
+}
+
+// NewUndoManager starts recording the local changes made through h. Call
+// Close to stop.
+func (h *DocumentHandle) NewUndoManager(opts ...UndoOptions) *UndoManager {
+	m := &UndoManager{doc: h.doc, handle: h, timeout: DefaultCaptureTimeout, applying: make(map[automerge.ChangeHash]bool)}
+	for _, o := range opts {
+		if o.CaptureTimeout != 0 {
+			m.timeout = o.CaptureTimeout
+		}
+	}
+	h.doc.ensureDoc()
+	h.doc.watchersMu.Lock()
+	if h.doc.localObservers == nil {
+		h.doc.localObservers = make(map[*DocumentHandle]map[*UndoManager]func(before, after []automerge.ChangeHash))
+	}
+	if h.doc.localObservers[h] == nil {
+		h.doc.localObservers[h] = make(map[*UndoManager]func(before, after []automerge.ChangeHash))
+	}
+	h.doc.localObservers[h][m] = m.observe
+	h.doc.watchersMu.Unlock()
+	return m
+}
+
+// Close stops recording changes.
+func (m *UndoManager) Close() {
+	m.doc.watchersMu.Lock()
+	delete(m.doc.localObservers[m.handle], m)
+	if len(m.doc.localObservers[m.handle]) == 0 {
+		delete(m.doc.localObservers, m.handle)
+	}
+	m.doc.watchersMu.Unlock()
+}
+
+// Boundary ends the current undo step, so that the next local change starts
+// a new one.
+func (m *UndoManager) Boundary() {
+	m.mu.Lock()
+	m.boundary = true
+	m.mu.Unlock()
+}
+
+// CanUndo reports whether there is a step to undo.
+func (m *UndoManager) CanUndo() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.undo) > 0
+}
+
+// CanRedo reports whether there is a step to redo.
+func (m *UndoManager) CanRedo() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.redo) > 0
+}
+
+// Undo reverts the most recent undo step with a new change.
+func (m *UndoManager) Undo() error {
+	return m.revert(&m.undo, &m.redo, "undo", ErrNothingToUndo)
+}
+
+// Redo reapplies the most recently undone step with a new change.
+func (m *UndoManager) Redo() error {
+	return m.revert(&m.redo, &m.undo, "redo", ErrNothingToRedo)
+}
+
+func (m *UndoManager) observe(before, after []automerge.ChangeHash) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, h := range after {
+		if m.applying[h] {
+			m.applied = &undoStep{before: before, after: after}
+			return
+		}
+	}
+	now := time.Now()
+	n := len(m.undo)
+	// Only extend the last step if nothing else changed the document in
+	// between, as the step's inverse would otherwise revert those changes too.
+	if n > 0 && !m.boundary && m.timeout > 0 && now.Sub(m.lastAt) < m.timeout && sameHeads(m.undo[n-1].after, before) {
+		m.undo[n-1].after = after
+	} else {
+		m.undo = append(m.undo, undoStep{before: before, after: after})
+	}
+	m.redo = nil
+	m.lastAt = now
+	m.boundary = false
+}
+
+// revert pops a step from from, applies its inverse and pushes the inverse
+// step onto to.
+func (m *UndoManager) revert(from, to *[]undoStep, msg string, empty error) error {
+	if m.doc.deleted.Load() {
+		return ErrDocumentDeleted
+	}
+	m.mu.Lock()
+	if len(*from) == 0 {
+		m.mu.Unlock()
+		return empty
+	}
+	step := (*from)[len(*from)-1]
+	*from = (*from)[:len(*from)-1]
+	m.boundary = true
+	m.mu.Unlock()
+
+	var head automerge.ChangeHash
+	err := m.doc.withLocalFork(m.handle.origin(), func(cur *automerge.Doc) (bool, error) {
+		ok, err := m.doc.inverse(cur, step, msg)
+		if err != nil || !ok {
+			return false, err
+		}
+		head = cur.Heads()[0]
+		m.mu.Lock()
+		m.applying[head] = true
+		m.mu.Unlock()
+		return true, nil
+	})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.applying, head)
+	applied := m.applied
+	m.applied = nil
+	if err != nil {
+		*from = append(*from, step)
+		return err
+	}
+	// applied stays nil when the step no longer changes anything
+	if applied != nil {
+		*to = append(*to, *applied)
+	}
+	return nil
+}
+
+// inverse commits to cur, a local fork of the document, a single change that
+// takes the document from step.after back to step.before, and reports
+// whether there was anything left to revert. List and text edits are made on
+// a scratch fork at step.after, so their positions refer to that version,
+// and merged into the current version like a concurrent edit; the result is
+// then replayed on cur, so that undo does not add an actor to the document.
+// Map keys are set on cur instead, since a write concurrent with a later one
+// to the same key may lose; a key is only reverted while it still holds the
+// value step.after gave it. The caller must hold d.mutMu, so that cur and the
+// merged version start from the same heads.
+func (d *Document) inverse(cur *automerge.Doc, step undoStep, msg string) (bool, error) {
+	base, err := d.Doc.Fork(step.after...)
+	if err != nil {
+		return false, err
+	}
+	target := automerge.New()
+	if len(step.before) > 0 {
+		if target, err = d.Doc.Fork(step.before...); err != nil {
+			return false, err
+		}
+	}
+	var keys, elems []Patch
+	for _, p := range diffDocs(base, target) {
+		switch {
+		case !isKeyPath(p.Path) || p.Action == PatchIncrement:
+			elems = append(elems, p)
+		case unchanged(base, cur, p.Path):
+			keys = append(keys, p)
+		}
+	}
+	changed := len(keys) > 0
+	if len(elems) > 0 {
+		if err := applyPatches(base, target, elems); err != nil {
+			return false, err
+		}
+		if _, err := base.Commit(msg); err != nil {
+			return false, err
+		}
+		merged, err := d.Doc.Fork()
+		if err != nil {
+			return false, err
+		}
+		if _, err := merged.Merge(base); err != nil {
+			return false, err
+		}
+		replay := diffDocs(cur, merged)
+		if err := applyPatches(cur, merged, replay); err != nil {
+			return false, err
+		}
+		changed = changed || len(replay) > 0
+	}
+	if !changed {
+		return false, nil
+	}
+	if err := applyPatches(cur, target, keys); err != nil {
+		return false, err
+	}
+	if _, err := cur.Commit(msg); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// isKeyPath reports whether path names a map key reached through maps only.
+func isKeyPath(path []interface{}) bool {
+	for _, p := range path {
+		if _, ok := p.(string); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// unchanged reports whether a and b hold the same value at path.
+func unchanged(a, b *automerge.Doc, path []interface{}) bool {
+	va, errA := resolvePath(a, "", path, false)
+	vb, errB := resolvePath(b, "", path, false)
+	if errA != nil || errB != nil {
+		return errA != nil && errB != nil
+	}
+	var patches []Patch
+	diffValues(&patches, path, va, vb)
+	return len(patches) == 0
+}
+
+// applyPatches applies patches computed by Diff to doc. Values are copied
+// from src, the version the patches lead to, so that text and counters keep
+// their types.
+func applyPatches(doc, src *automerge.Doc, patches []Patch) error {
+	for _, p := range patches {
+		if err := applyPatch(doc, src, p); err != nil {
+			return &PathError{Op: string(p.Action), Path: p.Path, Err: err}
+		}
+	}
+	return nil
+}
+
+func applyPatch(doc, src *automerge.Doc, p Patch) error {
+	last := p.Path[len(p.Path)-1]
+	parent, err := resolvePath(doc, string(p.Action), p.Path[:len(p.Path)-1], false)
+	if err != nil {
+		return err
+	}
+	source := func(path []interface{}) (interface{}, error) {
+		v, err := resolvePath(src, string(p.Action), path, false)
+		if err != nil {
+			return nil, err
+		}
+		return copyValue(v), nil
+	}
+	switch p.Action {
+	case PatchPut:
+		v, err := source(p.Path)
+		if err != nil {
+			return err
+		}
+		if key, ok := last.(string); ok {
+			return parent.Map().Set(key, v)
+		}
+		return parent.List().Set(last.(int), v)
+	case PatchDelete:
+		if key, ok := last.(string); ok {
+			return parent.Map().Delete(key)
+		}
+		i := last.(int)
+		if parent.Kind() == automerge.KindText {
+			return parent.Text().Delete(i, p.Length)
+		}
+		for n := 0; n < p.Length; n++ {
+			if err := parent.List().Delete(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	case PatchInsert:
+		i := last.(int)
+		values := make([]interface{}, 0, len(p.Value.([]interface{})))
+		for n := range p.Value.([]interface{}) {
+			v, err := source(append(append([]interface{}{}, p.Path[:len(p.Path)-1]...), i+n))
+			if err != nil {
+				return err
+			}
+			values = append(values, v)
+		}
+		return parent.List().Insert(i, values...)
+	case PatchSplice:
+		return parent.Text().Insert(last.(int), p.Value.(string))
+	case PatchIncrement:
+		v, err := resolvePath(doc, string(p.Action), p.Path, false)
+		if err != nil {
+			return err
+		}
+		return v.Counter().Inc(p.Value.(int64))
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+func TestUndoManagerMaps(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+	m := h.NewUndoManager()
+	defer m.Close()
+
+	if err := h.SetPath([]interface{}{"title"}, "a"); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+	m.Boundary()
+	if err := h.SetPath([]interface{}{"title"}, "b"); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+
+	steps := []struct {
+		op   func() error
+		want interface{}
+	}{
+		{m.Undo, "a"},
+		{m.Undo, nil},
+		{m.Redo, "a"},
+		{m.Redo, "b"},
+	}
+	for i, s := range steps {
+		if err := s.op(); err != nil {
+			t.Fatalf("step %d failed: %v", i, err)
+		}
+		if v, _ := h.GetPath("title"); v != s.want {
+			t.Fatalf("step %d: expected %v, got %v", i, s.want, v)
+		}
+	}
+	if err := m.Redo(); !errors.Is(err, ErrNothingToRedo) {
+		t.Fatalf("expected ErrNothingToRedo, got %v", err)
+	}
+
+	// a new change clears the redo stack
+	if err := m.Undo(); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	if err := h.SetPath([]interface{}{"title"}, "c"); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+	if m.CanRedo() {
+		t.Fatalf("expected redo stack cleared")
+	}
+}
+
+func TestUndoManagerGrouping(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+	grouped := h.NewUndoManager(UndoOptions{CaptureTimeout: time.Hour})
+	defer grouped.Close()
+	single := h.NewUndoManager(UndoOptions{CaptureTimeout: -1})
+	defer single.Close()
+
+	for _, k := range []string{"a", "b", "c"} {
+		if err := h.SetPath([]interface{}{k}, true); err != nil {
+			t.Fatalf("SetPath failed: %v", err)
+		}
+	}
+	if len(grouped.undo) != 1 || len(single.undo) != 3 {
+		t.Fatalf("expected 1 and 3 steps, got %d and %d", len(grouped.undo), len(single.undo))
+	}
+	if err := grouped.Undo(); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	if js, _ := h.JSON(); string(js) != `{}` {
+		t.Fatalf("expected all grouped changes undone, got %s", js)
+	}
+}
+
+func TestUndoManagerKeepsRemoteChanges(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+	if err := h.WithDocMut(func(doc *automerge.Doc) error {
+		if err := doc.RootMap().Set("items", []string{"a", "b"}); err != nil {
+			return err
+		}
+		return doc.RootMap().Set("body", automerge.NewText("hello world"))
+	}); err != nil {
+		t.Fatalf("WithDocMut failed: %v", err)
+	}
+	m := h.NewUndoManager()
+	defer m.Close()
+
+	if err := h.Insert([]interface{}{"items"}, 2, "c"); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := h.Splice([]interface{}{"body"}, 5, 6, ""); err != nil {
+		t.Fatalf("Splice failed: %v", err)
+	}
+
+	// a peer edits the same list and text concurrently
+	remote, err := h.doc.Doc.Fork()
+	if err != nil {
+		t.Fatalf("Fork failed: %v", err)
+	}
+	items, _ := remote.RootMap().Get("items")
+	if err := items.List().Insert(0, "z"); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	body, _ := remote.RootMap().Get("body")
+	if err := body.Text().Insert(0, "*"); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := remote.RootMap().Set("owner", "sam"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if _, err := remote.Commit("remote"); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if _, err := h.doc.merge(remote, ChangeOrigin{Kind: OriginPeer}); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+
+	if err := m.Undo(); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	js, err := h.JSON()
+	if err != nil {
+		t.Fatalf("JSON failed: %v", err)
+	}
+	if want := `{"body":"*hello world","items":["z","a","b"],"owner":"sam"}`; string(js) != want {
+		t.Fatalf("unexpected document after undo:\n got %s\nwant %s", js, want)
+	}
+	if err := m.Redo(); err != nil {
+		t.Fatalf("Redo failed: %v", err)
+	}
+	js, _ = h.JSON()
+	if want := `{"body":"*hello","items":["z","a","b","c"],"owner":"sam"}`; string(js) != want {
+		t.Fatalf("unexpected document after redo:\n got %s\nwant %s", js, want)
+	}
+	if err := h.Splice([]interface{}{"body"}, 0, 1, ""); err != nil {
+		t.Fatalf("body is no longer text: %v", err)
+	}
+}
+
+func TestUndoManagerConcurrentRemoteChanges(t *testing.T) {
+	h := New().NewDocHandle()
+	fillDoc(t, h, 500)
+	if err := h.SetPath([]interface{}{"items"}, []string{"a"}); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+	m := h.NewUndoManager()
+	defer m.Close()
+	if err := h.Insert([]interface{}{"items"}, 1, "b"); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+
+	// a peer keeps inserting while the step is undone and redone; none of
+	// its items may be copied into the local inverse changes
+	const n = 50
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			remote, err := h.doc.fork()
+			if err != nil {
+				done <- err
+				return
+			}
+			items, _ := remote.RootMap().Get("items")
+			if err := items.List().Insert(0, "p"); err != nil {
+				done <- err
+				return
+			}
+			if _, err := remote.Commit("remote"); err != nil {
+				done <- err
+				return
+			}
+			if _, err := h.doc.merge(remote, ChangeOrigin{Kind: OriginPeer}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < n; i++ {
+		revert := m.Undo
+		if i%2 == 1 {
+			revert = m.Redo
+		}
+		if err := revert(); err != nil {
+			t.Fatalf("undo/redo %d failed: %v", i, err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("remote change failed: %v", err)
+	}
+	items, err := h.GetPath("items")
+	if err != nil {
+		t.Fatalf("GetPath failed: %v", err)
+	}
+	peer := 0
+	for _, v := range items.([]interface{}) {
+		if v == "p" {
+			peer++
+		}
+	}
+	if peer != n {
+		t.Fatalf("expected %d peer items, got %d: %v", n, peer, items)
+	}
+}
+
+func TestUndoManagerPerHandle(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+	other, _ := r.GetDocHandle(h.DocID())
+	m := h.NewUndoManager()
+	defer m.Close()
+
+	if err := h.SetPath([]interface{}{"items"}, []string{"a"}); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+	m.Boundary()
+	if err := h.Insert([]interface{}{"items"}, 1, "b"); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := other.SetPath([]interface{}{"owner"}, "sam"); err != nil {
+		t.Fatalf("SetPath failed: %v", err)
+	}
+	if len(m.undo) != 2 {
+		t.Fatalf("expected 2 steps from h only, got %d", len(m.undo))
+	}
+	for _, op := range []func() error{m.Undo, m.Redo, m.Undo, m.Redo, m.Undo} {
+		if err := op(); err != nil {
+			t.Fatalf("undo/redo failed: %v", err)
+		}
+	}
+	if js, _ := h.JSON(); string(js) != `{"items":["a"],"owner":"sam"}` {
+		t.Fatalf("unexpected document %s", js)
+	}
+	for _, c := range mustHistory(t, h) {
+		if c.Actor != h.doc.Doc.ActorID() {
+			t.Fatalf("undo added actor %s", c.Actor)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+// TypeKey is the root key that names a document's type for WithTypeSchema.
+const TypeKey = "@type"
+
+// ErrSchemaViolation is matched by every ValidationError.
+var ErrSchemaViolation = errors.New("schema violation")
+
+// ValidationError reports that a document does not match its schema.
+type ValidationError struct {
+	DocumentID DocumentID
+	Errors     []SchemaError
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Errors) == 1 {
+		return fmt.Sprintf("document %s violates its schema: %v", e.DocumentID, e.Errors[0])
+	}
+	return fmt.Sprintf("document %s violates its schema: %v (and %d more)", e.DocumentID, e.Errors[0], len(e.Errors)-1)
+}
+
+// Is reports whether target is ErrSchemaViolation.
+func (e *ValidationError) Is(target error) bool { return target == ErrSchemaViolation }
+
+// WithSchema attaches s to the document id. A nil schema detaches it. A
+// document schema takes precedence over a type schema.
+//
+// Local changes made through a DocumentHandle that would violate the schema
+// fail with a *ValidationError and are not committed. A type schema applies to
+// local changes once the document has its type; documents without a schema
+// are changed in place without validation. Changes received from
+// peers that violate it are reported with an EventValidationFailed event and,
+// on a strict repo, kept out of the document.
+func (r *Repo) WithSchema(id DocumentID, s *Schema) *Repo {
+	r.mu.Lock()
+	if s == nil {
+		delete(r.schemas, id)
+	} else {
+		r.schemas[id] = s
+	}
+	r.mu.Unlock()
+	return r
+}
+
+// WithTypeSchema attaches s to every document whose TypeKey root value is typ.
+// A nil schema detaches it.
+func (r *Repo) WithTypeSchema(typ string, s *Schema) *Repo {
+	r.mu.Lock()
+	if s == nil {
+		delete(r.typeSchemas, typ)
+	} else {
+		r.typeSchemas[typ] = s
+	}
+	r.mu.Unlock()
+	return r
+}
+
+// WithStrictSchemas makes the repo quarantine sync changes that violate a
+// schema instead of applying them. Quarantined changes are listed by
+// Quarantined.
+func (r *Repo) WithStrictSchemas(strict bool) *Repo {
+	r.mu.Lock()
+	r.strictSchemas = strict
+	r.mu.Unlock()
+	return r
+}
+
+// MaxQuarantined is the number of refused changes a strict repo keeps per
+// document. Older ones are forgotten first.
+const MaxQuarantined = 256
+
+// Quarantined returns the changes to the document that a strict repo
+// refused because they violated its schema, oldest first.
+func (r *Repo) Quarantined(id DocumentID) []ChangeInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	changes := r.quarantine[id]
+	infos := make([]ChangeInfo, len(changes))
+	for i, c := range changes {
+		infos[i] = newChangeInfo(c)
+	}
+	return infos
+}
+
+// quarantined returns the hashes of the document's quarantined changes.
+func (r *Repo) quarantined(id DocumentID) map[automerge.ChangeHash]bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	hashes := make(map[automerge.ChangeHash]bool, len(r.quarantine[id]))
+	for _, c := range r.quarantine[id] {
+		hashes[c.Hash()] = true
+	}
+	return hashes
+}
+
+// addQuarantine quarantines changes that are not quarantined yet, keeping at
+// most MaxQuarantined per document.
+func (r *Repo) addQuarantine(id DocumentID, changes []*automerge.Change) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	q := r.quarantine[id]
+	for _, c := range changes {
+		dup := false
+		for _, old := range q {
+			if old.Hash() == c.Hash() {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			q = append(q, c)
+		}
+	}
+	if len(q) > MaxQuarantined {
+		q = append([]*automerge.Change(nil), q[len(q)-MaxQuarantined:]...)
+	}
+	r.quarantine[id] = q
+}
+
+// hasSchemas reports whether any schema could apply to the document once
+// changes from elsewhere, which may set its type, are applied.
+func (r *Repo) hasSchemas(id DocumentID) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.schemas[id]
+	return ok || len(r.typeSchemas) > 0
+}
+
+// schemaFor returns the schema that applies to doc as it is now, or nil.
+func (r *Repo) schemaFor(id DocumentID, doc *automerge.Doc) *Schema {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if s, ok := r.schemas[id]; ok {
+		return s
+	}
+	if len(r.typeSchemas) == 0 || doc == nil {
+		return nil
+	}
+	if typ, err := automerge.As[string](doc.RootMap().Get(TypeKey)); err == nil {
+		return r.typeSchemas[typ]
+	}
+	return nil
+}
+
+// validate checks doc against the schema that applies to the document id.
+func (r *Repo) validate(id DocumentID, doc *automerge.Doc) error {
+	s := r.schemaFor(id, doc)
+	if s == nil {
+		return nil
+	}
+	if errs := s.Validate(doc.Root().Interface()); len(errs) > 0 {
+		return &ValidationError{DocumentID: id, Errors: errs}
+	}
+	return nil
+}
+
+// validateSync checks the changes carried by a sync message against the
+// document's schema. It reports whether the message may be applied, and the
+// violation if any.
+//
+// When a strict repo finds a violation it checks the changes one at a time,
+// applies those that keep the document valid directly to it, and
+// quarantines the rest along with the changes that depend on them. The sync
+// message itself is then not applied, but the caller still replies to it so
+// that the sync round goes on from the accepted changes.
+func (r *Repo) validateSync(doc *Document, msg []byte, origin ChangeOrigin) (bool, error) {
+	if !r.hasSchemas(doc.ID) {
+		return true, nil
+	}
+	sm, err := automerge.LoadSyncMessage(msg)
+	if err != nil {
+		return true, nil
+	}
+	changes := sm.Changes()
+	if len(changes) == 0 {
+		return true, nil
+	}
+	fork, err := doc.fork()
+	if err != nil {
+		return true, nil
+	}
+	if err := fork.Apply(changes...); err != nil {
+		return true, nil
+	}
+	verr := r.validate(doc.ID, fork)
+	if verr == nil {
+		return true, nil
+	}
+	r.mu.RLock()
+	strict := r.strictSchemas
+	r.mu.RUnlock()
+	if !strict {
+		return true, verr
+	}
+
+	rejected := r.quarantined(doc.ID)
+	var valid, refused []*automerge.Change
+	accepted, err := doc.fork()
+	if err != nil {
+		return false, verr
+	}
+	for _, c := range changes {
+		if rejected[c.Hash()] || dependsOn(c, rejected) {
+			rejected[c.Hash()] = true
+			refused = append(refused, c)
+			continue
+		}
+		trial, err := accepted.Fork()
+		if err == nil {
+			err = applyChanges(trial, c)
+		}
+		if err == nil {
+			err = r.validate(doc.ID, trial)
+		}
+		if err != nil {
+			rejected[c.Hash()] = true
+			refused = append(refused, c)
+			continue
+		}
+		accepted = trial
+		valid = append(valid, c)
+	}
+	r.addQuarantine(doc.ID, refused)
+	if len(valid) > 0 {
+		doc.mutMu.Lock()
+		before := doc.Doc.Heads()
+		err := applyChanges(doc.Doc, valid...)
+		after := doc.Doc.Heads()
+		doc.mutMu.Unlock()
+		if err == nil && !sameHeads(before, after) {
+			doc.changed(before, after, origin)
+		}
+	}
+	return false, verr
+}
+
+// applyChanges applies changes one at a time. Doc.Apply applies every change
+// that was loaded together with the ones it is given, so changes from a sync
+// message are applied from their own bytes instead.
+func applyChanges(doc *automerge.Doc, changes ...*automerge.Change) error {
+	for _, c := range changes {
+		if err := doc.LoadIncremental(c.Save()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dependsOn reports whether c directly depends on a change in hashes.
+func dependsOn(c *automerge.Change, hashes map[automerge.ChangeHash]bool) bool {
+	for _, d := range c.Dependencies() {
+		if hashes[d] {
+			return true
+		}
+	}
+	return false
+}
+
+// localFork returns a fork of the document that commits as the document's
+// own actor, so that its changes can be merged back as local changes.
+// Callers must hold d.mutMu until the fork is merged back; see withLocalFork.
+func (d *Document) localFork() (*automerge.Doc, error) {
+	d.ensureDoc()
+	fork, err := d.Doc.Fork()
+	if err != nil {
+		return nil, err
+	}
+	if err := fork.SetActorID(d.Doc.ActorID()); err != nil {
+		return nil, err
+	}
+	return fork, nil
+}
+
+// withLocalFork runs f on a local fork of the document and, if f reports
+// that it committed something, merges the fork back as a change from origin.
+// The document's writer lock is held from the fork to the merge: a change
+// committed to the document in between would reuse the fork's actor and
+// sequence number, and automerge would then refuse the fork's change.
+func (d *Document) withLocalFork(origin ChangeOrigin, f func(fork *automerge.Doc) (bool, error)) error {
+	d.ensureDoc()
+	d.mutMu.Lock()
+	fork, err := d.localFork()
+	merge := false
+	if err == nil {
+		merge, err = f(fork)
+	}
+	var before, after []automerge.ChangeHash
+	if err == nil && merge {
+		before = d.Doc.Heads()
+		_, err = d.Doc.Merge(fork)
+		after = d.Doc.Heads()
+	}
+	d.mutMu.Unlock()
+	if err != nil || sameHeads(before, after) {
+		return err
+	}
+	d.changed(before, after, origin)
+	return nil
+}
+
+// withValidatedDocMut runs f on a fork of the document and merges the commit
+// back only if the result matches the document's schema, as automerge cannot
+// roll back uncommitted operations.
+func (h *DocumentHandle) withValidatedDocMut(f func(*automerge.Doc) error, msg string, opts []automerge.CommitOptions) error {
+	return h.doc.withLocalFork(h.origin(), func(fork *automerge.Doc) (bool, error) {
+		if err := f(fork); err != nil {
+			return false, err
+		}
+		if err := h.repo.validate(h.doc.ID, fork); err != nil {
+			return false, err
+		}
+		if _, err := fork.Commit(msg, opts...); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
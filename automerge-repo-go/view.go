@@ -0,0 +1,95 @@
+package repo
+
+import (
+	"bytes"
+	"fmt"
+
+	automerge "github.com/automerge/automerge-go"
+	"github.com/google/uuid"
+)
+
+// DocumentView is a read-only snapshot of a document as of a set of heads.
+// It is independent of the document it was taken from and does not change
+// when that document does.
+type DocumentView struct {
+	heads []automerge.ChangeHash
+	doc   *Document
+}
+
+// ViewAt returns a read-only view of the document as it was at heads. With no
+// heads the view shows the document's current state.
+func (h *DocumentHandle) ViewAt(heads []automerge.ChangeHash) (*DocumentView, error) {
+	fork, err := h.forkAt(heads)
+	if err != nil {
+		return nil, err
+	}
+	return &DocumentView{heads: fork.Heads(), doc: &Document{ID: h.doc.ID, Doc: fork}}, nil
+}
+
+// ForkAt creates a new document in the repo containing the history of this
+// document up to heads and returns a handle to it. The fork has its own ID
+// and actor and does not sync with the original.
+func (h *DocumentHandle) ForkAt(heads []automerge.ChangeHash) (*DocumentHandle, error) {
+	if h.repo == nil {
+		return nil, fmt.Errorf("document %s is not in a repo", h.doc.ID)
+	}
+	fork, err := h.forkAt(heads)
+	if err != nil {
+		return nil, err
+	}
+	doc := &Document{ID: uuid.New(), Doc: fork}
+	doc.pin(pinHandle)
+	h.repo.putDoc(doc)
+	return &DocumentHandle{doc: doc, repo: h.repo}, nil
+}
+
+func (h *DocumentHandle) forkAt(heads []automerge.ChangeHash) (*automerge.Doc, error) {
+	h.doc.ensureDoc()
+	fork, err := h.doc.fork(heads...)
+	if err != nil {
+		return nil, fmt.Errorf("forking document %s: %w", h.doc.ID, err)
+	}
+	return fork, nil
+}
+
+// DocumentID returns the ID of the document the view was taken from.
+func (v *DocumentView) DocumentID() DocumentID {
+	return v.doc.ID
+}
+
+// Heads returns the heads the view was taken at.
+func (v *DocumentView) Heads() []automerge.ChangeHash {
+	return v.heads
+}
+
+// Get retrieves a value from the view.
+func (v *DocumentView) Get(key string) (interface{}, bool) {
+	return v.doc.Get(key)
+}
+
+// Map returns the view's contents as a map.
+func (v *DocumentView) Map() (map[string]interface{}, error) {
+	return v.doc.Map()
+}
+
+// JSON returns the view's contents encoded as JSON.
+func (v *DocumentView) JSON() ([]byte, error) {
+	return v.doc.JSON()
+}
+
+// JSON returns the document's contents encoded as canonical JSON. See
+// DocumentHandle.JSON.
+func (d *Document) JSON() ([]byte, error) {
+	m, err := d.Map()
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		m = map[string]interface{}{}
+	}
+	var buf bytes.Buffer
+	if err := encodeJSON(&buf, m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
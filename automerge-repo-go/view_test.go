@@ -0,0 +1,80 @@
+package repo
+
+import (
+	"testing"
+
+	automerge "github.com/automerge/automerge-go"
+)
+
+func TestDocumentHandleViewAt(t *testing.T) {
+	r := New()
+	h := r.NewDocHandle()
+
+	if err := h.WithDocMut(func(doc *automerge.Doc) error {
+		return doc.RootMap().Set("status", "draft")
+	}); err != nil {
+		t.Fatalf("WithDocMut failed: %v", err)
+	}
+	draft := h.Heads()
+	if err := h.WithDocMut(func(doc *automerge.Doc) error {
+		if err := doc.RootMap().Set("status", "published"); err != nil {
+			return err
+		}
+		return doc.RootMap().Set("reviewer", "sam")
+	}); err != nil {
+		t.Fatalf("WithDocMut failed: %v", err)
+	}
+
+	view, err := h.ViewAt(draft)
+	if err != nil {
+		t.Fatalf("ViewAt failed: %v", err)
+	}
+	if v, _ := view.Get("status"); v != "draft" {
+		t.Fatalf("expected draft status in view, got %v", v)
+	}
+	if v, _ := view.Get("reviewer"); v != nil {
+		t.Fatalf("expected no reviewer in view, got %v", v)
+	}
+	js, err := view.JSON()
+	if err != nil {
+		t.Fatalf("JSON failed: %v", err)
+	}
+	if string(js) != `{"status":"draft"}` {
+		t.Fatalf("unexpected JSON %s", js)
+	}
+	if !sameHeads(view.Heads(), draft) || view.DocumentID() != h.DocID() {
+		t.Fatalf("unexpected view identity")
+	}
+
+	// the live document is unaffected
+	h.WithDoc(func(doc *automerge.Doc) {
+		v, _ := automerge.As[string](doc.RootMap().Get("status"))
+		if v != "published" {
+			t.Fatalf("expected published status, got %v", v)
+		}
+	})
+
+	fork, err := h.ForkAt(draft)
+	if err != nil {
+		t.Fatalf("ForkAt failed: %v", err)
+	}
+	defer fork.Close()
+	if fork.DocID() == h.DocID() {
+		t.Fatalf("fork shares the original's ID")
+	}
+	if _, ok := r.GetDoc(fork.DocID()); !ok {
+		t.Fatalf("fork not added to repo")
+	}
+	if err := fork.WithDocMut(func(doc *automerge.Doc) error {
+		return doc.RootMap().Set("status", "rework")
+	}); err != nil {
+		t.Fatalf("WithDocMut on fork failed: %v", err)
+	}
+	if v, _ := view.Get("status"); v != "draft" {
+		t.Fatalf("view changed after fork edit: %v", v)
+	}
+
+	if _, err := h.ViewAt([]automerge.ChangeHash{{1}}); err == nil {
+		t.Fatalf("expected error for unknown heads")
+	}
+}
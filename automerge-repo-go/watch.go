@@ -0,0 +1,95 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// WatchStorage merges documents that other writers change in the store into
+// the repo. The store must implement WatchableStorage. Changed documents held
+// in memory are merged using automerge's merge, which fires the normal change
+// notifications; documents the repo has not seen before are added. onChange,
+// if not nil, is called for every document that changed. The returned channel
+// is closed once the watcher stops after ctx is canceled.
+func (r *Repo) WatchStorage(ctx context.Context, onChange func(DocumentID)) (<-chan struct{}, error) {
+	ws, ok := r.store.(WatchableStorage)
+	if !ok {
+		return nil, fmt.Errorf("store does not support watching")
+	}
+	ch, err := ws.Watch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for id := range ch {
+			changed, err := r.mergeFromStore(id)
+			if err != nil {
+				log.Printf("watch: merging %s: %v", id, err)
+				continue
+			}
+			if changed && onChange != nil {
+				onChange(id)
+			}
+		}
+	}()
+	return done, nil
+}
+
+// mergeFromStore merges the stored copy of a document into memory and reports
+// whether the in-memory document changed.
+func (r *Repo) mergeFromStore(id DocumentID) (bool, error) {
+	r.mu.RLock()
+	doc, resident := r.docs[id]
+	if resident {
+		doc.pin(pinSync)
+		defer doc.unpin(pinSync)
+	}
+	_, evicted := r.evicted[id]
+	_, deleted := r.deleted[id]
+	r.mu.RUnlock()
+	if evicted || deleted {
+		// evicted documents pick up the new contents when they are reloaded
+		return false, nil
+	}
+	stored, err := r.store.Load(id)
+	if err != nil {
+		return false, err
+	}
+	if !resident {
+		r.mu.Lock()
+		if _, ok := r.docs[id]; ok {
+			r.mu.Unlock()
+			return r.mergeFromStore(id)
+		}
+		r.docs[id] = stored
+		r.mu.Unlock()
+		stored.touch()
+		r.evictIfNeeded(id)
+		return true, nil
+	}
+	return doc.merge(stored.Doc, ChangeOrigin{Kind: OriginStorage})
+}
+
+// WatchStorage merges documents changed in the store by other writers, as
+// Repo.WatchStorage does, and syncs every changed document to connected peers.
+func (h *RepoHandle) WatchStorage(ctx context.Context) (<-chan struct{}, error) {
+	return h.Repo.WatchStorage(ctx, h.syncToPeers)
+}
+
+// syncToPeers sends sync messages for the document to every connected peer.
+func (h *RepoHandle) syncToPeers(id DocumentID) {
+	h.mu.Lock()
+	remotes := make([]RepoID, 0, len(h.peers))
+	for remote := range h.peers {
+		remotes = append(remotes, remote)
+	}
+	h.mu.Unlock()
+	for _, remote := range remotes {
+		if err := h.SyncDocument(remote, id); err != nil {
+			log.Printf("watch: syncing %s to %s: %v", id, remote, err)
+		}
+	}
+}
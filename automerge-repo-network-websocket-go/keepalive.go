@@ -0,0 +1,195 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/automerge/automerge-repo-go"
+	"github.com/gorilla/websocket"
+)
+
+// DefaultCloseTimeout is how long Close waits for the peer to answer the
+// close frame unless Keepalive.CloseTimeout says otherwise.
+const DefaultCloseTimeout = time.Second
+
+// Keepalive configures liveness checks for a websocket connection. Zero
+// fields disable the corresponding check.
+type Keepalive struct {
+	// PingInterval is how often a ping is sent.
+	PingInterval time.Duration
+	// PongTimeout is how long after a ping the connection waits for the pong,
+	// or any other frame, before receives fail with repo.ErrConnTimeout.
+	// Zero means PingInterval.
+	PongTimeout time.Duration
+	// IdleTimeout closes the connection with status CloseGoingAway once no
+	// message has been sent or received for this long. Pings and pongs do
+	// not count as messages.
+	IdleTimeout time.Duration
+	// CloseTimeout bounds how long Close waits for the peer's close frame.
+	// Zero means DefaultCloseTimeout.
+	CloseTimeout time.Duration
+}
+
+// DefaultKeepalive pings every 30 seconds and gives up on peers that do not
+// answer within 10 seconds. Connections made by DialWebSocket and
+// AcceptWebSocket use it unless their options say otherwise.
+var DefaultKeepalive = Keepalive{PingInterval: 30 * time.Second, PongTimeout: 10 * time.Second}
+
+// keepalive runs the liveness checks and the close handshake of a websocket
+// connection.
+type keepalive struct {
+	c   *websocket.Conn
+	cfg Keepalive
+
+	// active holds the time of the last message in unix nanoseconds.
+	active atomic.Int64
+	idle   atomic.Bool
+	// reading counts receives in progress and readDone is signalled when
+	// one fails, so that Close knows whether to wait for the peer's close
+	// frame.
+	reading  atomic.Int32
+	readDone chan struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	// restart stops the goroutine of the previous start.
+	restart chan struct{}
+}
+
+func newKeepalive(c *websocket.Conn) *keepalive {
+	k := &keepalive{c: c, readDone: make(chan struct{}, 1), stop: make(chan struct{})}
+	k.touch()
+	return k
+}
+
+// start applies cfg and starts the goroutine that sends pings and watches
+// for idleness, replacing the checks of any earlier call.
+func (k *keepalive) start(cfg Keepalive) {
+	if cfg.PongTimeout <= 0 {
+		cfg.PongTimeout = cfg.PingInterval
+	}
+	if k.restart != nil {
+		close(k.restart)
+	}
+	k.restart = make(chan struct{})
+	k.cfg = cfg
+	if cfg.PingInterval > 0 {
+		k.extend()
+		k.c.SetPongHandler(func(string) error {
+			k.extend()
+			return nil
+		})
+	} else {
+		_ = k.c.SetReadDeadline(time.Time{})
+		k.c.SetPongHandler(nil)
+	}
+	if cfg.PingInterval > 0 || cfg.IdleTimeout > 0 {
+		go k.run(cfg, k.restart)
+	}
+}
+
+func (k *keepalive) run(cfg Keepalive, restart <-chan struct{}) {
+	var ping, idle <-chan time.Time
+	if cfg.PingInterval > 0 {
+		t := time.NewTicker(cfg.PingInterval)
+		defer t.Stop()
+		ping = t.C
+	}
+	if cfg.IdleTimeout > 0 {
+		t := time.NewTicker(cfg.IdleTimeout / 4)
+		defer t.Stop()
+		idle = t.C
+	}
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-restart:
+			return
+		case <-ping:
+			if err := k.c.WriteControl(websocket.PingMessage, nil, time.Now().Add(cfg.PongTimeout)); err != nil {
+				return
+			}
+		case <-idle:
+			if time.Since(time.Unix(0, k.active.Load())) >= cfg.IdleTimeout {
+				k.idle.Store(true)
+				_ = k.close(websocket.CloseGoingAway, "idle timeout")
+				return
+			}
+		}
+	}
+}
+
+// touch records message activity.
+func (k *keepalive) touch() {
+	k.active.Store(time.Now().UnixNano())
+}
+
+// extend pushes the read deadline out to the next expected pong.
+func (k *keepalive) extend() {
+	if k.cfg.PingInterval > 0 {
+		_ = k.c.SetReadDeadline(time.Now().Add(k.cfg.PingInterval + k.cfg.PongTimeout))
+	}
+}
+
+// read reads the next message.
+func (k *keepalive) read() ([]byte, error) {
+	k.reading.Add(1)
+	_, data, err := k.c.ReadMessage()
+	k.reading.Add(-1)
+	if err != nil {
+		select {
+		case k.readDone <- struct{}{}:
+		default:
+		}
+		return nil, k.err(err)
+	}
+	k.touch()
+	k.extend()
+	return data, nil
+}
+
+// write writes data as a binary message. Callers serialise writes.
+func (k *keepalive) write(data []byte) error {
+	if err := k.c.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		return err
+	}
+	k.touch()
+	return nil
+}
+
+// err maps read errors caused by the keepalive to repo.ErrConnTimeout.
+func (k *keepalive) err(err error) error {
+	if k.idle.Load() {
+		return fmt.Errorf("%w: idle for %v", repo.ErrConnTimeout, k.cfg.IdleTimeout)
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return fmt.Errorf("%w: %v", repo.ErrConnTimeout, err)
+	}
+	return readErr(err)
+}
+
+// close sends a close frame with code and text, waits for the peer's close
+// frame if a receive is in progress and closes the connection.
+func (k *keepalive) close(code int, text string) error {
+	k.stopOnce.Do(func() { close(k.stop) })
+	timeout := k.cfg.CloseTimeout
+	if timeout <= 0 {
+		timeout = DefaultCloseTimeout
+	}
+	err := k.c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(timeout))
+	if err == nil && k.reading.Load() > 0 {
+		t := time.NewTimer(timeout)
+		select {
+		case <-k.readDone:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+	return k.c.Close()
+}
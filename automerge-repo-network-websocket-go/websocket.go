@@ -2,6 +2,7 @@ package network
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -15,19 +16,46 @@ import (
 )
 
 type handshakeMessage struct {
-	Type     string `cbor:"type"`
-	SenderID string `cbor:"senderId"`
+	Type         string            `cbor:"type"`
+	SenderID     string            `cbor:"senderId"`
+	PeerMetadata repo.PeerMetadata `cbor:"peerMetadata,omitempty"`
 }
 
 // WSConn wraps a websocket connection for sending CBOR messages.
 type WSConn struct {
-	c  *websocket.Conn
-	mu sync.Mutex
+	c        *websocket.Conn
+	ka       *keepalive
+	mu       sync.Mutex
+	identity *repo.Identity
 }
 
 // NewWSConn creates a new WSConn.
 func NewWSConn(c *websocket.Conn) *WSConn {
-	return &WSConn{c: c}
+	c.SetReadLimit(repo.DefaultMaxFrameSize)
+	return &WSConn{c: c, ka: newKeepalive(c)}
+}
+
+// SetKeepalive enables pings, pong-based liveness detection and the idle
+// timeout described by k, replacing the keepalive the connection was
+// created with. A zero Keepalive turns the checks off. Call it before the
+// connection is used.
+func (c *WSConn) SetKeepalive(k Keepalive) {
+	c.ka.start(k)
+}
+
+// SetMaxFrameSize sets the largest message the connection accepts. Larger
+// messages fail with repo.ErrFrameTooLarge and close the connection. A size of
+// zero or less removes the limit.
+func (c *WSConn) SetMaxFrameSize(n int) {
+	c.c.SetReadLimit(int64(n))
+}
+
+// readErr maps the websocket read limit error to repo.ErrFrameTooLarge.
+func readErr(err error) error {
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return fmt.Errorf("%w: %v", repo.ErrFrameTooLarge, err)
+	}
+	return err
 }
 
 // Send encodes v as CBOR and writes it over the websocket.
@@ -38,12 +66,12 @@ func (c *WSConn) Send(v interface{}) error {
 	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.c.WriteMessage(websocket.BinaryMessage, data)
+	return c.ka.write(data)
 }
 
 // Recv reads a CBOR message into v.
 func (c *WSConn) Recv(v interface{}) error {
-	_, data, err := c.c.ReadMessage()
+	data, err := c.ka.read()
 	if err != nil {
 		return err
 	}
@@ -58,25 +86,84 @@ func (c *WSConn) SendMessage(msg repo.RepoMessage) error {
 	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.c.WriteMessage(websocket.BinaryMessage, data)
+	return c.ka.write(data)
 }
 
-// RecvMessage reads a repo.RepoMessage from the websocket.
+// RecvMessage reads a repo.RepoMessage from the websocket. Receives fail with
+// repo.ErrConnTimeout once the keepalive gives up on the peer, and with a
+// *websocket.CloseError carrying the status code when the peer closes.
 func (c *WSConn) RecvMessage() (repo.RepoMessage, error) {
-	_, data, err := c.c.ReadMessage()
+	data, err := c.ka.read()
 	if err != nil {
 		return repo.RepoMessage{}, err
 	}
 	return repo.DecodeRepoMessage(data)
 }
 
-// Close closes the websocket.
-func (c *WSConn) Close() error { return c.c.Close() }
+// Close performs the close handshake with status CloseNormalClosure and
+// closes the websocket.
+func (c *WSConn) Close() error {
+	return c.CloseWithStatus(websocket.CloseNormalClosure, "")
+}
+
+// CloseWithStatus sends a close frame with the given status code and reason,
+// waits up to the keepalive's CloseTimeout for the peer to answer if a
+// receive is in progress, and closes the websocket.
+func (c *WSConn) CloseWithStatus(code int, reason string) error {
+	return c.ka.close(code, reason)
+}
+
+// Identity returns the identity the Authenticator attached to the peer during
+// AcceptWebSocketWithOptions, or nil.
+func (c *WSConn) Identity() *repo.Identity {
+	return c.identity
+}
+
+// DialOptions configures DialWebSocketWithOptions.
+type DialOptions struct {
+	// Header is sent with the upgrade request, for example to carry
+	// credentials for the server's Authenticator.
+	Header http.Header
+	// Metadata is sent as this peer's peerMetadata.
+	Metadata repo.PeerMetadata
+	// Keepalive configures the connection's liveness checks. Nil selects
+	// DefaultKeepalive; a zero Keepalive turns them off.
+	Keepalive *Keepalive
+}
+
+// AcceptOptions configures AcceptWebSocketWithOptions.
+type AcceptOptions struct {
+	// CheckOrigin decides whether to upgrade a request from another origin.
+	// Nil accepts same-origin requests only.
+	CheckOrigin func(r *http.Request) bool
+	// Auth authenticates the peer once its join message arrives. Rejected
+	// peers get a close frame with status ClosePolicyViolation.
+	Auth repo.Authenticator
+	// Metadata is sent as this peer's peerMetadata.
+	Metadata repo.PeerMetadata
+	// Keepalive configures the connection's liveness checks. Nil selects
+	// DefaultKeepalive; a zero Keepalive turns them off.
+	Keepalive *Keepalive
+}
+
+// keepaliveOrDefault returns *k, or DefaultKeepalive if k is nil.
+func keepaliveOrDefault(k *Keepalive) Keepalive {
+	if k == nil {
+		return DefaultKeepalive
+	}
+	return *k
+}
 
 // DialWebSocket dials the given websocket URL and performs the join/peer handshake.
 // It returns the remote repository ID and a connection handle for further
-// communication.
+// communication, with DefaultKeepalive enabled.
 func DialWebSocket(ctx context.Context, u string, id repo.RepoID) (*WSConn, repo.RepoID, error) {
+	return DialWebSocketWithOptions(ctx, u, id, DialOptions{})
+}
+
+// DialWebSocketWithOptions is DialWebSocket with request headers, peer
+// metadata and keepalive settings.
+func DialWebSocketWithOptions(ctx context.Context, u string, id repo.RepoID, opts DialOptions) (*WSConn, repo.RepoID, error) {
 	// ensure scheme is ws/wss
 	parsed, err := url.Parse(u)
 	if err != nil {
@@ -86,7 +173,7 @@ func DialWebSocket(ctx context.Context, u string, id repo.RepoID) (*WSConn, repo
 		return nil, repo.RepoID{}, fmt.Errorf("invalid websocket url: %s", u)
 	}
 	dialer := websocket.DefaultDialer
-	conn, _, err := dialer.DialContext(ctx, u, nil)
+	conn, _, err := dialer.DialContext(ctx, u, opts.Header)
 	if err != nil {
 		return nil, repo.RepoID{}, err
 	}
@@ -94,10 +181,8 @@ func DialWebSocket(ctx context.Context, u string, id repo.RepoID) (*WSConn, repo
 	if d, ok := ctx.Deadline(); ok {
 		_ = conn.SetReadDeadline(d)
 		_ = conn.SetWriteDeadline(d)
-		defer conn.SetReadDeadline(time.Time{})
-		defer conn.SetWriteDeadline(time.Time{})
 	}
-	if err := ws.Send(handshakeMessage{Type: "join", SenderID: id.String()}); err != nil {
+	if err := ws.Send(handshakeMessage{Type: "join", SenderID: id.String(), PeerMetadata: opts.Metadata}); err != nil {
 		ws.Close()
 		return nil, repo.RepoID{}, err
 	}
@@ -110,15 +195,26 @@ func DialWebSocket(ctx context.Context, u string, id repo.RepoID) (*WSConn, repo
 		ws.Close()
 		return nil, repo.RepoID{}, fmt.Errorf("unexpected message %q", resp.Type)
 	}
+	_ = conn.SetReadDeadline(time.Time{})
+	_ = conn.SetWriteDeadline(time.Time{})
+	ws.SetKeepalive(keepaliveOrDefault(opts.Keepalive))
 	remote := parseRepoID(resp.SenderID)
 	return ws, remote, nil
 }
 
 // AcceptWebSocket upgrades an HTTP request to a websocket and completes the
 // join/peer handshake. The returned connection can be used for CBOR message
-// exchange.
+// exchange, and has DefaultKeepalive enabled.
 func AcceptWebSocket(w http.ResponseWriter, r *http.Request, id repo.RepoID) (*WSConn, repo.RepoID, error) {
-	upgrader := websocket.Upgrader{}
+	return AcceptWebSocketWithOptions(w, r, id, AcceptOptions{})
+}
+
+// AcceptWebSocketWithOptions is AcceptWebSocket with an origin check, an
+// Authenticator, peer metadata and keepalive settings. A peer rejected by opts.Auth fails the
+// handshake with repo.ErrUnauthorized; an accepted peer's identity is
+// available from the returned connection's Identity.
+func AcceptWebSocketWithOptions(w http.ResponseWriter, r *http.Request, id repo.RepoID, opts AcceptOptions) (*WSConn, repo.RepoID, error) {
+	upgrader := websocket.Upgrader{CheckOrigin: opts.CheckOrigin}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return nil, repo.RepoID{}, err
@@ -133,10 +229,17 @@ func AcceptWebSocket(w http.ResponseWriter, r *http.Request, id repo.RepoID) (*W
 		ws.Close()
 		return nil, repo.RepoID{}, fmt.Errorf("unexpected message %q", req.Type)
 	}
-	if err := ws.Send(handshakeMessage{Type: "peer", SenderID: id.String()}); err != nil {
+	authReq := repo.AuthRequest{Request: r, TLS: r.TLS, RemoteAddr: conn.RemoteAddr()}
+	ws.identity, err = repo.Authenticate(r.Context(), opts.Auth, authReq, req.SenderID, req.PeerMetadata)
+	if err != nil {
+		ws.CloseWithStatus(websocket.ClosePolicyViolation, "unauthorized")
+		return nil, repo.RepoID{}, err
+	}
+	if err := ws.Send(handshakeMessage{Type: "peer", SenderID: id.String(), PeerMetadata: opts.Metadata}); err != nil {
 		ws.Close()
 		return nil, repo.RepoID{}, err
 	}
+	ws.SetKeepalive(keepaliveOrDefault(opts.Keepalive))
 	remote := parseRepoID(req.SenderID)
 	return ws, remote, nil
 }
@@ -2,6 +2,7 @@ package network_test
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -11,6 +12,7 @@ import (
 	"github.com/automerge/automerge-repo-go"
 	"github.com/automerge/automerge-repo-network-websocket-go"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 )
 
 func TestWebSocketHandshake(t *testing.T) {
@@ -100,3 +102,258 @@ func TestWSConnSendRecvMessage(t *testing.T) {
 		t.Fatalf("mismatch: %#v vs %#v", received, msg)
 	}
 }
+
+func TestWSConnMaxFrameSize(t *testing.T) {
+	serverRepo := repo.New()
+	clientRepo := repo.New()
+
+	var recvErr error
+	done := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		conn, _, err := network.AcceptWebSocket(w, r, serverRepo.ID)
+		if err != nil {
+			t.Errorf("accept error: %v", err)
+			return
+		}
+		defer conn.Close()
+		conn.SetMaxFrameSize(1024)
+		_, recvErr = conn.RecvMessage()
+	}))
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, _, err := network.DialWebSocket(ctx, wsURL, clientRepo.ID)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+
+	msg := repo.RepoMessage{
+		Type:       "sync",
+		FromRepoID: clientRepo.ID,
+		ToRepoID:   serverRepo.ID,
+		DocumentID: uuid.New(),
+		Message:    make([]byte, 4096),
+	}
+	_ = conn.SendMessage(msg)
+
+	<-done
+
+	if !errors.Is(recvErr, repo.ErrFrameTooLarge) {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", recvErr)
+	}
+}
+
+// keepaliveServer accepts one websocket and runs serve on it.
+func keepaliveServer(t *testing.T, serve func(*network.WSConn)) (string, func()) {
+	t.Helper()
+	serverRepo := repo.New()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := network.AcceptWebSocket(w, r, serverRepo.ID)
+		if err != nil {
+			t.Errorf("accept error: %v", err)
+			return
+		}
+		serve(conn)
+	}))
+	return "ws" + strings.TrimPrefix(srv.URL, "http"), srv.Close
+}
+
+func dialKeepalive(t *testing.T, url string, k network.Keepalive) (*network.WSConn, repo.RepoID) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, remote, err := network.DialWebSocket(ctx, url, repo.New().ID)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	conn.SetKeepalive(k)
+	return conn, remote
+}
+
+func TestWSConnPongTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	// the server never reads, so pings are never answered
+	url, stop := keepaliveServer(t, func(conn *network.WSConn) {
+		<-release
+		conn.Close()
+	})
+	defer stop()
+
+	conn, remote := dialKeepalive(t, url, network.Keepalive{PingInterval: 50 * time.Millisecond, PongTimeout: 50 * time.Millisecond})
+	h := repo.NewRepoHandle(repo.New())
+	start := time.Now()
+	res := h.AddConn(remote, conn).Await()
+	if res.Kind != repo.ConnFinishedTimeout || !errors.Is(res.Err, repo.ErrConnTimeout) {
+		t.Fatalf("expected timeout, got %+v", res)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("dead peer detected after %v", elapsed)
+	}
+}
+
+func TestDialWebSocketKeepaliveOption(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	url, stop := keepaliveServer(t, func(conn *network.WSConn) {
+		<-release
+		conn.Close()
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	k := network.Keepalive{PingInterval: 50 * time.Millisecond, PongTimeout: 50 * time.Millisecond}
+	conn, remote, err := network.DialWebSocketWithOptions(ctx, url, repo.New().ID, network.DialOptions{Keepalive: &k})
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	h := repo.NewRepoHandle(repo.New())
+	res := h.AddConn(remote, conn).Await()
+	if res.Kind != repo.ConnFinishedTimeout {
+		t.Fatalf("expected the keepalive to detect the dead peer, got %+v", res)
+	}
+}
+
+func TestWSConnKeepaliveLivePeer(t *testing.T) {
+	url, stop := keepaliveServer(t, func(conn *network.WSConn) {
+		defer conn.Close()
+		// reading answers the client's pings
+		go func() {
+			for {
+				if _, err := conn.RecvMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		time.Sleep(300 * time.Millisecond)
+		if err := conn.SendMessage(repo.RepoMessage{Type: "sync", DocumentID: uuid.New(), Message: []byte{1}}); err != nil {
+			t.Errorf("send error: %v", err)
+		}
+	})
+	defer stop()
+
+	conn, _ := dialKeepalive(t, url, network.Keepalive{PingInterval: 50 * time.Millisecond, PongTimeout: 50 * time.Millisecond})
+	defer conn.Close()
+	msg, err := conn.RecvMessage()
+	if err != nil || msg.Type != "sync" {
+		t.Fatalf("expected message from live peer, got %+v %v", msg, err)
+	}
+}
+
+func TestWSConnIdleTimeoutAndCloseStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		k    network.Keepalive
+		code int
+	}{
+		{"idle", network.Keepalive{IdleTimeout: 100 * time.Millisecond}, websocket.CloseGoingAway},
+		{"close", network.Keepalive{}, websocket.CloseNormalClosure},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			serverErr := make(chan error, 1)
+			url, stop := keepaliveServer(t, func(conn *network.WSConn) {
+				defer conn.Close()
+				_, err := conn.RecvMessage()
+				serverErr <- err
+			})
+			defer stop()
+
+			conn, _ := dialKeepalive(t, url, tc.k)
+			if tc.code == websocket.CloseNormalClosure {
+				conn.Close()
+			} else if _, err := conn.RecvMessage(); !errors.Is(err, repo.ErrConnTimeout) {
+				t.Fatalf("expected ErrConnTimeout, got %v", err)
+			}
+			select {
+			case err := <-serverErr:
+				var ce *websocket.CloseError
+				if !errors.As(err, &ce) || ce.Code != tc.code {
+					t.Fatalf("expected close status %d, got %v", tc.code, err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for close")
+			}
+		})
+	}
+}
+
+func TestAcceptWebSocketAuth(t *testing.T) {
+	serverRepo := repo.New()
+	auth := repo.AuthenticatorFunc(func(ctx context.Context, req repo.AuthRequest) (*repo.Identity, error) {
+		if req.Request.Header.Get("Authorization") != "Bearer secret" {
+			return nil, errors.New("missing token")
+		}
+		return &repo.Identity{Subject: req.Metadata["user"].(string)}, nil
+	})
+	type result struct {
+		ident *repo.Identity
+		err   error
+	}
+	accepted := make(chan result, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := network.AcceptWebSocketWithOptions(w, r, serverRepo.ID, network.AcceptOptions{Auth: auth})
+		if err != nil {
+			accepted <- result{err: err}
+			return
+		}
+		accepted <- result{ident: conn.Identity()}
+		conn.Close()
+	}))
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	opts := network.DialOptions{
+		Header:   http.Header{"Authorization": {"Bearer secret"}},
+		Metadata: repo.PeerMetadata{"user": "alice"},
+	}
+	conn, _, err := network.DialWebSocketWithOptions(ctx, wsURL, repo.New().ID, opts)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	conn.Close()
+	if res := <-accepted; res.err != nil || res.ident == nil || res.ident.Subject != "alice" {
+		t.Fatalf("unexpected accept result %+v", res)
+	}
+
+	_, _, err = network.DialWebSocket(ctx, wsURL, repo.New().ID)
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.ClosePolicyViolation {
+		t.Fatalf("expected policy violation close, got %v", err)
+	}
+	if res := <-accepted; !errors.Is(res.err, repo.ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %v", res.err)
+	}
+}
+
+func TestAcceptWebSocketCheckOrigin(t *testing.T) {
+	serverRepo := repo.New()
+	allow := func(r *http.Request) bool { return r.Header.Get("Origin") == "https://app.example" }
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := network.AcceptWebSocketWithOptions(w, r, serverRepo.ID, network.AcceptOptions{CheckOrigin: allow})
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := network.DialWebSocketWithOptions(ctx, wsURL, repo.New().ID, network.DialOptions{Header: http.Header{"Origin": {"https://evil.example"}}}); err == nil {
+		t.Fatalf("expected foreign origin to be refused")
+	}
+	conn, _, err := network.DialWebSocketWithOptions(ctx, wsURL, repo.New().ID, network.DialOptions{Header: http.Header{"Origin": {"https://app.example"}}})
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	conn.Close()
+}
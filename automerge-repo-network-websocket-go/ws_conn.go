@@ -11,12 +11,28 @@ import (
 // and also satisfies io.ReadWriter for handshaking.
 type WSConnAdapter struct {
 	conn *websocket.Conn
+	ka   *keepalive
 	r    io.Reader
 }
 
 // NewWSConnAdapter creates a new WSConnAdapter.
 func NewWSConnAdapter(conn *websocket.Conn) *WSConnAdapter {
-	return &WSConnAdapter{conn: conn}
+	conn.SetReadLimit(repo.DefaultMaxFrameSize)
+	return &WSConnAdapter{conn: conn, ka: newKeepalive(conn)}
+}
+
+// SetKeepalive enables pings, pong-based liveness detection and the idle
+// timeout described by k, replacing any earlier keepalive. A zero Keepalive
+// turns the checks off. Call it before the connection is used.
+func (c *WSConnAdapter) SetKeepalive(k Keepalive) {
+	c.ka.start(k)
+}
+
+// SetMaxFrameSize sets the largest message the connection accepts. Larger
+// messages fail with repo.ErrFrameTooLarge. A size of zero or less removes
+// the limit.
+func (c *WSConnAdapter) SetMaxFrameSize(n int) {
+	c.conn.SetReadLimit(int64(n))
 }
 
 // SendMessage sends a message over the WebSocket connection.
@@ -25,21 +41,29 @@ func (c *WSConnAdapter) SendMessage(msg repo.RepoMessage) error {
 	if err != nil {
 		return err
 	}
-	return c.conn.WriteMessage(websocket.BinaryMessage, data)
+	return c.ka.write(data)
 }
 
-// RecvMessage receives a message from the WebSocket connection.
+// RecvMessage receives a message from the WebSocket connection. See
+// WSConn.RecvMessage for the errors it returns.
 func (c *WSConnAdapter) RecvMessage() (repo.RepoMessage, error) {
-	_, data, err := c.conn.ReadMessage()
+	data, err := c.ka.read()
 	if err != nil {
 		return repo.RepoMessage{}, err
 	}
 	return repo.DecodeRepoMessage(data)
 }
 
-// Close closes the WebSocket connection.
+// Close performs the close handshake with status CloseNormalClosure and
+// closes the WebSocket connection.
 func (c *WSConnAdapter) Close() error {
-	return c.conn.Close()
+	return c.CloseWithStatus(websocket.CloseNormalClosure, "")
+}
+
+// CloseWithStatus sends a close frame with the given status code and reason
+// and closes the connection. See WSConn.CloseWithStatus.
+func (c *WSConnAdapter) CloseWithStatus(code int, reason string) error {
+	return c.ka.close(code, reason)
 }
 
 // Read reads data from the WebSocket connection for io.Reader.
@@ -49,11 +73,13 @@ func (c *WSConnAdapter) Read(p []byte) (n int, err error) {
 		// We buffer it until it's fully consumed.
 		_, r, err := c.conn.NextReader()
 		if err != nil {
-			return 0, err
+			return 0, c.ka.err(err)
 		}
+		c.ka.touch()
 		c.r = r
 	}
 	n, err = c.r.Read(p)
+	err = readErr(err)
 	if err == io.EOF {
 		// The current message has been fully read, clear the reader
 		// so the next call to Read() will get the next message.
@@ -65,8 +91,7 @@ func (c *WSConnAdapter) Read(p []byte) (n int, err error) {
 
 // Write writes data to the WebSocket connection for io.Writer.
 func (c *WSConnAdapter) Write(p []byte) (n int, err error) {
-	err = c.conn.WriteMessage(websocket.BinaryMessage, p)
-	if err != nil {
+	if err := c.ka.write(p); err != nil {
 		return 0, err
 	}
 	return len(p), nil
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	automerge "github.com/automerge/automerge-go"
+	"github.com/automerge/automerge-repo-go"
+)
+
+// frameMagic marks a DEFLATE-compressed frame written by CompressedStore. The
+// last byte is the frame format version. Raw automerge chunks always start
+// with the bytes 0x85 0x6f 0x4a 0x83, so they are never mistaken for frames,
+// and a file may mix frames with raw chunks appended by a plain FsStore.
+var frameMagic = [4]byte{'A', 'M', 'Z', 1}
+
+// frameHeaderLen is the size of the magic plus the 4 byte payload length.
+const frameHeaderLen = 8
+
+// RawStorage is a StorageAdapter that stores each document as a sequence of
+// bytes which CompressedStore can read and write directly. FsStore implements
+// it.
+type RawStorage interface {
+	repo.StorageAdapter
+	// ReadRaw returns the stored bytes of the document, or an error wrapping
+	// fs.ErrNotExist if it is not stored.
+	ReadRaw(id repo.DocumentID) ([]byte, error)
+	// AppendRaw appends data to the stored bytes of the document, creating
+	// them if needed.
+	AppendRaw(id repo.DocumentID, data []byte) error
+	// WriteRaw atomically replaces the stored bytes of the document.
+	WriteRaw(id repo.DocumentID, data []byte) error
+}
+
+// CompressedStore decorates a RawStorage so that snapshots and incremental
+// chunks are DEFLATE-compressed before they are written. Each write is stored
+// as a self-describing frame, so documents that were written uncompressed by
+// the underlying store continue to load, even if compressed and uncompressed
+// writes were interleaved.
+type CompressedStore struct {
+	Store RawStorage
+	// Level is the flate compression level. Zero selects flate.DefaultCompression.
+	Level int
+}
+
+// NewCompressedStore returns a CompressedStore writing to an FsStore in dir.
+func NewCompressedStore(dir string) *CompressedStore {
+	return &CompressedStore{Store: &FsStore{Dir: dir}}
+}
+
+// Save appends a compressed frame with the document's new changes. Documents
+// that are not stored yet, or whose stored bytes do not start with a frame
+// because they were written or compacted by the underlying store, are
+// rewritten as a compressed snapshot instead.
+func (s *CompressedStore) Save(doc *repo.Document) error {
+	if doc.Doc == nil {
+		doc.Doc = automerge.New()
+	}
+	// the stored bytes are checked every time, as the underlying store may
+	// have rewritten them since the last save
+	b, err := s.Store.ReadRaw(doc.ID)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s.Compact(doc)
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(b, frameMagic[:]) {
+		return s.Compact(doc)
+	}
+
+	data := doc.Doc.SaveIncremental()
+	if len(data) == 0 {
+		return nil
+	}
+	frame, err := s.encodeFrame(data)
+	if err != nil {
+		return err
+	}
+	return s.Store.AppendRaw(doc.ID, frame)
+}
+
+// Compact writes a compressed snapshot of the document, replacing any
+// previously appended frames.
+func (s *CompressedStore) Compact(doc *repo.Document) error {
+	if doc.Doc == nil {
+		doc.Doc = automerge.New()
+	}
+	frame, err := s.encodeFrame(doc.Doc.Save())
+	if err != nil {
+		return err
+	}
+	return s.Store.WriteRaw(doc.ID, frame)
+}
+
+// Load reads a document whether or not it was compressed.
+func (s *CompressedStore) Load(id repo.DocumentID) (*repo.Document, error) {
+	b, err := s.Store.ReadRaw(id)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("document %s not found", id)
+		}
+		return nil, err
+	}
+	return decodeDocument(id, b)
+}
+
+// List returns all document IDs in the underlying store.
+func (s *CompressedStore) List() ([]repo.DocumentID, error) {
+	return s.Store.List()
+}
+
+// Remove deletes the document from the underlying store.
+func (s *CompressedStore) Remove(id repo.DocumentID) error {
+	return s.Store.Remove(id)
+}
+
+// SaveTombstone records that the document was deleted, if the underlying
+// store persists tombstones.
+func (s *CompressedStore) SaveTombstone(id repo.DocumentID, opts repo.DeleteOptions) error {
+	if ts, ok := s.Store.(repo.TombstoneStorage); ok {
+		return ts.SaveTombstone(id, opts)
+	}
+	return nil
+}
+
+// RemoveTombstone forgets the deletion of a document.
+func (s *CompressedStore) RemoveTombstone(id repo.DocumentID) error {
+	if ts, ok := s.Store.(repo.TombstoneStorage); ok {
+		return ts.RemoveTombstone(id)
+	}
+	return nil
+}
+
+// Tombstones returns every deletion recorded by the underlying store.
+func (s *CompressedStore) Tombstones() (map[repo.DocumentID]repo.DeleteOptions, error) {
+	if ts, ok := s.Store.(repo.TombstoneStorage); ok {
+		return ts.Tombstones()
+	}
+	return map[repo.DocumentID]repo.DeleteOptions{}, nil
+}
+
+func (s *CompressedStore) encodeFrame(data []byte) ([]byte, error) {
+	level := s.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	var buf bytes.Buffer
+	buf.Write(make([]byte, frameHeaderLen))
+	w, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	frame := buf.Bytes()
+	copy(frame, frameMagic[:])
+	binary.BigEndian.PutUint32(frame[4:frameHeaderLen], uint32(len(frame)-frameHeaderLen))
+	return frame, nil
+}
+
+// decodeFrames returns the raw automerge bytes stored in b, which is read as
+// any sequence of frames and raw chunks. If a frame or chunk is damaged the
+// bytes decoded before it are returned along with the error.
+func decodeFrames(b []byte) ([]byte, error) {
+	var out []byte
+	for len(b) > 0 {
+		if bytes.HasPrefix(b, chunkMagic) {
+			// a raw chunk appended by a plain FsStore
+			n, err := chunkLen(b)
+			if err != nil {
+				return out, err
+			}
+			out = append(out, b[:n]...)
+			b = b[n:]
+			continue
+		}
+		if !bytes.HasPrefix(b, frameMagic[:]) {
+			return out, errors.New("invalid chunk or compressed frame header")
+		}
+		if len(b) < frameHeaderLen {
+			return out, fmt.Errorf("compressed frame: %w", errTruncated)
+		}
+		n := int(binary.BigEndian.Uint32(b[4:frameHeaderLen]))
+		if len(b)-frameHeaderLen < n {
+			return out, fmt.Errorf("compressed frame: %w", errTruncated)
+		}
+		data, err := io.ReadAll(flate.NewReader(bytes.NewReader(b[frameHeaderLen : frameHeaderLen+n])))
+		if err != nil {
+			return out, err
+		}
+		out = append(out, data...)
+		b = b[frameHeaderLen+n:]
+	}
+	return out, nil
+}
@@ -0,0 +1,369 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	automerge "github.com/automerge/automerge-go"
+	"github.com/automerge/automerge-repo-go"
+	"github.com/automerge/automerge-repo-storage-fs-go"
+	"github.com/google/uuid"
+)
+
+func TestCompressedStoreSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	store := storage.NewCompressedStore(dir)
+
+	doc := &repo.Document{ID: uuid.New(), Doc: automerge.New()}
+	if err := doc.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := store.Save(doc); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := doc.Set("baz", "qux"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := store.Save(doc); err != nil {
+		t.Fatalf("incremental Save failed: %v", err)
+	}
+
+	loaded, err := store.Load(doc.ID)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if v, ok := loaded.Get("foo"); !ok || v != "bar" {
+		t.Fatalf("unexpected value for foo: %v", v)
+	}
+	if v, ok := loaded.Get("baz"); !ok || v != "qux" {
+		t.Fatalf("unexpected value for baz: %v", v)
+	}
+
+	// a plain FsStore reads compressed files too
+	plain, err := (&storage.FsStore{Dir: dir}).Load(doc.ID)
+	if err != nil {
+		t.Fatalf("plain Load failed: %v", err)
+	}
+	if v, _ := plain.Get("baz"); v != "qux" {
+		t.Fatalf("unexpected value from plain store: %v", v)
+	}
+}
+
+func TestCompressedStoreLoadsLegacyFiles(t *testing.T) {
+	dir := t.TempDir()
+	legacy := &storage.FsStore{Dir: dir}
+
+	doc := &repo.Document{ID: uuid.New(), Doc: automerge.New()}
+	if err := doc.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := legacy.Save(doc); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	store := &storage.CompressedStore{Store: legacy}
+	loaded, err := store.Load(doc.ID)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if v, _ := loaded.Get("foo"); v != "bar" {
+		t.Fatalf("unexpected value: %v", v)
+	}
+
+	// saving through the compressed store upgrades the legacy file
+	if err := loaded.Set("foo", "baz"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := store.Save(loaded); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, doc.ID.String()+".automerge"))
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !strings.HasPrefix(string(b), "AMZ\x01") {
+		t.Fatalf("expected compressed frame, got %x", b[:4])
+	}
+	reloaded, err := store.Load(doc.ID)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if v, _ := reloaded.Get("foo"); v != "baz" {
+		t.Fatalf("unexpected value after upgrade: %v", v)
+	}
+}
+
+// textDoc returns a document with n text-heavy incremental changes.
+func textDoc(n int) *repo.Document {
+	doc := &repo.Document{ID: uuid.New(), Doc: automerge.New()}
+	for i := 0; i < n; i++ {
+		_ = doc.Set(fmt.Sprintf("para-%d", i), strings.Repeat("the quick brown fox jumps over the lazy dog ", 20))
+	}
+	return doc
+}
+
+func benchmarkSave(b *testing.B, newStore func(dir string) repo.StorageAdapter) {
+	dir := b.TempDir()
+	store := newStore(dir)
+	doc := textDoc(1)
+	if err := store.Compact(doc); err != nil {
+		b.Fatalf("Compact failed: %v", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = doc.Set(fmt.Sprintf("para-%d", i), strings.Repeat("the quick brown fox jumps over the lazy dog ", 20))
+		if err := store.Save(doc); err != nil {
+			b.Fatalf("Save failed: %v", err)
+		}
+	}
+	b.StopTimer()
+	info, err := os.Stat(filepath.Join(dir, doc.ID.String()+".automerge"))
+	if err != nil {
+		b.Fatalf("stat failed: %v", err)
+	}
+	b.ReportMetric(float64(info.Size())/float64(b.N), "disk-bytes/op")
+}
+
+func benchmarkLoad(b *testing.B, newStore func(dir string) repo.StorageAdapter) {
+	dir := b.TempDir()
+	store := newStore(dir)
+	doc := textDoc(1)
+	if err := store.Compact(doc); err != nil {
+		b.Fatalf("Compact failed: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		_ = doc.Set(fmt.Sprintf("para-%d", i), strings.Repeat("the quick brown fox jumps over the lazy dog ", 20))
+		if err := store.Save(doc); err != nil {
+			b.Fatalf("Save failed: %v", err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.Load(doc.ID); err != nil {
+			b.Fatalf("Load failed: %v", err)
+		}
+	}
+}
+
+func newFsStore(dir string) repo.StorageAdapter { return &storage.FsStore{Dir: dir} }
+
+func newCompressedStore(dir string) repo.StorageAdapter { return storage.NewCompressedStore(dir) }
+
+func BenchmarkFsStoreSave(b *testing.B)         { benchmarkSave(b, newFsStore) }
+func BenchmarkCompressedStoreSave(b *testing.B) { benchmarkSave(b, newCompressedStore) }
+func BenchmarkFsStoreLoad(b *testing.B)         { benchmarkLoad(b, newFsStore) }
+func BenchmarkCompressedStoreLoad(b *testing.B) { benchmarkLoad(b, newCompressedStore) }
+
+func TestCompressedStoreMixedWrites(t *testing.T) {
+	dir := t.TempDir()
+	compressed := storage.NewCompressedStore(dir)
+	plain := &storage.FsStore{Dir: dir}
+
+	doc := &repo.Document{ID: uuid.New(), Doc: automerge.New()}
+	steps := []repo.StorageAdapter{compressed, plain, compressed, plain}
+	for i, store := range steps {
+		if err := doc.Set(fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+		if err := store.Save(doc); err != nil {
+			t.Fatalf("Save %d failed: %v", i, err)
+		}
+	}
+
+	for _, store := range []repo.StorageAdapter{compressed, plain} {
+		loaded, err := store.Load(doc.ID)
+		if err != nil {
+			t.Fatalf("%T Load failed: %v", store, err)
+		}
+		for i := range steps {
+			if v, ok := loaded.Get(fmt.Sprintf("k%d", i)); !ok || v != "v" {
+				t.Fatalf("%T: unexpected value for k%d: %v", store, i, v)
+			}
+		}
+	}
+	report, err := plain.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatalf("unexpected problems: %+v", report.Problems)
+	}
+}
+
+func TestCompressedStoreSaveAfterPlainCompact(t *testing.T) {
+	dir := t.TempDir()
+	compressed := storage.NewCompressedStore(dir)
+	plain := &storage.FsStore{Dir: dir}
+
+	doc := textDoc(2)
+	if err := compressed.Save(doc); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	// the plain store rewrites the file uncompressed behind the compressed one
+	if err := plain.Compact(doc); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if err := doc.Set("extra", "value"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := compressed.Save(doc); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, doc.ID.String()+".automerge"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !strings.HasPrefix(string(b), "AMZ\x01") {
+		t.Fatalf("expected the file to be compressed again")
+	}
+	for _, store := range []repo.StorageAdapter{compressed, plain} {
+		loaded, err := store.Load(doc.ID)
+		if err != nil {
+			t.Fatalf("%T Load failed: %v", store, err)
+		}
+		if v, _ := loaded.Get("extra"); v != "value" {
+			t.Fatalf("%T: unexpected value: %v", store, v)
+		}
+	}
+}
+
+func TestLoadFramesAfterRawChunks(t *testing.T) {
+	dir := t.TempDir()
+	plain := &storage.FsStore{Dir: dir}
+	doc := textDoc(1)
+	if err := plain.Save(doc); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := doc.Set("extra", "value"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	// a frame appended to a file that starts with a raw chunk
+	raw := &memRawStore{data: make(map[repo.DocumentID][]byte)}
+	if err := (&storage.CompressedStore{Store: raw}).Save(doc); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := plain.AppendRaw(doc.ID, raw.data[doc.ID]); err != nil {
+		t.Fatalf("AppendRaw failed: %v", err)
+	}
+	for _, store := range []repo.StorageAdapter{storage.NewCompressedStore(dir), plain} {
+		loaded, err := store.Load(doc.ID)
+		if err != nil {
+			t.Fatalf("%T Load failed: %v", store, err)
+		}
+		if v, _ := loaded.Get("extra"); v != "value" {
+			t.Fatalf("%T: unexpected value: %v", store, v)
+		}
+	}
+}
+
+// memRawStore is an in-memory RawStorage.
+type memRawStore struct {
+	data map[repo.DocumentID][]byte
+	// readErr, if set, is returned by ReadRaw.
+	readErr error
+}
+
+func (s *memRawStore) Load(id repo.DocumentID) (*repo.Document, error) {
+	d, err := automerge.Load(s.data[id])
+	if err != nil {
+		return nil, err
+	}
+	return &repo.Document{ID: id, Doc: d}, nil
+}
+
+func (s *memRawStore) Save(doc *repo.Document) error {
+	return s.AppendRaw(doc.ID, doc.Doc.SaveIncremental())
+}
+
+func (s *memRawStore) Compact(doc *repo.Document) error {
+	return s.WriteRaw(doc.ID, doc.Doc.Save())
+}
+
+func (s *memRawStore) List() ([]repo.DocumentID, error) {
+	var ids []repo.DocumentID
+	for id := range s.data {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *memRawStore) Remove(id repo.DocumentID) error {
+	delete(s.data, id)
+	return nil
+}
+
+func (s *memRawStore) ReadRaw(id repo.DocumentID) ([]byte, error) {
+	if s.readErr != nil {
+		return nil, s.readErr
+	}
+	b, ok := s.data[id]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return b, nil
+}
+
+func (s *memRawStore) AppendRaw(id repo.DocumentID, data []byte) error {
+	s.data[id] = append(s.data[id], data...)
+	return nil
+}
+
+func (s *memRawStore) WriteRaw(id repo.DocumentID, data []byte) error {
+	s.data[id] = data
+	return nil
+}
+
+func TestCompressedStoreWrapsRawStorage(t *testing.T) {
+	raw := &memRawStore{data: make(map[repo.DocumentID][]byte)}
+	store := &storage.CompressedStore{Store: raw}
+
+	doc := textDoc(3)
+	if err := store.Save(doc); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := doc.Set("extra", "value"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := store.Save(doc); err != nil {
+		t.Fatalf("incremental Save failed: %v", err)
+	}
+	if !strings.HasPrefix(string(raw.data[doc.ID]), "AMZ\x01") {
+		t.Fatalf("expected compressed frames in the wrapped store")
+	}
+	loaded, err := store.Load(doc.ID)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if v, _ := loaded.Get("extra"); v != "value" {
+		t.Fatalf("unexpected value: %v", v)
+	}
+	if _, err := store.Load(uuid.New()); err == nil {
+		t.Fatalf("expected an error for a missing document")
+	}
+}
+
+func TestCompressedStoreSaveReadError(t *testing.T) {
+	raw := &memRawStore{data: make(map[repo.DocumentID][]byte)}
+	store := &storage.CompressedStore{Store: raw}
+	doc := textDoc(1)
+	if err := store.Save(doc); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	stored := raw.data[doc.ID]
+	boom := errors.New("boom")
+	raw.readErr = boom
+	if err := doc.Set("extra", "value"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	// a failed read must not be taken for a missing document and compacted over
+	if err := store.Save(doc); !errors.Is(err, boom) {
+		t.Fatalf("expected the read error, got %v", err)
+	}
+	if string(raw.data[doc.ID]) != string(stored) {
+		t.Fatalf("stored bytes were rewritten")
+	}
+}
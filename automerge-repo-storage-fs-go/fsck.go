@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+	"github.com/automerge/automerge-repo-go"
+	"github.com/google/uuid"
+)
+
+// QuarantineDir is the subdirectory of FsStore.Dir that Repair moves files it
+// cannot fix into. Quarantined files keep their name with a timestamp added,
+// so repeated repairs never overwrite each other.
+const QuarantineDir = "quarantine"
+
+// OrphanTempAge is how old a temporary file must be before Verify reports it
+// as orphaned. Younger files may belong to a write still in progress.
+const OrphanTempAge = time.Minute
+
+// ProblemKind classifies an issue found by Verify.
+type ProblemKind int
+
+const (
+	// ProblemUnreadable indicates a document file that could not be read or parsed.
+	ProblemUnreadable ProblemKind = iota
+	// ProblemTruncated indicates a document file whose last chunk was cut short.
+	ProblemTruncated
+	// ProblemOrphanTemp indicates a temporary file left behind by an interrupted write.
+	ProblemOrphanTemp
+	// ProblemBadName indicates a .automerge file whose name is not a document ID.
+	ProblemBadName
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemUnreadable:
+		return "unreadable"
+	case ProblemTruncated:
+		return "truncated"
+	case ProblemOrphanTemp:
+		return "orphan temp file"
+	case ProblemBadName:
+		return "bad filename"
+	default:
+		return fmt.Sprintf("ProblemKind(%d)", int(k))
+	}
+}
+
+// RepairAction records what Repair did about a problem.
+type RepairAction int
+
+const (
+	// RepairNone indicates the problem was only reported.
+	RepairNone RepairAction = iota
+	// RepairSalvaged indicates the loadable changes were written to a fresh
+	// snapshot and the damaged original was quarantined.
+	RepairSalvaged
+	// RepairQuarantined indicates the file was moved to the quarantine directory.
+	RepairQuarantined
+)
+
+func (a RepairAction) String() string {
+	switch a {
+	case RepairNone:
+		return "none"
+	case RepairSalvaged:
+		return "salvaged"
+	case RepairQuarantined:
+		return "quarantined"
+	default:
+		return fmt.Sprintf("RepairAction(%d)", int(a))
+	}
+}
+
+// Problem describes a single issue found in the store.
+type Problem struct {
+	Kind ProblemKind
+	// Path is the file the problem was found in.
+	Path string
+	// DocumentID is the document the file belongs to, if its name is valid.
+	DocumentID repo.DocumentID
+	Err        error
+	// Action is filled in by Repair.
+	Action RepairAction
+	// Salvaged is the number of changes Repair recovered from the file.
+	Salvaged int
+}
+
+// Report is the result of Verify or Repair.
+type Report struct {
+	// Checked is the number of document files inspected.
+	Checked  int
+	Problems []Problem
+}
+
+// OK reports whether no problems were found.
+func (r *Report) OK() bool { return len(r.Problems) == 0 }
+
+// Verify walks the store and reports unreadable or truncated document files,
+// orphan temporary files older than OrphanTempAge and files whose names are
+// not document IDs. It does not modify anything on disk.
+func (s *FsStore) Verify() (*Report, error) {
+	report := &Report{}
+	files, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return report, nil
+		}
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		name := f.Name()
+		path := filepath.Join(s.Dir, name)
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			info, err := f.Info()
+			if err != nil || time.Since(info.ModTime()) < OrphanTempAge {
+				// gone already, or possibly still being written
+				continue
+			}
+			report.Problems = append(report.Problems, Problem{Kind: ProblemOrphanTemp, Path: path})
+		case strings.HasSuffix(name, ".automerge"):
+			id, err := uuid.Parse(strings.TrimSuffix(name, ".automerge"))
+			if err != nil {
+				report.Problems = append(report.Problems, Problem{Kind: ProblemBadName, Path: path, Err: err})
+				continue
+			}
+			report.Checked++
+			if p, ok := verifyFile(path, id); !ok {
+				report.Problems = append(report.Problems, p)
+			}
+		}
+	}
+	return report, nil
+}
+
+// Repair runs Verify and then fixes what it can. Damaged document files are
+// atomically replaced by a fresh snapshot of their loadable changes,
+// compressed if the file started with a compressed frame, and a copy of the
+// damaged bytes is kept in the QuarantineDir subdirectory. Files that cannot
+// be salvaged, orphan temporary files and badly named files are moved there
+// so nothing is deleted.
+func (s *FsStore) Repair() (*Report, error) {
+	report, err := s.Verify()
+	if err != nil {
+		return nil, err
+	}
+	for i := range report.Problems {
+		p := &report.Problems[i]
+		switch p.Kind {
+		case ProblemUnreadable, ProblemTruncated:
+			b, err := os.ReadFile(p.Path)
+			var doc *automerge.Doc
+			var n int
+			if err == nil {
+				doc, n = salvage(b)
+			}
+			if n > 0 {
+				data := doc.Save()
+				if bytes.HasPrefix(b, frameMagic[:]) {
+					if data, err = (&CompressedStore{}).encodeFrame(data); err != nil {
+						return report, err
+					}
+				}
+				if err := writeFileAtomic(p.Path, data); err != nil {
+					return report, err
+				}
+				if err := s.quarantineCopy(p.Path, b); err != nil {
+					return report, err
+				}
+				p.Action = RepairSalvaged
+				p.Salvaged = n
+				continue
+			}
+			fallthrough
+		default:
+			if err := s.quarantine(p.Path); err != nil {
+				return report, err
+			}
+			p.Action = RepairQuarantined
+		}
+	}
+	return report, nil
+}
+
+// quarantine moves path into the quarantine directory.
+func (s *FsStore) quarantine(path string) error {
+	target, err := s.quarantinePath(path)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path, target)
+}
+
+// quarantineCopy stores data, the former contents of path, in the quarantine
+// directory.
+func (s *FsStore) quarantineCopy(path string, data []byte) error {
+	target, err := s.quarantinePath(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(target, data, 0o644)
+}
+
+// quarantinePath returns a name for path in the quarantine directory that is
+// not taken yet.
+func (s *FsStore) quarantinePath(path string) (string, error) {
+	dir := filepath.Join(s.Dir, QuarantineDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	base := filepath.Join(dir, filepath.Base(path)+"."+time.Now().UTC().Format("20060102T150405Z"))
+	target := base
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(target); errors.Is(err, os.ErrNotExist) {
+			return target, nil
+		}
+		target = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// verifyFile checks that the document file at path loads.
+func verifyFile(path string, id repo.DocumentID) (Problem, bool) {
+	p := Problem{Kind: ProblemUnreadable, Path: path, DocumentID: id}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		p.Err = err
+		return p, false
+	}
+	data, err := decodeFrames(b)
+	if err != nil {
+		p.Err = err
+		if errors.Is(err, errTruncated) {
+			p.Kind = ProblemTruncated
+		}
+		return p, false
+	}
+	if _, err := automerge.Load(data); err != nil {
+		p.Err = err
+		if _, err := splitChunks(data); errors.Is(err, errTruncated) {
+			p.Kind = ProblemTruncated
+		}
+		return p, false
+	}
+	return p, true
+}
+
+// salvage loads every intact chunk of the stored bytes b into a new document
+// and returns it along with the number of changes recovered.
+func salvage(b []byte) (*automerge.Doc, int) {
+	data, _ := decodeFrames(b)
+	chunks, _ := splitChunks(data)
+	doc := automerge.New()
+	for _, c := range chunks {
+		_ = doc.LoadIncremental(c)
+	}
+	changes, err := doc.Changes()
+	if err != nil {
+		return nil, 0
+	}
+	return doc, len(changes)
+}
+
+var errTruncated = errors.New("truncated chunk")
+
+// chunkMagic starts every chunk of automerge's binary format.
+var chunkMagic = []byte{0x85, 0x6f, 0x4a, 0x83}
+
+// splitChunks splits raw automerge data into its chunks. It returns the
+// complete chunks found before any damaged or truncated data.
+func splitChunks(b []byte) ([][]byte, error) {
+	var chunks [][]byte
+	for len(b) > 0 {
+		end, err := chunkLen(b)
+		if err != nil {
+			return chunks, err
+		}
+		chunks = append(chunks, b[:end])
+		b = b[end:]
+	}
+	return chunks, nil
+}
+
+// chunkLen returns the length of the automerge chunk at the start of b.
+func chunkLen(b []byte) (int, error) {
+	if !bytes.HasPrefix(b, chunkMagic) {
+		return 0, fmt.Errorf("invalid chunk header")
+	}
+	// magic, 4 byte checksum and 1 byte chunk type
+	pos := len(chunkMagic) + 4 + 1
+	if len(b) < pos {
+		return 0, errTruncated
+	}
+	var n uint64
+	var shift uint
+	for {
+		if pos >= len(b) {
+			return 0, errTruncated
+		}
+		c := b[pos]
+		pos++
+		n |= uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+		shift += 7
+		if shift > 63 {
+			return 0, fmt.Errorf("invalid chunk length")
+		}
+	}
+	if uint64(len(b)-pos) < n {
+		return 0, errTruncated
+	}
+	return pos + int(n), nil
+}
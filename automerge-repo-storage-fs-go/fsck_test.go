@@ -0,0 +1,209 @@
+package storage_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+	"github.com/automerge/automerge-repo-go"
+	"github.com/automerge/automerge-repo-storage-fs-go"
+	"github.com/google/uuid"
+)
+
+func TestFsStoreVerifyAndRepair(t *testing.T) {
+	dir := t.TempDir()
+	store := &storage.FsStore{Dir: dir}
+
+	// a healthy document
+	good := &repo.Document{ID: uuid.New(), Doc: automerge.New()}
+	if err := good.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := store.Save(good); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// a document whose last incremental chunk was cut short
+	truncated := &repo.Document{ID: uuid.New(), Doc: automerge.New()}
+	if err := truncated.Set("first", "kept"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := store.Save(truncated); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := truncated.Set("second", "lost"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := store.Save(truncated); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	truncatedPath := filepath.Join(dir, truncated.ID.String()+".automerge")
+	info, err := os.Stat(truncatedPath)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if err := os.Truncate(truncatedPath, info.Size()-3); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+
+	garbageID := uuid.New()
+	writeFile(t, filepath.Join(dir, garbageID.String()+".automerge"), "not automerge")
+	writeFile(t, filepath.Join(dir, "notes.automerge"), "bad name")
+	orphan := filepath.Join(dir, good.ID.String()+".automerge.123.tmp")
+	writeFile(t, orphan, "partial")
+	old := time.Now().Add(-2 * storage.OrphanTempAge)
+	if err := os.Chtimes(orphan, old, old); err != nil {
+		t.Fatalf("chtimes failed: %v", err)
+	}
+	// a write in progress
+	writeFile(t, filepath.Join(dir, good.ID.String()+".automerge.456.tmp"), "partial")
+
+	report, err := store.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if report.Checked != 3 {
+		t.Fatalf("expected 3 documents checked, got %d", report.Checked)
+	}
+	kinds := map[storage.ProblemKind]int{}
+	for _, p := range report.Problems {
+		kinds[p.Kind]++
+	}
+	want := map[storage.ProblemKind]int{
+		storage.ProblemTruncated:  1,
+		storage.ProblemUnreadable: 1,
+		storage.ProblemBadName:    1,
+		storage.ProblemOrphanTemp: 1,
+	}
+	for k, n := range want {
+		if kinds[k] != n {
+			t.Fatalf("expected %d %v problems, got %d (%+v)", n, k, kinds[k], report.Problems)
+		}
+	}
+
+	report, err = store.Repair()
+	if err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	for _, p := range report.Problems {
+		switch p.Kind {
+		case storage.ProblemTruncated:
+			if p.Action != storage.RepairSalvaged || p.Salvaged != 1 {
+				t.Fatalf("expected truncated file salvaged, got %+v", p)
+			}
+		default:
+			if p.Action != storage.RepairQuarantined {
+				t.Fatalf("expected %v quarantined, got %+v", p.Kind, p)
+			}
+		}
+	}
+
+	loaded, err := store.Load(truncated.ID)
+	if err != nil {
+		t.Fatalf("Load of salvaged document failed: %v", err)
+	}
+	if v, _ := loaded.Get("first"); v != "kept" {
+		t.Fatalf("unexpected salvaged value: %v", v)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, storage.QuarantineDir, garbageID.String()+".automerge.*")); len(m) != 1 {
+		t.Fatalf("expected garbage file quarantined, got %v", m)
+	}
+	if _, err := os.Stat(filepath.Join(dir, good.ID.String()+".automerge.456.tmp")); err != nil {
+		t.Fatalf("recent temp file was moved: %v", err)
+	}
+
+	// a file damaged again is quarantined next to the first copy
+	writeFile(t, filepath.Join(dir, garbageID.String()+".automerge"), "still not automerge")
+	if _, err := store.Repair(); err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, storage.QuarantineDir, garbageID.String()+".automerge.*")); len(m) != 2 {
+		t.Fatalf("expected both garbage files quarantined, got %v", m)
+	}
+
+	report, err = store.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !report.OK() {
+		t.Fatalf("expected clean store after repair, got %+v", report.Problems)
+	}
+}
+
+func TestFsStoreRepairCompressed(t *testing.T) {
+	dir := t.TempDir()
+	store := &storage.FsStore{Dir: dir}
+	compressed := &storage.CompressedStore{Store: store}
+
+	doc := textDoc(1)
+	if err := compressed.Save(doc); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := doc.Set("second", "lost"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := compressed.Save(doc); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	path := filepath.Join(dir, doc.ID.String()+".automerge")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatalf("truncate failed: %v", err)
+	}
+	damaged, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	if _, err := store.Repair(); err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("salvaged file missing: %v", err)
+	}
+	if !strings.HasPrefix(string(b), "AMZ\x01") {
+		t.Fatalf("expected the salvaged snapshot to stay compressed")
+	}
+	m, _ := filepath.Glob(filepath.Join(dir, storage.QuarantineDir, doc.ID.String()+".automerge.*"))
+	if len(m) != 1 {
+		t.Fatalf("expected a quarantined copy, got %v", m)
+	}
+	if q, _ := os.ReadFile(m[0]); string(q) != string(damaged) {
+		t.Fatalf("quarantined copy differs from the damaged file")
+	}
+
+	// the compressed store keeps appending to the salvaged file
+	loaded, err := compressed.Load(doc.ID)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if err := loaded.Set("third", "saved"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := compressed.Save(loaded); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	for _, s := range []repo.StorageAdapter{compressed, store} {
+		again, err := s.Load(doc.ID)
+		if err != nil {
+			t.Fatalf("%T Load after repair failed: %v", s, err)
+		}
+		if v, _ := again.Get("third"); v != "saved" {
+			t.Fatalf("%T: unexpected value: %v", s, v)
+		}
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+}
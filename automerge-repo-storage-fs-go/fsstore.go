@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	automerge "github.com/automerge/automerge-go"
 	"github.com/automerge/automerge-repo-go"
@@ -16,6 +17,13 @@ import (
 // FsStore persists documents to disk in a directory.
 type FsStore struct {
 	Dir string
+	// PollInterval is how often Watch scans Dir for changes when it polls.
+	// Zero selects DefaultPollInterval.
+	PollInterval time.Duration
+	// Polling makes Watch poll even where file system notifications are
+	// available, for example on network file systems that do not deliver
+	// notifications for writes made by other machines.
+	Polling bool
 }
 
 // Save appends any new changes from the document to a file on disk.
@@ -24,7 +32,7 @@ func (s *FsStore) Save(doc *repo.Document) error {
 	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
 		return err
 	}
-	path := filepath.Join(s.Dir, fmt.Sprintf("%s.automerge", doc.ID))
+	path := s.path(doc.ID)
 
 	if doc.Doc == nil {
 		doc.Doc = automerge.New()
@@ -35,45 +43,38 @@ func (s *FsStore) Save(doc *repo.Document) error {
 		return s.Compact(doc)
 	}
 
-	data := doc.Doc.SaveIncremental()
-
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	if _, err := f.Write(data); err != nil {
-		return err
-	}
-
-	return nil
+	return s.AppendRaw(doc.ID, doc.Doc.SaveIncremental())
 }
 
 // Compact writes the full document to disk, replacing any incremental saves.
 func (s *FsStore) Compact(doc *repo.Document) error {
-	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
-		return err
-	}
-	path := filepath.Join(s.Dir, fmt.Sprintf("%s.automerge", doc.ID))
 	if doc.Doc == nil {
 		doc.Doc = automerge.New()
 	}
-	data := doc.Doc.Save()
-	return os.WriteFile(path, data, 0o644)
+	return s.WriteRaw(doc.ID, doc.Doc.Save())
 }
 
 // Load reads a document from disk. It can load both full snapshots and files
-// with incremental changes appended.
+// with incremental changes appended, whether or not they were compressed by
+// CompressedStore.
 func (s *FsStore) Load(id repo.DocumentID) (*repo.Document, error) {
-	path := filepath.Join(s.Dir, fmt.Sprintf("%s.automerge", id))
-	b, err := os.ReadFile(path)
+	b, err := s.ReadRaw(id)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			return nil, fmt.Errorf("document %s not found", id)
 		}
 		return nil, err
 	}
+	return decodeDocument(id, b)
+}
+
+// decodeDocument loads a document from stored bytes, decompressing any
+// frames written by CompressedStore.
+func decodeDocument(id repo.DocumentID, b []byte) (*repo.Document, error) {
+	b, err := decodeFrames(b)
+	if err != nil {
+		return nil, err
+	}
 	d, err := automerge.Load(b)
 	if err != nil {
 		return nil, err
@@ -81,6 +82,33 @@ func (s *FsStore) Load(id repo.DocumentID) (*repo.Document, error) {
 	return &repo.Document{ID: id, Doc: d}, nil
 }
 
+// ReadRaw returns the contents of the document's file.
+func (s *FsStore) ReadRaw(id repo.DocumentID) ([]byte, error) {
+	return os.ReadFile(s.path(id))
+}
+
+// AppendRaw appends data to the document's file, creating it if needed.
+func (s *FsStore) AppendRaw(id repo.DocumentID, data []byte) error {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path(id), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+// WriteRaw atomically replaces the document's file with data.
+func (s *FsStore) WriteRaw(id repo.DocumentID, data []byte) error {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(id), data)
+}
+
 // List returns all document IDs currently stored on disk.
 func (s *FsStore) List() ([]repo.DocumentID, error) {
 	var ids []repo.DocumentID
@@ -104,4 +132,42 @@ func (s *FsStore) List() ([]repo.DocumentID, error) {
 		ids = append(ids, id)
 	}
 	return ids, nil
-}
\ No newline at end of file
+}
+
+// Remove deletes the document's file from disk.
+func (s *FsStore) Remove(id repo.DocumentID) error {
+	if err := os.Remove(s.path(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so an interrupted write never leaves a half-written document.
+// Temporary files left behind by a crash are reported by Verify.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, 0o644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// path returns the location of the document's file.
+func (s *FsStore) path(id repo.DocumentID) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("%s.automerge", id))
+}
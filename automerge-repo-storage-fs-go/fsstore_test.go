@@ -48,3 +48,66 @@ func TestFsStoreSaveLoadList(t *testing.T) {
 		t.Fatalf("unexpected ids: %v", ids)
 	}
 }
+
+func TestFsStoreRemove(t *testing.T) {
+	dir := t.TempDir()
+	store := &storage.FsStore{Dir: dir}
+
+	doc := &repo.Document{ID: uuid.New(), Doc: automerge.New()}
+	if err := doc.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := store.Save(doc); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := store.Remove(doc.ID); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if _, err := store.Load(doc.ID); err == nil {
+		t.Fatalf("expected document to be gone")
+	}
+	// removing a missing document is not an error
+	if err := store.Remove(doc.ID); err != nil {
+		t.Fatalf("second Remove failed: %v", err)
+	}
+}
+
+func TestFsStoreTombstones(t *testing.T) {
+	dir := t.TempDir()
+	store := &storage.FsStore{Dir: dir}
+
+	r := repo.NewWithStore(store)
+	doc := r.NewDoc()
+	if err := doc.Set("foo", "bar"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if err := r.SaveDoc(doc.ID); err != nil {
+		t.Fatalf("SaveDoc failed: %v", err)
+	}
+	if err := r.Delete(doc.ID, repo.DeleteOptions{Tombstone: true}); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	tombstones, err := store.Tombstones()
+	if err != nil {
+		t.Fatalf("Tombstones failed: %v", err)
+	}
+	if opts, ok := tombstones[doc.ID]; !ok || !opts.Tombstone {
+		t.Fatalf("expected tombstone for %s, got %v", doc.ID, tombstones)
+	}
+
+	// a repo opened on the same directory still knows the document is deleted
+	r2 := repo.NewWithStore(store)
+	if err := r2.SaveDoc(doc.ID); err != repo.ErrDocumentDeleted {
+		t.Fatalf("expected ErrDocumentDeleted, got %v", err)
+	}
+
+	if err := store.RemoveTombstone(doc.ID); err != nil {
+		t.Fatalf("RemoveTombstone failed: %v", err)
+	}
+	if err := store.RemoveTombstone(doc.ID); err != nil {
+		t.Fatalf("second RemoveTombstone failed: %v", err)
+	}
+	if tombstones, _ := store.Tombstones(); len(tombstones) != 0 {
+		t.Fatalf("expected no tombstones, got %v", tombstones)
+	}
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/automerge/automerge-repo-go"
+	"github.com/google/uuid"
+)
+
+// TombstoneDir is the subdirectory of FsStore.Dir that holds a file for every
+// deleted document.
+const TombstoneDir = "tombstones"
+
+// tombstoneFile is the content of a tombstone file.
+type tombstoneFile struct {
+	Tombstone bool `json:"tombstone"`
+}
+
+// SaveTombstone records that the document was deleted.
+func (s *FsStore) SaveTombstone(id repo.DocumentID, opts repo.DeleteOptions) error {
+	dir := filepath.Join(s.Dir, TombstoneDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(tombstoneFile{Tombstone: opts.Tombstone})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.tombstonePath(id), data)
+}
+
+// RemoveTombstone forgets the deletion of a document.
+func (s *FsStore) RemoveTombstone(id repo.DocumentID) error {
+	if err := os.Remove(s.tombstonePath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Tombstones returns every recorded deletion.
+func (s *FsStore) Tombstones() (map[repo.DocumentID]repo.DeleteOptions, error) {
+	out := make(map[repo.DocumentID]repo.DeleteOptions)
+	dir := filepath.Join(s.Dir, TombstoneDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return out, nil
+		}
+		return nil, err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, ".tombstone") {
+			continue
+		}
+		id, err := uuid.Parse(strings.TrimSuffix(name, ".tombstone"))
+		if err != nil {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var t tombstoneFile
+		if err := json.Unmarshal(b, &t); err != nil {
+			return nil, fmt.Errorf("tombstone %s: %w", id, err)
+		}
+		out[id] = repo.DeleteOptions{Tombstone: t.Tombstone}
+	}
+	return out, nil
+}
+
+// tombstonePath returns the location of the document's tombstone file.
+func (s *FsStore) tombstonePath(id repo.DocumentID) string {
+	return filepath.Join(s.Dir, TombstoneDir, fmt.Sprintf("%s.tombstone", id))
+}
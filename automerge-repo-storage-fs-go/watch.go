@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/automerge/automerge-repo-go"
+	"github.com/fsnotify/fsnotify"
+	"github.com/google/uuid"
+)
+
+// DefaultPollInterval is how often Watch scans the directory when it polls
+// and FsStore.PollInterval is zero.
+const DefaultPollInterval = time.Second
+
+// notifyDelay is how long Watch collects file system events before reporting
+// the documents they touched, so that a write is read once it is complete.
+const notifyDelay = 50 * time.Millisecond
+
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// Watch sends the ID of every document file that is created or modified in
+// the store directory, including by other processes or file-sync tools. It
+// uses file system notifications where the platform provides them and falls
+// back to polling the directory every PollInterval otherwise, or if
+// FsStore.Polling is set. The channel is closed when ctx is canceled.
+func (s *FsStore) Watch(ctx context.Context) (<-chan repo.DocumentID, error) {
+	if !s.Polling {
+		if ch, err := s.watchNotify(ctx); err == nil {
+			return ch, nil
+		}
+	}
+	return s.watchPoll(ctx)
+}
+
+// watchNotify implements Watch with fsnotify.
+func (s *FsStore) watchNotify(ctx context.Context) (<-chan repo.DocumentID, error) {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(s.Dir); err != nil {
+		w.Close()
+		return nil, err
+	}
+	ch := make(chan repo.DocumentID)
+	go func() {
+		defer close(ch)
+		defer w.Close()
+		pending := make(map[repo.DocumentID]struct{})
+		timer := time.NewTimer(notifyDelay)
+		timer.Stop()
+		add := func(id repo.DocumentID) {
+			if len(pending) == 0 {
+				timer.Reset(notifyDelay)
+			}
+			pending[id] = struct{}{}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+					continue
+				}
+				if id, ok := docFileID(filepath.Base(ev.Name)); ok {
+					add(id)
+				}
+			case _, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				// events may have been lost, so report every document
+				stamps, err := s.scan()
+				if err != nil {
+					continue
+				}
+				for id := range stamps {
+					add(id)
+				}
+			case <-timer.C:
+				for id := range pending {
+					delete(pending, id)
+					select {
+					case ch <- id:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// watchPoll implements Watch by scanning the directory every PollInterval.
+func (s *FsStore) watchPoll(ctx context.Context) (<-chan repo.DocumentID, error) {
+	interval := s.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	seen, err := s.scan()
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan repo.DocumentID)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			current, err := s.scan()
+			if err != nil {
+				continue
+			}
+			for id, stamp := range current {
+				if prev, ok := seen[id]; ok && prev == stamp {
+					continue
+				}
+				select {
+				case ch <- id:
+				case <-ctx.Done():
+					return
+				}
+			}
+			seen = current
+		}
+	}()
+	return ch, nil
+}
+
+// docFileID returns the ID of the document stored in the file called name.
+func docFileID(name string) (repo.DocumentID, bool) {
+	if !strings.HasSuffix(name, ".automerge") {
+		return repo.DocumentID{}, false
+	}
+	id, err := uuid.Parse(strings.TrimSuffix(name, ".automerge"))
+	return id, err == nil
+}
+
+// scan records the size and modification time of every document file.
+func (s *FsStore) scan() (map[repo.DocumentID]fileStamp, error) {
+	stamps := make(map[repo.DocumentID]fileStamp)
+	files, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return stamps, nil
+		}
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		id, ok := docFileID(f.Name())
+		if !ok {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		stamps[id] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+	}
+	return stamps, nil
+}
+
+// Watch reports documents changed in the underlying store, which must
+// implement repo.WatchableStorage; see FsStore.Watch.
+func (s *CompressedStore) Watch(ctx context.Context) (<-chan repo.DocumentID, error) {
+	ws, ok := s.Store.(repo.WatchableStorage)
+	if !ok {
+		return nil, fmt.Errorf("%T cannot be watched", s.Store)
+	}
+	return ws.Watch(ctx)
+}
@@ -0,0 +1,104 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	automerge "github.com/automerge/automerge-go"
+	"github.com/automerge/automerge-repo-go"
+	"github.com/automerge/automerge-repo-storage-fs-go"
+)
+
+func TestRepoWatchStorageMergesExternalWrites(t *testing.T) {
+	t.Run("notify", func(t *testing.T) {
+		// a poll interval this long means changes can only be seen through
+		// file system notifications
+		testWatchStorage(t, storage.FsStore{PollInterval: time.Hour})
+	})
+	t.Run("poll", func(t *testing.T) {
+		testWatchStorage(t, storage.FsStore{PollInterval: 5 * time.Millisecond, Polling: true})
+	})
+}
+
+func testWatchStorage(t *testing.T, store storage.FsStore) {
+	dir := t.TempDir()
+	store.Dir = dir
+	r := repo.NewWithStore(&store)
+	h := r.NewDocHandle()
+	if err := h.WithDocMut(func(doc *automerge.Doc) error {
+		return doc.RootMap().Set("local", "yes")
+	}); err != nil {
+		t.Fatalf("mutate err: %v", err)
+	}
+	if err := h.Save(); err != nil {
+		t.Fatalf("save err: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan repo.DocumentID, 4)
+	done, err := r.WatchStorage(ctx, func(id repo.DocumentID) { changed <- id })
+	if err != nil {
+		t.Fatalf("watch err: %v", err)
+	}
+
+	// another process writes to the same directory
+	other := repo.NewWithStore(&storage.FsStore{Dir: dir})
+	doc, err := other.LoadDoc(h.DocID())
+	if err != nil {
+		t.Fatalf("load err: %v", err)
+	}
+	notify := h.Changed()
+	if err := doc.Set("external", "yes"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := other.SaveDoc(doc.ID); err != nil {
+		t.Fatalf("save err: %v", err)
+	}
+
+	select {
+	case id := <-changed:
+		if id != h.DocID() {
+			t.Fatalf("unexpected document changed: %v", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for external change")
+	}
+	select {
+	case <-notify:
+	default:
+		t.Fatalf("expected change notification")
+	}
+	var local, external string
+	h.WithDoc(func(d *automerge.Doc) {
+		local, _ = automerge.As[string](d.RootMap().Get("local"))
+		external, _ = automerge.As[string](d.RootMap().Get("external"))
+	})
+	if local != "yes" || external != "yes" {
+		t.Fatalf("unexpected merged contents: %q %q", local, external)
+	}
+
+	// new documents written by others are picked up too
+	created := other.NewDoc()
+	if err := created.Set("k", "v"); err != nil {
+		t.Fatalf("set err: %v", err)
+	}
+	if err := other.SaveDoc(created.ID); err != nil {
+		t.Fatalf("save err: %v", err)
+	}
+	select {
+	case id := <-changed:
+		if id != created.ID {
+			t.Fatalf("unexpected document changed: %v", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for new document")
+	}
+	if _, ok := r.GetDoc(created.ID); !ok {
+		t.Fatalf("new document not added to repo")
+	}
+
+	cancel()
+	<-done
+}
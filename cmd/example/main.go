@@ -13,7 +13,8 @@ func usage() {
   example new                       create a new document
   example list                      list document IDs
   example set <id> <key> <value>    set a value in a document
-  example get <id> <key>            get a value from a document`)
+  example get <id> <key>            get a value from a document
+  example fsck [-repair]            check stored documents and optionally repair them`)
 }
 
 func main() {
@@ -77,6 +78,39 @@ func main() {
 		if v, ok := doc.Get(key); ok {
 			fmt.Println(v)
 		}
+	case "fsck":
+		repair := len(os.Args) == 3 && os.Args[2] == "-repair"
+		if len(os.Args) > 3 || (len(os.Args) == 3 && !repair) {
+			usage()
+			return
+		}
+		var report *repo.Report
+		var err error
+		if repair {
+			report, err = store.Repair()
+		} else {
+			report, err = store.Verify()
+		}
+		if err != nil {
+			panic(err)
+		}
+		for _, p := range report.Problems {
+			line := fmt.Sprintf("%s: %s", p.Path, p.Kind)
+			if p.Err != nil {
+				line += fmt.Sprintf(" (%v)", p.Err)
+			}
+			if repair {
+				line += fmt.Sprintf(" -> %s", p.Action)
+				if p.Salvaged > 0 {
+					line += fmt.Sprintf(", %d changes recovered", p.Salvaged)
+				}
+			}
+			fmt.Println(line)
+		}
+		fmt.Printf("%d documents checked, %d problems\n", report.Checked, len(report.Problems))
+		if !repair && !report.OK() {
+			os.Exit(1)
+		}
 	default:
 		usage()
 	}
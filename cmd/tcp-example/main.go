@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -21,6 +24,7 @@ var (
 	repoHandle *repo.RepoHandle
 	peers  []repo.RepoID
 	mu     sync.Mutex
+	transport repo.TCPTransport
 )
 
 func completer(d prompt.Document) []prompt.Suggest {
@@ -77,21 +81,17 @@ func executor(in string) {
 		})
 		fmt.Println(val)
 	case "view":
-		var data map[string]interface{}
-		docHandle.WithDoc(func(doc *automerge.Doc) {
-			var err error
-			data, err = automerge.As[map[string]interface{}](doc.Root())
-			if err != nil {
-				fmt.Println("error:", err)
-				return
-			}
-		})
-		b, err := json.MarshalIndent(data, "", "  ")
+		data, err := docHandle.JSON()
 		if err != nil {
 			fmt.Println("error:", err)
 			return
 		}
-		fmt.Println(string(b))
+		var b bytes.Buffer
+		if err := json.Indent(&b, data, "", "  "); err != nil {
+			fmt.Println("error:", err)
+			return
+		}
+		fmt.Println(b.String())
 	case "exit":
 		os.Exit(0)
 	default:
@@ -102,6 +102,9 @@ func executor(in string) {
 func main() {
 	listenAddr := flag.String("listen", "", "address to listen on")
 	connectAddr := flag.String("connect", "", "address to connect to")
+	certFile := flag.String("tls-cert", "", "TLS certificate; its common name is this peer's repo ID")
+	keyFile := flag.String("tls-key", "", "TLS private key")
+	caFile := flag.String("tls-ca", "", "CA certificates used to verify peers; requires client certificates when listening")
 	flag.Parse()
 
 	if *listenAddr == "" && *connectAddr == "" {
@@ -110,6 +113,17 @@ func main() {
 	}
 
 	r := repo.New()
+	if *certFile != "" || *caFile != "" {
+		cfg, id, err := tlsConfig(*certFile, *keyFile, *caFile)
+		if err != nil {
+			fmt.Println("tls error:", err)
+			os.Exit(1)
+		}
+		if id != nil {
+			r.ID = *id
+		}
+		transport.TLS = cfg
+	}
 	repoHandle = repo.NewRepoHandle(r)
 	docHandle = r.NewDocHandle()
 	docHandle.WithDocMut(func(doc *automerge.Doc) error {
@@ -139,8 +153,45 @@ func main() {
 	p.Run()
 }
 
+// tlsConfig loads the TLS configuration and, if a certificate is given, the
+// repo ID it is issued to.
+func tlsConfig(certFile, keyFile, caFile string) (*tls.Config, *repo.RepoID, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	var id *repo.RepoID
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		certID, err := repo.CertRepoID(leaf)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+		id = &certID
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+		cfg.RootCAs = pool
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, id, nil
+}
+
 func listen(addr string) {
-	ln, err := net.Listen("tcp", addr)
+	ln, err := transport.Listen(addr)
 	if err != nil {
 		fmt.Println("listen error:", err)
 		os.Exit(1)
@@ -157,23 +208,29 @@ func listen(addr string) {
 }
 
 func connect(addr string) {
-	conn, err := net.Dial("tcp", addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lp, remote, err := transport.Dial(ctx, addr, repoHandle.Repo.ID)
 	if err != nil {
 		fmt.Println("dial error:", err)
 		return
 	}
-	handleConnection(conn, repo.Outgoing)
+	addPeer(remote, lp)
 }
 
 func handleConnection(conn net.Conn, dir repo.ConnDirection) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	lp, remote, err := repo.Connect(ctx, conn, repoHandle.Repo.ID, dir)
+	lp, remote, err := transport.Handshake(ctx, conn, repoHandle.Repo.ID, dir)
 	if err != nil {
 		fmt.Println("handshake error:", err)
 		conn.Close()
 		return
 	}
+	addPeer(remote, lp)
+}
+
+func addPeer(remote repo.RepoID, lp *repo.LPConn) {
 	_ = repoHandle.AddConn(remote, lp)
 	mu.Lock()
 	peers = append(peers, remote)